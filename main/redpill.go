@@ -1,17 +1,20 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/infradash/redpill/pkg/conf"
-	_ "github.com/infradash/redpill/pkg/domain"
+	"github.com/infradash/redpill/pkg/domain"
 	"github.com/infradash/redpill/pkg/env"
+	"github.com/infradash/redpill/pkg/kv"
 	"github.com/infradash/redpill/pkg/mock"
 	"github.com/infradash/redpill/pkg/orchestrate"
 	"github.com/infradash/redpill/pkg/redpill"
 	"github.com/infradash/redpill/pkg/registry"
-	"github.com/qorio/maestro/pkg/zk"
+	"github.com/infradash/redpill/pkg/stats"
+	"github.com/qorio/maestro/pkg/pubsub"
 	"github.com/qorio/omni/auth"
 	"github.com/qorio/omni/rest"
 	"github.com/qorio/omni/runtime"
@@ -23,8 +26,13 @@ import (
 )
 
 const (
-	EnvPort    = "REDPILL_PORT"
-	EnvZkHosts = "REDPILL_ZK_HOSTS"
+	EnvPort         = "REDPILL_PORT"
+	EnvZkHosts      = "REDPILL_ZK_HOSTS"
+	EnvEnvSecretKey = "REDPILL_ENV_SECRET_KEY"
+	EnvKvBackend    = "REDPILL_KV_BACKEND"
+	EnvBoltFile     = "REDPILL_BOLT_FILE"
+	EnvLogBroker    = "REDPILL_LOG_BROKER"
+	EnvDocker       = "REDPILL_DOCKER"
 )
 
 var (
@@ -33,6 +41,23 @@ var (
 	port       = flag.Int("port", runtime.EnvInt(EnvPort, 5050), "Server listening port")
 	zk_hosts   = flag.String("zk_hosts", runtime.EnvString(EnvZkHosts, "localhost:2181"), "ZK hosts")
 	zk_timeout = flag.String("zk_timeout", "5s", "Zk timeout")
+
+	zk_sessions = flag.Int("zk_sessions", kv.ZkMaxSessions,
+		"Most ZK sessions open at once besides the main one, each a connection held by a registry lease")
+
+	kv_backend = flag.String("kv_backend", runtime.EnvString(EnvKvBackend, "zk"), "Key value store: zk or bolt")
+	bolt_file  = flag.String("bolt_file", runtime.EnvString(EnvBoltFile, "redpill.db"), "BoltDB file of the bolt store")
+
+	log_broker = flag.String("log_broker", runtime.EnvString(EnvLogBroker, ""),
+		"Broker of the topics the output of orchestrations is published to, e.g. mqtt://localhost:1883")
+
+	docker = flag.String("docker", runtime.EnvString(EnvDocker, "unix:///var/run/docker.sock"),
+		"Docker endpoint the orchestrations with a docker section run on")
+
+	stats_refresh = flag.Duration("stats_refresh", 30*time.Second, "How often the cached domain stats are refreshed")
+
+	env_secret_key = flag.String("env_secret_key", runtime.EnvString(EnvEnvSecretKey, ""),
+		"Base64 encoded AES key (16, 24 or 32 bytes) for secret environment variables")
 )
 
 func must_not(err error) {
@@ -57,11 +82,19 @@ func main() {
 	timeout, err := time.ParseDuration(*zk_timeout)
 	must_not(err)
 
-	zk_pool := func() zk.ZK {
+	var store kv.Store
+	switch *kv_backend {
+	case "zk":
 		glog.Infoln("Connecting to zookeeper:", *zk_hosts)
-		zc, err := zk.Connect(strings.Split(*zk_hosts, ","), timeout)
+		kv.ZkMaxSessions = *zk_sessions
+		store, err = kv.NewZkStore(strings.Split(*zk_hosts, ","), timeout)
 		must_not(err)
-		return zc
+	case "bolt":
+		glog.Infoln("Opening bolt store:", *bolt_file)
+		store, err = kv.OpenBoltStore(*bolt_file)
+		must_not(err)
+	default:
+		panic(fmt.Errorf("unknown kv backend: %s", *kv_backend))
 	}
 
 	redpillOptions := redpill.Options{
@@ -74,11 +107,20 @@ func main() {
 		ErrorRenderer: rest.ErrorRenderer,
 	})
 
-	env := env.NewService(zk_pool, mock.ListEnvs)
-	registry := registry.NewService(zk_pool)
-	domain := mock.NewDomainService()
-	orchestrate := orchestrate.NewService(zk_pool, mock.OrchestrationModelStorage, mock.OrchestrationInstanceStorage)
+	secret_key, err := base64.StdEncoding.DecodeString(*env_secret_key)
+	must_not(err)
+
+	env, err := env.NewService(store, secret_key)
+	must_not(err)
+
+	registry := registry.NewService(store)
+	domain := domain.NewService(store)
+	instances := orchestrate.NewInstanceStorage(store)
+	orchestrate := orchestrate.NewService(store, mock.OrchestrationModelStorage,
+		func() orchestrate.InstanceStorage { return instances },
+		pubsub.Broker(*log_broker), *docker)
 	confs := conf.NewService(mock.ConfStorage)
+	domainStats := stats.NewService(env, domain, orchestrate, *stats_refresh)
 
 	endpoint, err := redpill.NewApi(
 		redpillOptions,
@@ -88,6 +130,7 @@ func main() {
 		registry,
 		orchestrate,
 		confs,
+		domainStats,
 	)
 
 	if err != nil {
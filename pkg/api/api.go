@@ -4,6 +4,7 @@ import (
 	"github.com/qorio/omni/api"
 	"github.com/qorio/omni/version"
 	"net/http"
+	"time"
 )
 
 const (
@@ -14,6 +15,7 @@ const (
 	ScopeEnvironmentReadonly api.AuthScope = iota
 	ScopeEnvironmentUpdate
 	ScopeEnvironmentAdmin
+	ScopeEnvironmentReveal
 
 	ScopeRegistryReadonly
 	ScopeRegistryUpdate
@@ -37,6 +39,7 @@ var AuthScopes = api.AuthScopes{
 	ScopeEnvironmentReadonly:      "env-readonly",
 	ScopeEnvironmentUpdate:        "env-update",
 	ScopeEnvironmentAdmin:         "env-admin",
+	ScopeEnvironmentReveal:        "env-reveal",
 	ScopeRegistryReadonly:         "registry-readonly",
 	ScopeRegistryUpdate:           "registry-update",
 	ScopeRegistryAdmin:            "registry-admin",
@@ -62,22 +65,59 @@ const (
 	// Domains
 	ListDomains
 	GetDomain
+	CreateDomain
+	UpdateDomain
+	DeleteDomain
+	AddDomainInstance
+	RetireDomainInstance
+	GetDomainMembers
+	UpdateDomainMembers
+	GetDomainStats
 
 	// Environments
 	ListEnvironmentVars
 	GetEnvironmentVars
 	CreateEnvironmentVars
 	UpdateEnvironmentVars
+	ListEnvironmentHistory
+	GetEnvironmentVarsAtRevision
+	RollbackEnvironmentVars
+	DiffEnvironmentVars
+	PromoteEnvironmentVars
+	RevealEnvironmentVars
+	ValidateEnvironmentVars
+	GetEnvironmentSchema
+	UpdateEnvironmentSchema
+	ResolveEnvironmentVars
+	GetClassEnvironmentVars
+	CreateClassEnvironmentVars
+	UpdateClassEnvironmentVars
+	GetInstanceEnvironmentVars
+	CreateInstanceEnvironmentVars
+	UpdateInstanceEnvironmentVars
+	WatchEnvironmentVars
 
 	GetRegistryEntry
+	ListRegistryRoot
 	UpdateRegistryEntry
 	DeleteRegistryEntry
+	RegistryTransaction
+	ExportRegistry
+	ImportRegistry
+	WatchRegistry
+	SearchRegistry
+	GrantRegistryLease
+	KeepAliveRegistryLease
+	RevokeRegistryLease
+	GetRegistryAcl
+	UpdateRegistryAcl
 
 	ListOrchestrations
 	StartOrchestration
 	WatchOrchestration
 	ListOrchestrationInstances
 	GetOrchestrationInstance
+	CancelOrchestration
 
 	GetOrchestrationModel
 	CreateOrchestrationModel
@@ -113,7 +153,7 @@ Returns build info
 	ListDomains: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeDomainReadonly],
 		Doc: `
-List domains that the user has access to.
+List domains that the user is a member of, or that have no members.
 `,
 		UrlRoute:   "/v1/domain/",
 		HttpMethod: "GET",
@@ -134,6 +174,120 @@ Get information on the domain
 		},
 	},
 
+	CreateDomain: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainAdmin],
+		Doc: `
+Create a domain class with its name, description and owners.  It has no instances yet.
+`,
+		UrlRoute:     "/v1/domain/",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(Domain)
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(DomainDetail)
+		},
+	},
+
+	UpdateDomain: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainUpdate],
+		Doc: `
+Replace the name, description and owners of the domain class
+`,
+		UrlRoute:     "/v1/domain/{domain_class}",
+		HttpMethod:   "PUT",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(Domain)
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(DomainDetail)
+		},
+	},
+
+	DeleteDomain: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainAdmin],
+		Doc: `
+Delete the domain class.  All its instances must be retired first.
+`,
+		UrlRoute:   "/v1/domain/{domain_class}",
+		HttpMethod: "DELETE",
+	},
+
+	AddDomainInstance: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainUpdate],
+		Doc: `
+Add an instance to the domain class, with its description, owners and tier: development, test,
+staging or production.  A retired instance can be added again.
+`,
+		UrlRoute:     "/v1/domain/{domain_class}/instance/",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(DomainInstance)
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(DomainDetail)
+		},
+	},
+
+	RetireDomainInstance: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainUpdate],
+		Doc: `
+Retire an instance of the domain class.  It is no longer listed in the instances of the domain
+but is kept in its instance info, with the time it was retired.
+`,
+		UrlRoute:   "/v1/domain/{domain_class}/instance/{domain_instance}",
+		HttpMethod: "DELETE",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(DomainDetail)
+		},
+	},
+
+	GetDomainMembers: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainReadonly],
+		Doc: `
+List the users and groups with a role in the domain class or in one of its instances.  The
+roles are viewer, editor and admin.
+`,
+		UrlRoute:   "/v1/domain/{domain_class}/members",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(DomainMembers)
+		},
+	},
+
+	UpdateDomainMembers: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainUpdate],
+		Doc: `
+Replace the members of the domain class.  Only its admins can.  A domain class with no
+members is open to all.
+`,
+		UrlRoute:     "/v1/domain/{domain_class}/members",
+		HttpMethod:   "PUT",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(DomainMembers)
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(DomainMembers)
+		},
+	},
+
+	GetDomainStats: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeDomainReadonly],
+		Doc: `
+Counts of the instances, services, versions and orchestration runs of the domain class.
+They are cached and refreshed in the background, and are as of their update_time.
+`,
+		UrlRoute:   "/v1/domain/{domain_class}/stats",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(DomainStats)
+		},
+	},
+
 	///////////////////////////////////////// ENV /////////////////////////////////////////////
 	ListEnvironmentVars: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeDomainReadonly],
@@ -150,10 +304,15 @@ List all environment variables in a domain
 	GetEnvironmentVars: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
 		Doc: `
-Get environment variables
+Get environment variables.  Values of secret keys are masked.
+The output is json, dotenv, yaml or shell (export K=V), chosen by the format query or
+the Accept header.
 `,
 		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}",
 		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"format": "", // json, dotenv, yaml or shell
+		},
 		ResponseBody: func(req *http.Request) interface{} {
 			return new(EnvList)
 		},
@@ -162,11 +321,16 @@ Get environment variables
 	CreateEnvironmentVars: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
 		Doc: `
-Create environment variables for a new domain/ environment
+Create environment variables for a new domain/ environment.
+The body is json, dotenv, yaml or shell, chosen by the format query or the Content-Type.
 `,
 		UrlRoute:     "/v1/env/{domain_class}/{domain_instance}/{service}/{version}",
 		HttpMethod:   "POST",
 		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"format": "", // json, dotenv, yaml or shell
+			"secret": "", // comma separated keys to encrypt
+		},
 		RequestBody: func(req *http.Request) interface{} {
 			return new(EnvList)
 		},
@@ -175,11 +339,262 @@ Create environment variables for a new domain/ environment
 	UpdateEnvironmentVars: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
 		Doc: `
-Update environment variables
+Update environment variables.  A json body is an EnvChange.  A body in any other format
+is a list of keys to add or update, or with replace=true the full env: keys that are
+not in it are deleted.  Masked values of secret keys are left as they are.
 `,
 		UrlRoute:     "/v1/env/{domain_class}/{domain_instance}/{service}/{version}",
 		HttpMethod:   "PATCH",
 		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"format":  "",    // json, dotenv, yaml or shell
+			"replace": false, // true if the body is the full env
+			"secret":  "",    // comma separated keys to encrypt
+		},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(EnvChange)
+		},
+	},
+
+	ListEnvironmentHistory: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+List the changes made to the environment variables, oldest first
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/history",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return []EnvHistoryEntry{}
+		},
+	},
+
+	GetEnvironmentVarsAtRevision: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Get environment variables as of a revision.  No X-Dash-Version is returned; use the
+current env's version to update it or to roll back to the revision.
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/history/{revision}",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(EnvList)
+		},
+	},
+
+	RollbackEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
+		Doc: `
+Roll back environment variables to a revision.  The rollback is recorded as a new change.
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/rollback/{revision}",
+		HttpMethod: "POST",
+	},
+
+	DiffEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Compare environment variables against those of another domain instance, service and version.
+Added and changed keys are what promoting to the target would change.
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/diff/{to_instance}/{to_service}/{to_version}",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(EnvDiff)
+		},
+	},
+
+	PromoteEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
+		Doc: `
+Apply the listed keys of the diff to the target as a single change
+`,
+		UrlRoute:     "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/promote/{to_instance}/{to_service}/{to_version}",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(EnvPromotion)
+		},
+	},
+
+	RevealEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReveal],
+		Doc: `
+Get environment variables with the secrets decrypted.  This is how agents get the actual values.
+Every reveal is audited.
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/reveal",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(EnvList)
+		},
+	},
+
+	ValidateEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Check the environment variables against the schema of the service
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/validate",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(EnvValidation)
+		},
+	},
+
+	GetEnvironmentSchema: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Get the schema of the environment variables of a service in a domain
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{service}/schema",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(EnvSchema)
+		},
+	},
+
+	UpdateEnvironmentSchema: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentAdmin],
+		Doc: `
+Set the schema of the environment variables of a service in a domain.  New and updated
+environment variables are checked against it.
+`,
+		UrlRoute:     "/v1/env/{domain_class}/{service}/schema",
+		HttpMethod:   "PUT",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(EnvSchema)
+		},
+	},
+
+	WatchEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Websocket that sends a message for each key that is added, changed or deleted, with the
+revision after the change.  Values of secret keys are masked.
+`,
+		UrlRoute:   "/v1/ws/env/{domain_class}/{domain_instance}/{service}/{version}",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return []EnvChangeEvent{}
+		},
+	},
+
+	ResolveEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Get the effective environment variables of a version, with the layer each value comes from.
+Values set for the version override the ones set for the domain instance, which override
+the ones set for the domain class.  Values of secret keys are masked.
+`,
+		UrlRoute:   "/v1/env/{domain_class}/{domain_instance}/{service}/{version}/resolved",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return map[string]EnvResolvedValue{}
+		},
+	},
+
+	GetClassEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Get environment variables set for the domain class.  They are inherited by all
+instances and versions of the service.
+`,
+		UrlRoute:   "/v1/env-layer/{domain_class}/{service}",
+		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"format": "", // json, dotenv, yaml or shell
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(EnvList)
+		},
+	},
+
+	CreateClassEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
+		Doc: `
+Create environment variables for the domain class.  They are inherited by all
+instances and versions of the service.
+`,
+		UrlRoute:     "/v1/env-layer/{domain_class}/{service}",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"format": "", // json, dotenv, yaml or shell
+			"secret": "", // comma separated keys to encrypt
+		},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(EnvList)
+		},
+	},
+
+	UpdateClassEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
+		Doc: `
+Update environment variables of the domain class.  They are inherited by all
+instances and versions of the service.
+`,
+		UrlRoute:     "/v1/env-layer/{domain_class}/{service}",
+		HttpMethod:   "PATCH",
+		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"format":  "",    // json, dotenv, yaml or shell
+			"replace": false, // true if the body is the full env
+			"secret":  "",    // comma separated keys to encrypt
+		},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(EnvChange)
+		},
+	},
+
+	GetInstanceEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentReadonly],
+		Doc: `
+Get environment variables set for the domain instance.  They are inherited by all
+versions of the service in the instance and override the ones of the domain class.
+`,
+		UrlRoute:   "/v1/env-layer/{domain_class}/{domain_instance}/{service}",
+		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"format": "", // json, dotenv, yaml or shell
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(EnvList)
+		},
+	},
+
+	CreateInstanceEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
+		Doc: `
+Create environment variables for the domain instance.  They are inherited by all
+versions of the service in the instance and override the ones of the domain class.
+`,
+		UrlRoute:     "/v1/env-layer/{domain_class}/{domain_instance}/{service}",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"format": "", // json, dotenv, yaml or shell
+			"secret": "", // comma separated keys to encrypt
+		},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(EnvList)
+		},
+	},
+
+	UpdateInstanceEnvironmentVars: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeEnvironmentUpdate],
+		Doc: `
+Update environment variables of the domain instance.  They are inherited by all
+versions of the service in the instance and override the ones of the domain class.
+`,
+		UrlRoute:     "/v1/env-layer/{domain_class}/{domain_instance}/{service}",
+		HttpMethod:   "PATCH",
+		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"format":  "",    // json, dotenv, yaml or shell
+			"replace": false, // true if the body is the full env
+			"secret":  "",    // comma separated keys to encrypt
+		},
 		RequestBody: func(req *http.Request) interface{} {
 			return new(EnvChange)
 		},
@@ -199,26 +614,57 @@ Main events feed
 	GetRegistryEntry: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeRegistryReadonly],
 		Doc: `
-Get registry key
+Get registry key.  With list=true the children of the key are listed.  With depth=N the
+subtree is returned as nested RegistryNodes, N levels deep.
 `,
 		UrlRoute:   "/v1/reg/{path:" + PathRegex + "}",
 		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"list":  false,
+			"depth": 0,
+		},
 		ResponseBody: func(req *http.Request) interface{} {
 			return new(RegistryEntry)
 		},
 	},
 
+	ListRegistryRoot: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryReadonly],
+		Doc: `
+List the top of the registry.  With depth=N the tree is returned N levels deep.
+`,
+		UrlRoute:   "/v1/reg/",
+		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"depth": 1,
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistryNode)
+		},
+	},
+
 	UpdateRegistryEntry: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeRegistryUpdate],
 		Doc: `
-Update registry key
+Update registry key.  With ephemeral=true or sequential=true a new entry is created instead.
+An ephemeral entry is removed when the lease given by lease expires or is revoked.  The name
+of a sequential entry is the key with a number assigned by the server appended.  The entry
+created is returned.
 `,
 		UrlRoute:     "/v1/reg/{path:" + PathRegex + "}",
 		HttpMethod:   "POST",
 		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"ephemeral":  false,
+			"sequential": false,
+			"lease":      "",
+		},
 		RequestBody: func(req *http.Request) interface{} {
 			return new(RegistryEntry)
 		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistryEntry)
+		},
 	},
 
 	DeleteRegistryEntry: api.MethodSpec{
@@ -231,6 +677,170 @@ Update registry key
 		ContentTypes: []string{"application/json"},
 	},
 
+	RegistryTransaction: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryUpdate],
+		Doc: `
+Apply check, set, create and delete operations to registry entries in one transaction.
+Check, set and delete give the version the entry must be at.  Returns the new version of each
+entry.  If an operation fails nothing is written, and the response is a 409 with the index of
+the operation and the reason it failed.
+`,
+		UrlRoute:     "/v1/reg-txn/",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(RegistryTxn)
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistryTxnResult)
+		},
+	},
+
+	ExportRegistry: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryReadonly],
+		Doc: `
+Export the subtree at the path, with the paths, values and versions of all the entries.
+The format is json or tar.
+`,
+		UrlRoute:   "/v1/reg-snapshot/{path:" + PathRegex + "}",
+		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"format": "json",
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistrySnapshot)
+		},
+	},
+
+	ImportRegistry: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryAdmin],
+		Doc: `
+Import an exported subtree at the path, in one transaction.  Existing entries with a different
+value are left alone with mode=skip and set with mode=overwrite.  With dry_run=true nothing is
+written.  Returns the entries that are (or would be) created, updated, skipped or unchanged.
+The body is json or, with format=tar or a Content-Type of application/x-tar, tar.
+`,
+		UrlRoute:     "/v1/reg-snapshot/{path:" + PathRegex + "}",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		UrlQueries: api.UrlQueries{
+			"format":  "",
+			"mode":    RegistryImportSkip,
+			"dry_run": false,
+		},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(RegistrySnapshot)
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistryImportResult)
+		},
+	},
+
+	WatchRegistry: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryReadonly],
+		Doc: `
+Websocket that sends the current value and version of the entry, then a message for each
+change to its value, its children and its removal.  With recursive=true all the entries
+under it are watched as well.
+`,
+		UrlRoute:   "/v1/ws/reg/{path:" + PathRegex + "}",
+		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"recursive": false,
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return []RegistryChangeEvent{}
+		},
+	},
+
+	SearchRegistry: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryReadonly],
+		Doc: `
+Search the subtree at the path for entries whose name matches the glob key (or whose path
+does, if key starts with /), whose value contains value, and whose value matches the regular
+expression value_regex.  At least one of them is needed.  The search goes depth levels down
+and returns at most limit entries, shallowest first.
+`,
+		UrlRoute:   "/v1/reg-search/{path:" + PathRegex + "}",
+		HttpMethod: "GET",
+		UrlQueries: api.UrlQueries{
+			"key":         "",
+			"value":       "",
+			"value_regex": "",
+			"depth":       5,
+			"limit":       100,
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistrySearchResult)
+		},
+	},
+
+	GrantRegistryLease: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryUpdate],
+		Doc: `
+Grant a lease for ephemeral entries.  The lease expires unless it is kept alive within its
+ttl, in seconds, and its entries are removed.  Each lease holds a connection to the store, so
+only so many can be held at once; past that, 429 too-many-leases.  Revoke leases no longer
+needed rather than wait for them to expire.
+`,
+		UrlRoute:     "/v1/reg-lease/",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(RegistryLease)
+		},
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistryLease)
+		},
+	},
+
+	KeepAliveRegistryLease: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryUpdate],
+		Doc: `
+Keep a lease alive for another ttl
+`,
+		UrlRoute:   "/v1/reg-lease/{lease}",
+		HttpMethod: "PUT",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistryLease)
+		},
+	},
+
+	RevokeRegistryLease: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryUpdate],
+		Doc: `
+Revoke a lease and remove its ephemeral entries
+`,
+		UrlRoute:   "/v1/reg-lease/{lease}",
+		HttpMethod: "DELETE",
+	},
+
+	GetRegistryAcl: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryAdmin],
+		Doc: `
+Get the access control rules of the registry.  The version is in the X-Dash-Version header.
+`,
+		UrlRoute:   "/v1/reg-acl/",
+		HttpMethod: "GET",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(RegistryAcl)
+		},
+	},
+
+	UpdateRegistryAcl: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeRegistryAdmin],
+		Doc: `
+Replace the access control rules of the registry.  The X-Dash-Version header must have the
+version that was read.
+`,
+		UrlRoute:     "/v1/reg-acl/",
+		HttpMethod:   "PUT",
+		ContentTypes: []string{"application/json"},
+		RequestBody: func(req *http.Request) interface{} {
+			return new(RegistryAcl)
+		},
+	},
+
 	ListOrchestrations: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeOrchestrateReadonly],
 		Doc: `
@@ -276,7 +886,10 @@ Start an orchestration instance
 	GetOrchestrationInstance: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeOrchestrateStart],
 		Doc: `
-Get an orchestration instance
+Get an orchestration instance.  Its status is Pending, Running, Succeeded, Failed, Cancelled
+or TimedOut, and its info has the history of the changes of its status.  It is stopped and
+TimedOut once it has run for the timeout of its model.  Those left Pending or Running by a
+restart of redpill are Failed with the error interrupted.
 `,
 		UrlRoute:     "/v1/orchestrate/{domain_class}/{domain_instance}/{orchestration}/{instance_id}",
 		HttpMethod:   "GET",
@@ -286,6 +899,19 @@ Get an orchestration instance
 		},
 	},
 
+	CancelOrchestration: api.MethodSpec{
+		AuthScope: AuthScopes[ScopeOrchestrateStart],
+		Doc: `
+Cancel an orchestration instance that has not completed.  What it runs is asked to stop and
+is killed if it has not stopped after a grace period.  Those watching its log are told.
+`,
+		UrlRoute:   "/v1/orchestrate/{domain_class}/{domain_instance}/{orchestration}/{instance_id}",
+		HttpMethod: "DELETE",
+		ResponseBody: func(req *http.Request) interface{} {
+			return new(OrchestrationInstance)
+		},
+	},
+
 	WatchOrchestration: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeOrchestrateReadonly],
 		Doc: `
@@ -303,7 +929,7 @@ Watch the feed of an orchestration instance
 	CreateOrchestrationModel: api.MethodSpec{
 		AuthScope: AuthScopes[ScopeOrchestrateModelUpdate],
 		Doc: `
-Create or update the model for an orchestration
+Create or update the model for an orchestration.  Its timeout, if any, is a duration like 30m.
 `,
 		UrlRoute:     "/v1/model/{domain_class}",
 		HttpMethod:   "POST",
@@ -505,23 +1131,86 @@ type Event struct {
 	ObjectType  string `json:"object_type"`
 }
 
+// Owner is the id of the ZK session of an ephemeral entry, and Lease the lease that holds
+// it if the lease was granted by this server.
 type RegistryEntry struct {
-	Path  string `json:"path"`
-	Value string `json:"value"`
+	Path       string   `json:"path"`
+	Value      string   `json:"value"`
+	Version    Revision `json:"version,omitempty"`
+	Ephemeral  bool     `json:"ephemeral,omitempty"`
+	Sequential bool     `json:"sequential,omitempty"`
+	Owner      string   `json:"owner,omitempty"`
+	Lease      string   `json:"lease,omitempty"`
+}
+
+// A node in a listing of the registry, with its children to the depth asked for.
+// NumChildren is the number of children whether they are listed or not.
+type RegistryNode struct {
+	Path        string          `json:"path"`
+	Name        string          `json:"name"`
+	Value       string          `json:"value"`
+	Version     Revision        `json:"version"`
+	NumChildren int32           `json:"num_children"`
+	Children    []*RegistryNode `json:"children,omitempty"`
 }
 
 type Domain struct {
-	Id    string `json:"id"`
-	Class string `json:"class"`
-	Name  string `json:"name"`
-	Url   string `json:"url"`
+	Id          string   `json:"id"`
+	Class       string   `json:"class"`
+	Name        string   `json:"name"`
+	Url         string   `json:"url"`
+	Description string   `json:"description,omitempty"`
+	Owners      []string `json:"owners,omitempty"`
 }
 
+// Instances are the names of the instances in service.  InstanceInfo has all the instances,
+// including the retired ones.
 type DomainDetail struct {
-	Id        string   `json:"id"`
-	Class     string   `json:"class"`
-	Name      string   `json:"name"`
-	Instances []string `json:"instances"`
+	Id           string           `json:"id"`
+	Class        string           `json:"class"`
+	Name         string           `json:"name"`
+	Description  string           `json:"description,omitempty"`
+	Owners       []string         `json:"owners,omitempty"`
+	Instances    []string         `json:"instances"`
+	InstanceInfo []DomainInstance `json:"instance_info,omitempty"`
+}
+
+const (
+	DomainTierDevelopment = "development"
+	DomainTierTest        = "test"
+	DomainTierStaging     = "staging"
+	DomainTierProduction  = "production"
+)
+
+// An instance of a domain class, like production in production.blinker.com.  A retired
+// instance is kept, with the time it was retired, until its domain class is deleted.
+type DomainInstance struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Owners      []string   `json:"owners,omitempty"`
+	Tier        string     `json:"tier,omitempty"`
+	CreateTime  time.Time  `json:"create_time"`
+	RetireTime  *time.Time `json:"retire_time,omitempty"`
+}
+
+const (
+	DomainRoleViewer = "viewer"
+	DomainRoleEditor = "editor"
+	DomainRoleAdmin  = "admin"
+)
+
+// A role in a domain class for a user or for the members of a group.  With an instance the
+// role is only in that instance of the class.
+type DomainMember struct {
+	User     string `json:"user,omitempty"`
+	Group    string `json:"group,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Role     string `json:"role"`
+}
+
+// A domain class with no members is open to all the users with the domain scopes.
+type DomainMembers struct {
+	Members []DomainMember `json:"members"`
 }
 
 type StartOrchestrationRequest struct {
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	. "gopkg.in/check.v1"
 	"testing"
 )
@@ -19,3 +20,147 @@ func (suite *ApiTests) TestGetEnvironmentVars(c *C) {
 	c.Assert(len(change.Update), Equals, 0)
 	c.Assert(len(change.Delete), Equals, 0)
 }
+
+func (suite *ApiTests) TestEnvFormatRoundTrip(c *C) {
+	list := EnvList{
+		"DB_HOST":  "localhost",
+		"GREETING": "hello world",
+		"QUOTED":   `it's "quoted" $HOME`,
+		"MULTI":    "line1\nline2",
+		"EMPTY":    "",
+		"FLAG":     "true",
+	}
+	for _, format := range []string{EnvFormatJSON, EnvFormatDotenv, EnvFormatYAML, EnvFormatShell} {
+		buff, err := list.Format(format)
+		c.Assert(err, Equals, nil)
+		c.Log(format, "\n", string(buff))
+
+		parsed, err := ParseEnvList(format, buff)
+		c.Assert(err, Equals, nil)
+		c.Assert(parsed, DeepEquals, list)
+	}
+
+	_, err := list.Format("xml")
+	c.Assert(err, Equals, ErrUnknownEnvFormat)
+}
+
+func (suite *ApiTests) TestEnvFormatOutput(c *C) {
+	list := EnvList{"B": "two words", "A": "1"}
+
+	buff, err := list.Format(EnvFormatDotenv)
+	c.Assert(err, Equals, nil)
+	c.Assert(string(buff), Equals, "A=1\nB=\"two words\"\n")
+
+	buff, err = list.Format(EnvFormatShell)
+	c.Assert(err, Equals, nil)
+	c.Assert(string(buff), Equals, "export A=1\nexport B='two words'\n")
+
+	buff, err = list.Format(EnvFormatYAML)
+	c.Assert(err, Equals, nil)
+	c.Assert(string(buff), Equals, "A: \"1\"\nB: \"two words\"\n")
+}
+
+func (suite *ApiTests) TestParseDotenv(c *C) {
+	list, err := ParseEnvList(EnvFormatDotenv, []byte(`
+# comment
+export A=1
+B = two # trailing comment
+C='single # not a comment'
+D="escaped \"quote\""
+`))
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, EnvList{"A": "1", "B": "two", "C": "single # not a comment", "D": `escaped "quote"`})
+
+	_, err = ParseEnvList(EnvFormatDotenv, []byte("NO_EQUALS\n"))
+	c.Assert(err, Equals, ErrBadEnvFormat)
+
+	_, err = ParseEnvList(EnvFormatDotenv, []byte("A='unterminated\n"))
+	c.Assert(err, Equals, ErrBadEnvFormat)
+}
+
+func (suite *ApiTests) TestParseKubernetesYAML(c *C) {
+	list, err := ParseEnvList(EnvFormatYAML, []byte(`
+env:
+  - name: DB_HOST
+    value: localhost
+  - name: DB_PORT
+    value: "5432"
+  - name: PASSWORD
+    valueFrom:
+      secretKeyRef:
+        name: db
+        key: password
+    value: 'it''s'
+`))
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, EnvList{"DB_HOST": "localhost", "DB_PORT": "5432", "PASSWORD": "it's"})
+
+	// Only the items under env are vars
+	list, err = ParseEnvList(EnvFormatYAML, []byte(`
+ports:
+  - name: http
+    value: 80
+HOST: example.com
+env:
+  - name: DB_HOST
+    value: localhost
+    valueFrom:
+      - name: nested
+        value: 1
+  - name: DB_PORT
+    value: "5432"
+volumes:
+- name: data
+`))
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, EnvList{"HOST": "example.com", "DB_HOST": "localhost", "DB_PORT": "5432"})
+}
+
+// Read as yaml, not a subset of it
+func (suite *ApiTests) TestParseYAML(c *C) {
+	list, err := ParseEnvList(EnvFormatYAML, []byte(`
+defaults: &defaults
+  name: POOL_SIZE
+  value: 10
+VERSION: 1.0
+ENABLED: true
+UNSET:
+MOTD: |
+  line1
+  line2
+FLOW: {a: 1}
+env: [{name: DB_HOST, value: localhost}, *defaults]
+`))
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, EnvList{"VERSION": "1.0", "ENABLED": "true", "MOTD": "line1\nline2\n",
+		"DB_HOST": "localhost", "POOL_SIZE": "10"})
+
+	for _, bad := range []string{"- A\n- B\n", "A: [\n", "env:\n  - value: x\n"} {
+		_, err = ParseEnvList(EnvFormatYAML, []byte(bad))
+		c.Assert(err, Equals, ErrBadEnvFormat)
+	}
+}
+
+func (suite *ApiTests) TestEnvFormatForContentType(c *C) {
+	c.Assert(EnvFormatForContentType("application/json; charset=utf-8"), Equals, EnvFormatJSON)
+	c.Assert(EnvFormatForContentType("text/yaml"), Equals, EnvFormatYAML)
+	c.Assert(EnvFormatForContentType("text/plain"), Equals, EnvFormatDotenv)
+	c.Assert(EnvFormatForContentType("image/png"), Equals, "")
+	c.Assert(EnvFormatContentType(EnvFormatShell), Equals, "text/x-sh")
+}
+
+func (suite *ApiTests) TestRegistrySnapshotTar(c *C) {
+	snapshot := &RegistrySnapshot{
+		Entries: []RegistryEntry{
+			{Path: "/", Value: "root", Version: 1},
+			{Path: "/a", Value: "", Version: 0},
+			{Path: "/a/b", Value: "line1\nline2", Version: 12},
+		},
+	}
+	var buff bytes.Buffer
+	c.Assert(snapshot.WriteTar(&buff), Equals, nil)
+
+	read, err := ReadRegistrySnapshotTar(&buff)
+	c.Assert(err, Equals, nil)
+	c.Assert(read.Entries, DeepEquals, snapshot.Entries)
+}
@@ -7,6 +7,8 @@ import (
 
 type Context interface {
 	UserId() string
+	// Groups the user is a member of
+	Groups() []string
 	UrlParameter(string) string
 }
 
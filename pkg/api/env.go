@@ -12,4 +12,128 @@ type EnvList map[string]interface{}
 type EnvChange struct {
 	Update EnvList  `json:"update,omitempty"`
 	Delete []string `json:"delete,omitempty"`
+
+	// Keys in Update to encrypt.  Keys that are already secret stay secret.
+	Secret []string `json:"secret,omitempty"`
+}
+
+// Shown in place of the values of secret keys
+const EnvSecretMask = "********"
+
+const (
+	EnvKeyAdd    = "add"
+	EnvKeyUpdate = "update"
+	EnvKeyDelete = "delete"
+)
+
+type EnvKeyChange struct {
+	Key    string `json:"key"`
+	Action string `json:"action"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// A recorded change to an env.  Revision is the revision of the env after the change.
+type EnvHistoryEntry struct {
+	Revision   Revision       `json:"revision"`
+	User       string         `json:"user"`
+	Timestamp  int64          `json:"timestamp"`
+	Changes    []EnvKeyChange `json:"changes"`
+	RollbackTo Revision       `json:"rollback_to,omitempty"`
+}
+
+type EnvValueChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Differences between two envs, as seen from the target.  Added are keys that are only in the source,
+// Removed are keys only in the target, and Changed are keys with different values.
+type EnvDiff struct {
+	Added   EnvList                   `json:"added"`
+	Removed EnvList                   `json:"removed"`
+	Changed map[string]EnvValueChange `json:"changed"`
+}
+
+type EnvPromotion struct {
+	Keys []string `json:"keys"`
+}
+
+// A recorded reveal of the secrets in an env
+type EnvRevealEntry struct {
+	Revision  Revision `json:"revision"`
+	User      string   `json:"user"`
+	Timestamp int64    `json:"timestamp"`
+	Keys      []string `json:"keys"`
+}
+
+// Types of env values
+const (
+	EnvTypeString = "string"
+	EnvTypeInt    = "int"
+	EnvTypeFloat  = "float"
+	EnvTypeBool   = "bool"
+	EnvTypeUrl    = "url"
+)
+
+// Schema of the envs of a service in a domain class.  If Strict is set, keys that are not in
+// the schema are rejected.
+type EnvSchema struct {
+	Keys   map[string]EnvKeySchema `json:"keys"`
+	Strict bool                    `json:"strict,omitempty"`
+}
+
+// Pattern is a regular expression that has to match the whole value.  Default is used when a
+// new env does not have the key.
+type EnvKeySchema struct {
+	Required bool     `json:"required,omitempty"`
+	Type     string   `json:"type,omitempty"`
+	Enum     []string `json:"enum,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Default  *string  `json:"default,omitempty"`
+}
+
+type EnvFieldError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type EnvValidation struct {
+	Valid  bool            `json:"valid"`
+	Errors []EnvFieldError `json:"errors,omitempty"`
+}
+
+// Returned when an env or a schema is not valid, with the errors of each key.
+type EnvValidationError struct {
+	Message string          `json:"error"`
+	Errors  []EnvFieldError `json:"fields"`
+}
+
+func (this *EnvValidationError) Error() string {
+	return this.Message
+}
+
+// Layers of an env.  Values set for the domain class are overridden by the ones set for the
+// domain instance, which are overridden by the ones set for the version.
+const (
+	EnvLayerClass    = "class"
+	EnvLayerInstance = "instance"
+	EnvLayerVersion  = "version"
+)
+
+// The effective value of a key and the layer it comes from.  Overrides are the lower layers
+// that also set the key.
+type EnvResolvedValue struct {
+	Value     string   `json:"value"`
+	Layer     string   `json:"layer"`
+	Overrides []string `json:"overrides,omitempty"`
+}
+
+// A change to a key of an env, sent to watchers.  Revision is the revision of the env after
+// the change.  Values of secret keys are masked.
+type EnvChangeEvent struct {
+	Key      string   `json:"key"`
+	Action   string   `json:"action"`
+	Value    string   `json:"value,omitempty"`
+	Revision Revision `json:"revision"`
 }
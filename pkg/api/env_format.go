@@ -0,0 +1,266 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Formats an env can be exported to and imported from
+const (
+	EnvFormatJSON   = "json"
+	EnvFormatDotenv = "dotenv"
+	EnvFormatYAML   = "yaml"
+	EnvFormatShell  = "shell"
+)
+
+// The first content type of each format is the one used in responses
+var env_format_content_types = map[string][]string{
+	EnvFormatJSON:   []string{"application/json"},
+	EnvFormatDotenv: []string{"text/plain", "text/x-dotenv"},
+	EnvFormatYAML:   []string{"application/x-yaml", "application/yaml", "text/yaml", "text/x-yaml"},
+	EnvFormatShell:  []string{"text/x-sh", "application/x-sh", "text/x-shellscript"},
+}
+
+func EnvFormatContentType(format string) string {
+	if types, has := env_format_content_types[format]; has {
+		return types[0]
+	}
+	return ""
+}
+
+// Returns the format for the content type, or an empty string if there is none.
+// Parameters such as charset are ignored.
+func EnvFormatForContentType(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for format, types := range env_format_content_types {
+		for _, t := range types {
+			if t == contentType {
+				return format
+			}
+		}
+	}
+	return ""
+}
+
+func (this EnvList) keys() []string {
+	keys := []string{}
+	for k, _ := range this {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Keys are written in order so the output of the same env is always the same.
+func (this EnvList) Format(format string) ([]byte, error) {
+	if format == EnvFormatJSON {
+		return json.Marshal(this)
+	}
+	var buff bytes.Buffer
+	for _, k := range this.keys() {
+		v := fmt.Sprintf("%v", this[k])
+		switch format {
+		case EnvFormatDotenv:
+			fmt.Fprintf(&buff, "%s=%s\n", k, dotenv_quote(v))
+		case EnvFormatShell:
+			fmt.Fprintf(&buff, "export %s=%s\n", k, shell_quote(v))
+		case EnvFormatYAML:
+			// Values are always quoted so that ones like true or 1.0 stay strings
+			fmt.Fprintf(&buff, "%s: %s\n", yaml_key(k), yaml_quote(v))
+		default:
+			return nil, ErrUnknownEnvFormat
+		}
+	}
+	return buff.Bytes(), nil
+}
+
+// Parses the env in any of the formats written by Format.  YAML is read either as a flat
+// mapping of keys to values or as a Kubernetes style list of name / value items, e.g.
+//
+//	env:
+//	  - name: DB_HOST
+//	    value: localhost
+func ParseEnvList(format string, buff []byte) (EnvList, error) {
+	switch format {
+	case EnvFormatJSON:
+		list := EnvList{}
+		if err := json.Unmarshal(buff, &list); err != nil {
+			return nil, ErrBadEnvFormat
+		}
+		return list, nil
+	case EnvFormatDotenv, EnvFormatShell:
+		return parse_dotenv(buff)
+	case EnvFormatYAML:
+		return parse_yaml(buff)
+	default:
+		return nil, ErrUnknownEnvFormat
+	}
+}
+
+var safe_value = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]+$`)
+
+func dotenv_quote(v string) string {
+	if safe_value.MatchString(v) {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "$", `\$`, "`", "\\`")
+	return `"` + r.Replace(v) + `"`
+}
+
+func shell_quote(v string) string {
+	if safe_value.MatchString(v) {
+		return v
+	}
+	return `'` + strings.Replace(v, `'`, `'\''`, -1) + `'`
+}
+
+func yaml_key(k string) string {
+	if safe_value.MatchString(k) && !strings.ContainsAny(k[:1], "-%@") {
+		return k
+	}
+	return yaml_quote(k)
+}
+
+// A json string is a valid yaml double quoted scalar
+func yaml_quote(v string) string {
+	buff, _ := json.Marshal(v)
+	return string(buff)
+}
+
+func lines(buff []byte) []string {
+	return strings.Split(strings.Replace(string(buff), "\r\n", "\n", -1), "\n")
+}
+
+// Reads KEY=VALUE lines, with or without a leading export.  Values can be unquoted, single
+// quoted or double quoted as in the shell.  Quoted values can span lines.
+func parse_dotenv(buff []byte) (EnvList, error) {
+	list := EnvList{}
+	all := lines(buff)
+	for i := 0; i < len(all); i++ {
+		line := strings.TrimSpace(all[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "export ") {
+			line = strings.TrimSpace(line[len("export "):])
+		}
+		eq := strings.Index(line, "=")
+		if eq < 1 {
+			return nil, ErrBadEnvFormat
+		}
+		key := strings.TrimSpace(line[0:eq])
+		raw := strings.TrimLeft(line[eq+1:], " \t")
+		value, err := unquote_shell(raw)
+		for ; err == ErrBadEnvFormat && i+1 < len(all); i++ {
+			// The quote is not closed on this line
+			raw = raw + "\n" + all[i+1]
+			value, err = unquote_shell(raw)
+		}
+		if err != nil {
+			return nil, err
+		}
+		list[key] = value
+	}
+	return list, nil
+}
+
+func unquote_shell(s string) (string, error) {
+	var buff bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			end := strings.Index(s[i+1:], "'")
+			if end < 0 {
+				return "", ErrBadEnvFormat
+			}
+			buff.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					switch s[i] {
+					case 'n':
+						buff.WriteByte('\n')
+					case 'r':
+						buff.WriteByte('\r')
+					case 't':
+						buff.WriteByte('\t')
+					case '\\', '"', '$', '`':
+						buff.WriteByte(s[i])
+					default:
+						buff.WriteByte('\\')
+						buff.WriteByte(s[i])
+					}
+					continue
+				}
+				buff.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return "", ErrBadEnvFormat
+			}
+		case c == '\\' && i+1 < len(s):
+			i++
+			buff.WriteByte(s[i])
+		case c == '#' && i > 0 && (s[i-1] == ' ' || s[i-1] == '\t'):
+			// Comment to the end of line
+			return strings.TrimSpace(buff.String()), nil
+		default:
+			buff.WriteByte(c)
+		}
+	}
+	return buff.String(), nil
+}
+
+// A top level value of a yaml env.  Only scalars and lists of name / value items are kept.
+type yaml_value struct {
+	scalar *string
+	items  []yaml_item
+}
+
+type yaml_item struct {
+	Name  *string `yaml:"name"`
+	Value string  `yaml:"value"`
+}
+
+// Scalars are kept as they are written, so that 1.0 or true stay the same strings.
+func (this *yaml_value) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var scalar *string
+	if err := unmarshal(&scalar); err == nil {
+		this.scalar = scalar
+		return nil
+	}
+	var items []yaml_item
+	if err := unmarshal(&items); err == nil {
+		this.items = items
+	}
+	return nil
+}
+
+// The top level keys with scalar values are vars, and so are the name / value items of the
+// list under the env key.  Other blocks are skipped.
+func parse_yaml(buff []byte) (EnvList, error) {
+	doc := map[string]yaml_value{}
+	if err := yaml.Unmarshal(buff, &doc); err != nil {
+		return nil, ErrBadEnvFormat
+	}
+	list := EnvList{}
+	for k, v := range doc {
+		if v.scalar != nil {
+			list[k] = *v.scalar
+		}
+	}
+	for _, item := range doc["env"].items {
+		if item.Name == nil {
+			return nil, ErrBadEnvFormat
+		}
+		list[*item.Name] = item.Value
+	}
+	return list, nil
+}
@@ -7,4 +7,28 @@ import (
 var (
 	ErrConflict = errors.New("revsions-conflict")
 	ErrNotFound = errors.New("not-found")
+
+	ErrUnknownEnvFormat = errors.New("unknown-env-format")
+	ErrBadEnvFormat     = errors.New("bad-env-format")
+
+	ErrBadSnapshot   = errors.New("bad-snapshot")
+	ErrBadImportMode = errors.New("bad-import-mode")
+
+	ErrLeaseRequired = errors.New("lease-required")
+	ErrBadLeaseTtl   = errors.New("bad-lease-ttl")
+	ErrTooManyLeases = errors.New("too-many-leases")
+
+	ErrForbidden  = errors.New("forbidden")
+	ErrBadAclRule = errors.New("bad-acl-rule")
+
+	ErrBadSearch = errors.New("bad-search")
+	ErrBadTxn    = errors.New("bad-txn")
+
+	ErrBadDomain          = errors.New("bad-domain")
+	ErrDomainExists       = errors.New("domain-exists")
+	ErrDomainHasInstances = errors.New("domain-has-instances")
+	ErrBadDomainMember    = errors.New("bad-domain-member")
+
+	ErrBadTransition = errors.New("bad-transition")
+	ErrBadTimeout    = errors.New("bad-timeout")
 )
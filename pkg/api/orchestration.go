@@ -27,6 +27,29 @@ type Orchestration interface {
 	GetDefaultContext() OrchestrationContext
 }
 
+// The states of an orchestration instance.  It starts Pending and is Running once its executor
+// starts.  The others are final.
+const (
+	OrchestrationPending   = "Pending"
+	OrchestrationRunning   = "Running"
+	OrchestrationSucceeded = "Succeeded"
+	OrchestrationFailed    = "Failed"
+	OrchestrationCancelled = "Cancelled"
+	OrchestrationTimedOut  = "TimedOut"
+)
+
+// A change of the status of an orchestration instance.  User is who made the change, or ""
+// if redpill did.
+type OrchestrationTransition struct {
+	From string    `json:"from,omitempty"`
+	To   string    `json:"to"`
+	Time time.Time `json:"time"`
+	User string    `json:"user,omitempty"`
+}
+
+// ExitCode is the exit code of what the orchestration ran, once it has completed.  Error is
+// why it could not be run or waited for.  History has all the changes of its status, oldest
+// first.
 type OrchestrationInfo struct {
 	Domain         string    `json:"domain"`
 	Id             string    `json:"id"`
@@ -36,6 +59,10 @@ type OrchestrationInfo struct {
 	Status         string    `json:"status"`
 	User           string    `json:"user"`
 	Note           string    `json:"note"`
+	ExitCode       int       `json:"exit_code"`
+	Error          string    `json:"error,omitempty"`
+
+	History []OrchestrationTransition `json:"history"`
 }
 
 type OrchestrationInstance interface {
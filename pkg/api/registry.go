@@ -0,0 +1,219 @@
+package api
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A copy of a registry subtree.  Paths of the entries are relative to the root of the
+// subtree, which is itself at /.  Parents come before their children.
+type RegistrySnapshot struct {
+	Root    string          `json:"root"`
+	Entries []RegistryEntry `json:"entries"`
+}
+
+// What an import did, or would do in a dry run.  Skipped are existing entries with a
+// different value that were left alone.
+type RegistryImportResult struct {
+	DryRun    bool     `json:"dry_run"`
+	Created   []string `json:"created"`
+	Updated   []string `json:"updated"`
+	Skipped   []string `json:"skipped"`
+	Unchanged []string `json:"unchanged"`
+}
+
+const (
+	RegistryImportSkip      = "skip"
+	RegistryImportOverwrite = "overwrite"
+)
+
+const (
+	RegistryAccessRead   = "read"
+	RegistryAccessUpdate = "update"
+	RegistryAccessAdmin  = "admin"
+)
+
+// A rule grants access to the entries at and under the prefix to a user or to the members of
+// a group.  A rule with neither applies to everyone.
+type RegistryAclRule struct {
+	Prefix string `json:"prefix"`
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Access string `json:"access"`
+}
+
+// Access to an entry is decided by the rules with the longest prefix of its path.  Users that
+// none of those rules apply to have no access.  Entries that no rule covers are open to all
+// the users with the registry scopes.
+type RegistryAcl struct {
+	Rules []RegistryAclRule `json:"rules"`
+}
+
+// What to look for under a registry path.  Key is a glob on the name of the entries, or on
+// their whole path if it starts with /.  Value is a substring of the value and ValueRegex a
+// regular expression on it.  An entry matches if it matches all that is given.  Depth is the
+// number of levels below the path to search and Limit the most entries to return.
+type RegistrySearch struct {
+	Key        string `json:"key,omitempty"`
+	Value      string `json:"value,omitempty"`
+	ValueRegex string `json:"value_regex,omitempty"`
+	Depth      int    `json:"depth"`
+	Limit      int    `json:"limit"`
+}
+
+// The matching entries, shallowest first.  Truncated is true if there were more than the limit.
+type RegistrySearchResult struct {
+	Entries   []RegistryEntry `json:"entries"`
+	Truncated bool            `json:"truncated"`
+}
+
+const (
+	RegistryTxnCheck  = "check"
+	RegistryTxnSet    = "set"
+	RegistryTxnCreate = "create"
+	RegistryTxnDelete = "delete"
+)
+
+// An operation of a transaction.  Check, set and delete apply only if the entry is at the
+// version, which cannot be negative.  Create needs the parent of the path to exist, or to be created earlier in the
+// same transaction.
+type RegistryTxnOp struct {
+	Op      string   `json:"op"`
+	Path    string   `json:"path"`
+	Value   string   `json:"value,omitempty"`
+	Version Revision `json:"version"`
+}
+
+// The operations are applied in order, and either all of them are or none is.
+type RegistryTxn struct {
+	Ops []RegistryTxnOp `json:"ops"`
+}
+
+// The versions of the entries after the transaction, keyed by path.  Deleted entries are
+// left out.
+type RegistryTxnResult struct {
+	Revisions map[string]Revision `json:"revisions"`
+}
+
+const (
+	RegistryTxnVersionMismatch = "version-mismatch"
+	RegistryTxnNotFound        = "not-found"
+	RegistryTxnExists          = "exists"
+	RegistryTxnNotEmpty        = "not-empty"
+)
+
+// Returned when an operation of a transaction fails, in which case nothing is written.  Op is
+// the index of the operation, or -1 if the entries changed again before it could be told.
+type RegistryTxnError struct {
+	Message string `json:"error"`
+	Op      int    `json:"op"`
+	Path    string `json:"path,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+func (this *RegistryTxnError) Error() string {
+	return this.Message
+}
+
+// Ephemeral entries are created in the ZK session of a lease and are removed when the lease
+// expires or is revoked.  Ttl is in seconds and Expires in seconds since the epoch.
+type RegistryLease struct {
+	Id      string `json:"id"`
+	Ttl     int    `json:"ttl"`
+	Expires int64  `json:"expires"`
+}
+
+const (
+	RegistryEventCurrent  = "current"
+	RegistryEventCreate   = "create"
+	RegistryEventChange   = "change"
+	RegistryEventChildren = "children"
+	RegistryEventDelete   = "delete"
+)
+
+// A change to a registry entry, sent to watchers.  The first events of a watch describe the
+// entries as they are, with the action current.  Version is the version of the data and
+// NumChildren the number of children after the change.
+type RegistryChangeEvent struct {
+	Path        string   `json:"path"`
+	Action      string   `json:"action"`
+	Value       string   `json:"value,omitempty"`
+	Version     Revision `json:"version"`
+	NumChildren int32    `json:"num_children"`
+}
+
+// Version of the znode, kept as a pax record
+const tar_version_record = "REDPILL.version"
+
+func tar_name(path string) string {
+	if path == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(path, "/")
+}
+
+func tar_path(name string) string {
+	name = strings.Trim(name, "/")
+	if name == "." || name == "" {
+		return "/"
+	}
+	return "/" + strings.TrimPrefix(name, "./")
+}
+
+// Writes the snapshot as a tar with one file per entry.  Entries with children are files
+// too, so the tar is a way to move the snapshot around and not to be extracted.
+func (this *RegistrySnapshot) WriteTar(w io.Writer) error {
+	out := tar.NewWriter(w)
+	now := time.Now()
+	for _, entry := range this.Entries {
+		header := &tar.Header{
+			Name:       tar_name(entry.Path),
+			Mode:       0644,
+			Size:       int64(len(entry.Value)),
+			ModTime:    now,
+			Typeflag:   tar.TypeReg,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{tar_version_record: strconv.Itoa(int(entry.Version))},
+		}
+		if err := out.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, entry.Value); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+func ReadRegistrySnapshotTar(r io.Reader) (*RegistrySnapshot, error) {
+	snapshot := &RegistrySnapshot{Entries: []RegistryEntry{}}
+	in := tar.NewReader(r)
+	for {
+		header, err := in.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		value, err := ioutil.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+		entry := RegistryEntry{Path: tar_path(header.Name), Value: string(value)}
+		if v, has := header.PAXRecords[tar_version_record]; has {
+			if version, err := strconv.Atoi(v); err == nil {
+				entry.Version = Revision(version)
+			}
+		}
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+	return snapshot, nil
+}
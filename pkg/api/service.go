@@ -2,27 +2,75 @@ package api
 
 import (
 	"net/http"
+	"time"
 )
 
+// Revision is used for optimistic locking and is passed around in the X-Dash-Version header.
+// For registry entries it is the version of the znode.  For environment variables it is
+// derived from the content of all the variables so any change gives a new revision.
 type Revision int32
 type Unmarshaler func(*http.Request, interface{}) error
 
 type EnvService interface {
 	ListEnvs(c Context, domainClass string) ([]Env, error)
 	GetEnv(c Context, domain, service, version string) (EnvList, Revision, error)
-	SaveEnv(c Context, domain, service, version string, change *EnvChange, rev Revision) error
-	NewEnv(c Context, domain, service, version string, vars *EnvList) (rev Revision, err error)
+	SaveEnv(c Context, domain, service, version string, change *EnvChange, rev Revision) (Revision, error)
+	NewEnv(c Context, domain, service, version string, vars *EnvList, secret ...string) (rev Revision, err error)
+	RevealEnv(c Context, domain, service, version string) (EnvList, Revision, error)
+	ResolveEnv(c Context, domain, service, version string) (map[string]EnvResolvedValue, error)
+	WatchEnv(c Context, domain, service, version string, stop <-chan bool) (<-chan EnvChangeEvent, error)
+
+	ListEnvHistory(c Context, domain, service, version string) ([]EnvHistoryEntry, error)
+	GetEnvAt(c Context, domain, service, version string, rev Revision) (EnvList, error)
+	RollbackEnv(c Context, domain, service, version string, to, rev Revision) (Revision, error)
+
+	DiffEnv(c Context, domain, service, version, toDomain, toService, toVersion string) (*EnvDiff, error)
+	PromoteEnv(c Context, domain, service, version, toDomain, toService, toVersion string, keys []string) (Revision, error)
+
+	GetEnvSchema(c Context, domainClass, service string) (*EnvSchema, error)
+	SaveEnvSchema(c Context, domainClass, service string, schema *EnvSchema) error
+	ValidateEnv(c Context, domain, service, version string) (*EnvValidation, error)
 }
 
 type RegistryService interface {
 	GetEntry(c Context, key string) ([]byte, Revision, error)
+	DescribeEntry(c Context, key string) (*RegistryEntry, error)
+	ListEntries(c Context, key string, depth int) (*RegistryNode, error)
 	UpdateEntry(c Context, key string, value []byte, rev Revision) (Revision, error)
 	DeleteEntry(c Context, key string, rev Revision) error
+	CreateEntry(c Context, key string, value []byte, ephemeral, sequential bool, lease string) (*RegistryEntry, error)
+	Transaction(c Context, txn *RegistryTxn) (*RegistryTxnResult, error)
+
+	GrantLease(c Context, ttl time.Duration) (*RegistryLease, error)
+	KeepAliveLease(c Context, id string) (*RegistryLease, error)
+	RevokeLease(c Context, id string) error
+
+	GetAcl(c Context) (*RegistryAcl, Revision, error)
+	SaveAcl(c Context, acl *RegistryAcl, rev Revision) (Revision, error)
+	CheckAccess(c Context, key, access string) error
+
+	ExportEntries(c Context, key string) (*RegistrySnapshot, error)
+	ImportEntries(c Context, key string, snapshot *RegistrySnapshot, mode string, dryRun bool) (*RegistryImportResult, error)
+	WatchEntries(c Context, key string, recursive bool, stop <-chan bool) (<-chan RegistryChangeEvent, error)
+	SearchEntries(c Context, key string, search *RegistrySearch) (*RegistrySearchResult, error)
 }
 
 type DomainService interface {
 	ListDomains(c Context) ([]Domain, error)
 	GetDomain(c Context, domainClass string) (*DomainDetail, error)
+	CreateDomain(c Context, domain *Domain) (*DomainDetail, error)
+	UpdateDomain(c Context, domain *Domain) (*DomainDetail, error)
+	DeleteDomain(c Context, domainClass string) error
+	AddInstance(c Context, domainClass string, instance *DomainInstance) (*DomainDetail, error)
+	RetireInstance(c Context, domainClass, domainInstance string) (*DomainDetail, error)
+
+	GetMembers(c Context, domainClass string) (*DomainMembers, error)
+	SaveMembers(c Context, domainClass string, members *DomainMembers) (*DomainMembers, error)
+	CheckMembership(c Context, domainClass, domainInstance, role string) error
+}
+
+type StatsService interface {
+	GetDomainStats(c Context, domainClass string) (*DomainStats, error)
 }
 
 type OrchestrateService interface {
@@ -30,6 +78,8 @@ type OrchestrateService interface {
 	StartOrchestration(c Context, domainClass, domainInstance, orchestration string, input OrchestrationContext, note ...string) (OrchestrationInstance, error)
 	GetOrchestration(c Context, domain, orchestration, instance string) (OrchestrationInstance, error)
 	ListInstances(c Context, domain, orchestration string) ([]OrchestrationInstance, error)
+	ListClassInstances(c Context, domainClass, orchestration string) ([]OrchestrationInstance, error)
+	CancelOrchestration(c Context, domain, orchestration, instance string) (OrchestrationInstance, error)
 
 	NewOrchestrationModel(c Context, req *http.Request, um Unmarshaler) (OrchestrationModel, error)
 	SaveOrchestrationModel(c Context, domainClass string, m OrchestrationModel) error
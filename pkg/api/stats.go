@@ -0,0 +1,43 @@
+package api
+
+import (
+	"time"
+)
+
+// Counts for a domain class, computed from the env tree, the instances of the domain and the
+// orchestration runs.  They are cached and refreshed in the background, so they are as of
+// UpdateTime.
+type DomainStats struct {
+	Class          string                   `json:"class"`
+	Environments   DomainEnvironmentStats   `json:"environments"`
+	Orchestrations DomainOrchestrationStats `json:"orchestrations"`
+	Instances      []DomainInstanceStats    `json:"instances"`
+	UpdateTime     time.Time                `json:"update_time"`
+}
+
+// Domains are the instances in service.  Versions are counted once per service, and Live
+// is the number of service instances with a live version.
+type DomainEnvironmentStats struct {
+	Domains  int `json:"domains"`
+	Retired  int `json:"retired"`
+	Services int `json:"services"`
+	Versions int `json:"versions"`
+	Live     int `json:"live"`
+}
+
+// AllTime is the number of runs of the orchestrations of the domain class, and Status the
+// number of runs by their status.
+type DomainOrchestrationStats struct {
+	Models  int            `json:"models"`
+	AllTime int            `json:"all_time"`
+	Status  map[string]int `json:"status"`
+}
+
+type DomainInstanceStats struct {
+	Name     string `json:"name"`
+	Tier     string `json:"tier,omitempty"`
+	Retired  bool   `json:"retired,omitempty"`
+	Services int    `json:"services"`
+	Live     int    `json:"live"`
+	Runs     int    `json:"runs"`
+}
@@ -1,23 +1,333 @@
 package domain
 
 import (
+	"encoding/json"
 	"github.com/golang/glog"
 	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"regexp"
+	"sort"
+	"time"
 )
 
+// Domain classes are at /_redpill/domain/{domain_class} and their instances are its children.
+// Both are kept as json.  The registry api does not reach below /_redpill, so the members
+// can only be changed here.
+const domain_root = "/_redpill/domain"
+
+// Names are a single segment of the url routes
+var name_regex = regexp.MustCompile("^[:0-9a-zA-Z\\.\\-]+$")
+
+var tiers = map[string]bool{
+	"":                    true,
+	DomainTierDevelopment: true,
+	DomainTierTest:        true,
+	DomainTierStaging:     true,
+	DomainTierProduction:  true,
+}
+
+// What is kept for a domain class.  The class is the name of the node.
+type domain_record struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Owners      []string       `json:"owners,omitempty"`
+	Members     []DomainMember `json:"members,omitempty"`
+}
+
 type domainService struct {
+	conn kv.Store
+}
+
+func NewService(store kv.Store) DomainService {
+	return &domainService{conn: store}
+}
+
+func class_path(domainClass string) string {
+	return domain_root + "/" + domainClass
+}
+
+func instance_path(domainClass, domainInstance string) string {
+	return class_path(domainClass) + "/" + domainInstance
+}
+
+// Maps the error of a write to a node read earlier.  A node that is gone means the domain class
+// was deleted, since its instances are only deleted with it.
+func write_err(err error) error {
+	switch err {
+	case kv.ErrNotExist:
+		return ErrNotFound
+	case kv.ErrBadVersion, kv.ErrNodeExists, kv.ErrNotEmpty:
+		return ErrConflict
+	}
+	return err
+}
+
+func domain_url(domainClass string) string {
+	return "/v1/domain/" + domainClass
+}
+
+func (this *domainService) load(domainClass string) (*kv.Node, *domain_record, error) {
+	if !name_regex.MatchString(domainClass) {
+		return nil, nil, ErrNotFound
+	}
+	zn, err := this.conn.Get(class_path(domainClass))
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, nil, ErrNotFound
+	case err != nil:
+		return nil, nil, err
+	}
+	record := new(domain_record)
+	if err := json.Unmarshal(zn.Value, record); err != nil {
+		return nil, nil, err
+	}
+	return zn, record, nil
+}
+
+// The nodes of the instances of the class and what they hold, in name order
+func (this *domainService) instances(domainClass string) ([]*kv.Node, []DomainInstance, error) {
+	nodes, err := this.conn.Children(class_path(domainClass))
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, nil, ErrNotFound
+	case err != nil:
+		return nil, nil, err
+	}
+	sort.Sort(by_path(nodes))
+	instances := make([]DomainInstance, len(nodes))
+	for i, n := range nodes {
+		if err := json.Unmarshal(n.Value, &instances[i]); err != nil {
+			return nil, nil, err
+		}
+		instances[i].Name = n.GetBasename()
+	}
+	return nodes, instances, nil
 }
 
-func NewService() DomainService {
-	return &domainService{}
+type by_path []*kv.Node
+
+func (p by_path) Len() int           { return len(p) }
+func (p by_path) Less(i, j int) bool { return p[i].GetPath() < p[j].GetPath() }
+func (p by_path) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (this *domainService) detail(domainClass string) (*DomainDetail, error) {
+	_, record, err := this.load(domainClass)
+	if err != nil {
+		return nil, err
+	}
+	_, instances, err := this.instances(domainClass)
+	if err != nil {
+		return nil, err
+	}
+	detail := &DomainDetail{
+		Id:           domainClass,
+		Class:        domainClass,
+		Name:         record.Name,
+		Description:  record.Description,
+		Owners:       record.Owners,
+		Instances:    []string{},
+		InstanceInfo: instances,
+	}
+	for _, instance := range instances {
+		if instance.RetireTime == nil {
+			detail.Instances = append(detail.Instances, instance.Name)
+		}
+	}
+	return detail, nil
 }
 
 func (this *domainService) ListDomains(c Context) ([]Domain, error) {
 	glog.Infoln("ListDomains", "UserId=", c.UserId())
-	return nil, nil
+	nodes, err := this.conn.Children(domain_root)
+	switch {
+	case err == kv.ErrNotExist:
+		return []Domain{}, nil
+	case err != nil:
+		return nil, err
+	}
+	sort.Sort(by_path(nodes))
+	list := []Domain{}
+	for _, n := range nodes {
+		record := new(domain_record)
+		if err := json.Unmarshal(n.Value, record); err != nil {
+			return nil, err
+		}
+		if len(record.Members) > 0 && !is_member(record.Members, c.UserId(), c.Groups()) {
+			continue
+		}
+		list = append(list, Domain{
+			Id:          n.GetBasename(),
+			Class:       n.GetBasename(),
+			Name:        record.Name,
+			Url:         domain_url(n.GetBasename()),
+			Description: record.Description,
+			Owners:      record.Owners,
+		})
+	}
+	return list, nil
 }
 
+// Members of only some of the instances see only those instances
 func (this *domainService) GetDomain(c Context, domainClass string) (*DomainDetail, error) {
-	glog.Infoln("GetDomain", "UserId=", c.UserId())
-	return nil, nil
+	glog.Infoln("GetDomain", "UserId=", c.UserId(), "DomainClass=", domainClass)
+	_, record, err := this.load(domainClass)
+	if err != nil {
+		return nil, err
+	}
+	if len(record.Members) > 0 && !is_member(record.Members, c.UserId(), c.Groups()) {
+		return nil, ErrForbidden
+	}
+	detail, err := this.detail(domainClass)
+	if err != nil {
+		return nil, err
+	}
+	return visible(detail, record.Members, c), nil
+}
+
+// The user that creates the domain class is its first admin
+func (this *domainService) CreateDomain(c Context, domain *Domain) (*DomainDetail, error) {
+	glog.Infoln("CreateDomain", "UserId=", c.UserId(), "DomainClass=", domain.Class)
+	if !name_regex.MatchString(domain.Class) {
+		return nil, ErrBadDomain
+	}
+	record := domain_record{Name: domain.Name, Description: domain.Description, Owners: domain.Owners}
+	if c.UserId() != "" {
+		record.Members = []DomainMember{{User: c.UserId(), Role: DomainRoleAdmin}}
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	_, err = this.conn.Create(class_path(domain.Class), value)
+	switch {
+	case err == kv.ErrNodeExists:
+		return nil, ErrDomainExists
+	case err != nil:
+		return nil, err
+	}
+	return this.detail(domain.Class)
+}
+
+// Replaces the name, description and owners of the domain class
+func (this *domainService) UpdateDomain(c Context, domain *Domain) (*DomainDetail, error) {
+	glog.Infoln("UpdateDomain", "UserId=", c.UserId(), "DomainClass=", domain.Class)
+	zn, record, err := this.load(domain.Class)
+	if err != nil {
+		return nil, err
+	}
+	record.Name, record.Description, record.Owners = domain.Name, domain.Description, domain.Owners
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	_, err = this.conn.Set(zn.GetPath(), value, zn.Version)
+	if err != nil {
+		return nil, write_err(err)
+	}
+	return this.detail(domain.Class)
+}
+
+// Only a domain class with no instance in service can be deleted.  Its retired instances are
+// deleted with it.
+func (this *domainService) DeleteDomain(c Context, domainClass string) error {
+	glog.Infoln("DeleteDomain", "UserId=", c.UserId(), "DomainClass=", domainClass)
+	zn, _, err := this.load(domainClass)
+	if err != nil {
+		return err
+	}
+	nodes, instances, err := this.instances(domainClass)
+	if err != nil {
+		return err
+	}
+	ops := []kv.Op{}
+	for i, instance := range instances {
+		if instance.RetireTime == nil {
+			return ErrDomainHasInstances
+		}
+		ops = append(ops, kv.OpDelete(nodes[i].GetPath(), nodes[i].Version))
+	}
+	ops = append(ops, kv.OpDelete(zn.GetPath(), zn.Version))
+	_, err = this.conn.Multi(ops...)
+	return write_err(err)
+}
+
+// Adds an instance to the domain class.  A retired instance can be added again, which puts
+// it back in service with the new description, owners and tier.
+func (this *domainService) AddInstance(c Context, domainClass string, instance *DomainInstance) (*DomainDetail, error) {
+	glog.Infoln("AddInstance", "UserId=", c.UserId(), "DomainClass=", domainClass, "DomainInstance=", instance.Name)
+	if !name_regex.MatchString(instance.Name) || !tiers[instance.Tier] {
+		return nil, ErrBadDomain
+	}
+	zn, _, err := this.load(domainClass)
+	if err != nil {
+		return nil, err
+	}
+
+	added := *instance
+	added.CreateTime = time.Now()
+	added.RetireTime = nil
+	value, err := json.Marshal(added)
+	if err != nil {
+		return nil, err
+	}
+
+	// The check makes sure the class is not deleted while the instance is added
+	path := instance_path(domainClass, instance.Name)
+	ops := []kv.Op{kv.OpCheck(zn.GetPath(), zn.Version)}
+	existing, err := this.conn.Get(path)
+	switch {
+	case err == kv.ErrNotExist:
+		ops = append(ops, kv.OpCreate(path, value))
+	case err != nil:
+		return nil, err
+	default:
+		old := new(DomainInstance)
+		if err := json.Unmarshal(existing.Value, old); err != nil {
+			return nil, err
+		}
+		if old.RetireTime == nil {
+			return nil, ErrDomainExists
+		}
+		ops = append(ops, kv.OpSet(path, value, existing.Version))
+	}
+	_, err = this.conn.Multi(ops...)
+	if err != nil {
+		return nil, write_err(err)
+	}
+	return this.detail(domainClass)
+}
+
+// Takes the instance out of service.  It is kept, with the time it was retired.
+func (this *domainService) RetireInstance(c Context, domainClass, domainInstance string) (*DomainDetail, error) {
+	glog.Infoln("RetireInstance", "UserId=", c.UserId(), "DomainClass=", domainClass, "DomainInstance=", domainInstance)
+	if _, _, err := this.load(domainClass); err != nil {
+		return nil, err
+	}
+	if !name_regex.MatchString(domainInstance) {
+		return nil, ErrNotFound
+	}
+	zn, err := this.conn.Get(instance_path(domainClass, domainInstance))
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	instance := new(DomainInstance)
+	if err := json.Unmarshal(zn.Value, instance); err != nil {
+		return nil, err
+	}
+	if instance.RetireTime == nil {
+		now := time.Now()
+		instance.RetireTime = &now
+		value, err := json.Marshal(instance)
+		if err != nil {
+			return nil, err
+		}
+		_, err = this.conn.Set(zn.GetPath(), value, zn.Version)
+		if err != nil {
+			return nil, write_err(err)
+		}
+	}
+	return this.detail(domainClass)
 }
@@ -0,0 +1,218 @@
+package domain
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomain(t *testing.T) { TestingT(t) }
+
+type test_context string
+
+func (t test_context) UserId() string {
+	return string(t)
+}
+func (t test_context) Groups() []string {
+	return nil
+}
+func (t test_context) UrlParameter(k string) string {
+	return ""
+}
+
+type DomainTests struct {
+	store kv.Store
+	c     Context
+}
+
+var _ = Suite(&DomainTests{})
+
+func (suite *DomainTests) SetUpTest(c *C) {
+	store, err := kv.OpenBoltStore(filepath.Join(c.MkDir(), "domain.db"))
+	c.Assert(err, Equals, nil)
+	suite.store = store
+	suite.c = test_context("test")
+}
+
+func (suite *DomainTests) TearDownTest(c *C) {
+	suite.store.Close()
+}
+
+func (suite *DomainTests) TestCreateAndList(c *C) {
+	s := NewService(suite.store)
+
+	list, err := s.ListDomains(suite.c)
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, []Domain{})
+
+	detail, err := s.CreateDomain(suite.c, &Domain{Class: "blinker.com", Name: "API", Owners: []string{"ops"}})
+	c.Assert(err, Equals, nil)
+	c.Assert(detail.Class, Equals, "blinker.com")
+	c.Assert(detail.Instances, DeepEquals, []string{})
+
+	_, err = s.CreateDomain(suite.c, &Domain{Class: "blinker.com"})
+	c.Assert(err, Equals, ErrDomainExists)
+	_, err = s.CreateDomain(suite.c, &Domain{Class: "a/b"})
+	c.Assert(err, Equals, ErrBadDomain)
+
+	_, err = s.CreateDomain(suite.c, &Domain{Class: "acme.com", Name: "Shop", Description: "The shop"})
+	c.Assert(err, Equals, nil)
+
+	list, err = s.ListDomains(suite.c)
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, []Domain{
+		{Id: "acme.com", Class: "acme.com", Name: "Shop", Url: "/v1/domain/acme.com", Description: "The shop"},
+		{Id: "blinker.com", Class: "blinker.com", Name: "API", Url: "/v1/domain/blinker.com", Owners: []string{"ops"}},
+	})
+
+	detail, err = s.UpdateDomain(suite.c, &Domain{Class: "acme.com", Name: "Store"})
+	c.Assert(err, Equals, nil)
+	c.Assert(detail.Name, Equals, "Store")
+	c.Assert(detail.Description, Equals, "")
+
+	_, err = s.GetDomain(suite.c, "none.com")
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = s.UpdateDomain(suite.c, &Domain{Class: "none.com"})
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (suite *DomainTests) TestInstances(c *C) {
+	s := NewService(suite.store)
+	_, err := s.CreateDomain(suite.c, &Domain{Class: "blinker.com", Name: "API"})
+	c.Assert(err, Equals, nil)
+
+	for _, i := range []DomainInstance{
+		{Name: "production", Tier: DomainTierProduction, Owners: []string{"ops"}},
+		{Name: "staging", Tier: DomainTierStaging},
+		{Name: "dev"},
+	} {
+		_, err := s.AddInstance(suite.c, "blinker.com", &i)
+		c.Assert(err, Equals, nil)
+	}
+	_, err = s.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "dev"})
+	c.Assert(err, Equals, ErrDomainExists)
+	_, err = s.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "qa", Tier: "prod"})
+	c.Assert(err, Equals, ErrBadDomain)
+	_, err = s.AddInstance(suite.c, "none.com", &DomainInstance{Name: "qa"})
+	c.Assert(err, Equals, ErrNotFound)
+
+	detail, err := s.GetDomain(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(detail.Instances, DeepEquals, []string{"dev", "production", "staging"})
+	c.Assert(detail.InstanceInfo[1].Tier, Equals, DomainTierProduction)
+	c.Assert(detail.InstanceInfo[1].Owners, DeepEquals, []string{"ops"})
+	c.Assert(detail.InstanceInfo[1].CreateTime.IsZero(), Equals, false)
+
+	c.Assert(s.DeleteDomain(suite.c, "blinker.com"), Equals, ErrDomainHasInstances)
+
+	detail, err = s.RetireInstance(suite.c, "blinker.com", "staging")
+	c.Assert(err, Equals, nil)
+	c.Assert(detail.Instances, DeepEquals, []string{"dev", "production"})
+	c.Assert(detail.InstanceInfo[2].Name, Equals, "staging")
+	c.Assert(detail.InstanceInfo[2].RetireTime, Not(IsNil))
+
+	_, err = s.RetireInstance(suite.c, "blinker.com", "qa")
+	c.Assert(err, Equals, ErrNotFound)
+
+	// Back in service
+	detail, err = s.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "staging", Tier: DomainTierTest})
+	c.Assert(err, Equals, nil)
+	c.Assert(detail.Instances, DeepEquals, []string{"dev", "production", "staging"})
+	c.Assert(detail.InstanceInfo[2].Tier, Equals, DomainTierTest)
+	c.Assert(detail.InstanceInfo[2].RetireTime, IsNil)
+
+	for _, i := range detail.Instances {
+		_, err := s.RetireInstance(suite.c, "blinker.com", i)
+		c.Assert(err, Equals, nil)
+	}
+	c.Assert(s.DeleteDomain(suite.c, "blinker.com"), Equals, nil)
+	_, err = s.GetDomain(suite.c, "blinker.com")
+	c.Assert(err, Equals, ErrNotFound)
+	c.Assert(s.DeleteDomain(suite.c, "blinker.com"), Equals, ErrNotFound)
+}
+
+// Runs race before each write, as if someone else got there between the read and the write
+type racing_store struct {
+	kv.Store
+	race func()
+}
+
+func (this *racing_store) Set(path string, value []byte, version int32) (*kv.Node, error) {
+	this.race()
+	return this.Store.Set(path, value, version)
+}
+
+func (this *racing_store) Multi(ops ...kv.Op) ([]string, error) {
+	this.race()
+	return this.Store.Multi(ops...)
+}
+
+func (suite *DomainTests) TestRaces(c *C) {
+	s := NewService(suite.store)
+	_, err := s.CreateDomain(suite.c, &Domain{Class: "blinker.com", Name: "API"})
+	c.Assert(err, Equals, nil)
+	_, err = s.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "dev"})
+	c.Assert(err, Equals, nil)
+	_, err = s.RetireInstance(suite.c, "blinker.com", "dev")
+	c.Assert(err, Equals, nil)
+
+	racing := &racing_store{Store: suite.store}
+	r := NewService(racing)
+
+	// Updated
+	racing.race = func() {
+		_, err := s.UpdateDomain(suite.c, &Domain{Class: "blinker.com", Name: "Other"})
+		c.Assert(err, Equals, nil)
+	}
+	_, err = r.UpdateDomain(suite.c, &Domain{Class: "blinker.com", Name: "Mine"})
+	c.Assert(err, Equals, ErrConflict)
+	_, err = r.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "qa"})
+	c.Assert(err, Equals, ErrConflict)
+	_, err = r.SaveMembers(suite.c, "blinker.com", &DomainMembers{})
+	c.Assert(err, Equals, ErrConflict)
+
+	// An instance added, or put back in service
+	racing.race = func() {
+		_, err := s.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "qa"})
+		c.Assert(err, Equals, nil)
+	}
+	c.Assert(r.DeleteDomain(suite.c, "blinker.com"), Equals, ErrConflict)
+	_, err = s.RetireInstance(suite.c, "blinker.com", "qa")
+	c.Assert(err, Equals, nil)
+	_, err = r.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "qa"})
+	c.Assert(err, Equals, ErrConflict)
+
+	// Deleted
+	for _, i := range []string{"dev", "qa"} {
+		_, err = s.RetireInstance(suite.c, "blinker.com", i)
+		c.Assert(err, Equals, nil)
+	}
+	deleted := func() {
+		s.DeleteDomain(suite.c, "blinker.com")
+	}
+	racing.race = deleted
+	_, err = r.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "dev"})
+	c.Assert(err, Equals, ErrNotFound)
+
+	for _, write := range []func() error{
+		func() error {
+			_, err := r.UpdateDomain(suite.c, &Domain{Class: "blinker.com"})
+			return err
+		},
+		func() error {
+			_, err := r.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: "qa"})
+			return err
+		},
+		func() error {
+			return r.DeleteDomain(suite.c, "blinker.com")
+		},
+	} {
+		racing.race = func() {}
+		_, err = s.CreateDomain(suite.c, &Domain{Class: "blinker.com"})
+		c.Assert(err, Equals, nil)
+		racing.race = deleted
+		c.Assert(write(), Equals, ErrNotFound)
+	}
+}
@@ -0,0 +1,143 @@
+package domain
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+)
+
+var role_levels = map[string]int{
+	DomainRoleViewer: 1,
+	DomainRoleEditor: 2,
+	DomainRoleAdmin:  3,
+}
+
+func check_members(members []DomainMember) error {
+	for _, m := range members {
+		switch {
+		case (m.User == "") == (m.Group == ""):
+			return ErrBadDomainMember
+		case m.Instance != "" && !name_regex.MatchString(m.Instance):
+			return ErrBadDomainMember
+		case role_levels[m.Role] == 0:
+			return ErrBadDomainMember
+		}
+	}
+	return nil
+}
+
+func applies(m DomainMember, user string, groups []string) bool {
+	if m.User != "" {
+		return m.User == user
+	}
+	for _, g := range groups {
+		if g == m.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// The role of the user in the instance, or in the whole class if instance is "".  A role in
+// the class is a role in all of its instances.
+func member_role(members []DomainMember, user string, groups []string, instance string) string {
+	role := ""
+	for _, m := range members {
+		if applies(m, user, groups) && (m.Instance == "" || m.Instance == instance) &&
+			role_levels[m.Role] > role_levels[role] {
+			role = m.Role
+		}
+	}
+	return role
+}
+
+// True if the user has a role in the class or in any of its instances
+func is_member(members []DomainMember, user string, groups []string) bool {
+	for _, m := range members {
+		if applies(m, user, groups) {
+			return true
+		}
+	}
+	return false
+}
+
+func has_role(members []DomainMember, c Context, instance, role string) bool {
+	if len(members) == 0 {
+		return true
+	}
+	return role_levels[member_role(members, c.UserId(), c.Groups(), instance)] >= role_levels[role]
+}
+
+// Leaves out the instances the user cannot see
+func visible(detail *DomainDetail, members []DomainMember, c Context) *DomainDetail {
+	if has_role(members, c, "", DomainRoleViewer) {
+		return detail
+	}
+	instances := []string{}
+	for _, i := range detail.Instances {
+		if has_role(members, c, i, DomainRoleViewer) {
+			instances = append(instances, i)
+		}
+	}
+	info := []DomainInstance{}
+	for _, i := range detail.InstanceInfo {
+		if has_role(members, c, i.Name, DomainRoleViewer) {
+			info = append(info, i)
+		}
+	}
+	detail.Instances, detail.InstanceInfo = instances, info
+	return detail
+}
+
+func (this *domainService) GetMembers(c Context, domainClass string) (*DomainMembers, error) {
+	glog.Infoln("GetMembers", "UserId=", c.UserId(), "DomainClass=", domainClass)
+	_, record, err := this.load(domainClass)
+	if err != nil {
+		return nil, err
+	}
+	members := &DomainMembers{Members: record.Members}
+	if members.Members == nil {
+		members.Members = []DomainMember{}
+	}
+	return members, nil
+}
+
+func (this *domainService) SaveMembers(c Context, domainClass string, members *DomainMembers) (*DomainMembers, error) {
+	glog.Infoln("SaveMembers", "UserId=", c.UserId(), "DomainClass=", domainClass, "Members=", len(members.Members))
+	if err := check_members(members.Members); err != nil {
+		return nil, err
+	}
+	zn, record, err := this.load(domainClass)
+	if err != nil {
+		return nil, err
+	}
+	record.Members = members.Members
+	value, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	_, err = this.conn.Set(zn.GetPath(), value, zn.Version)
+	if err != nil {
+		return nil, write_err(err)
+	}
+	return this.GetMembers(c, domainClass)
+}
+
+// Returns ErrForbidden if the user does not have the role in the instance of the domain class,
+// or in the class itself if instance is "".  Domain classes that are not managed here are open
+// to all.
+func (this *domainService) CheckMembership(c Context, domainClass, domainInstance, role string) error {
+	_, record, err := this.load(domainClass)
+	switch {
+	case err == ErrNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+	if !has_role(record.Members, c, domainInstance, role) {
+		glog.Infoln("CheckMembership:", c.UserId(), "DomainClass=", domainClass, "DomainInstance=", domainInstance,
+			"Role=", role, "Forbidden")
+		return ErrForbidden
+	}
+	return nil
+}
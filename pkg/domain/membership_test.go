@@ -0,0 +1,124 @@
+package domain
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type group_context struct {
+	user   string
+	groups []string
+}
+
+func (t group_context) UserId() string {
+	return t.user
+}
+func (t group_context) Groups() []string {
+	return t.groups
+}
+func (t group_context) UrlParameter(k string) string {
+	return ""
+}
+
+type MembershipTests struct{}
+
+var _ = Suite(&MembershipTests{})
+
+func (suite *MembershipTests) TestCheckMembers(c *C) {
+	c.Assert(check_members([]DomainMember{
+		{User: "alice", Role: DomainRoleAdmin},
+		{Group: "ops", Instance: "production", Role: DomainRoleEditor},
+	}), Equals, nil)
+
+	for _, bad := range []DomainMember{
+		{Role: DomainRoleViewer},
+		{User: "alice", Group: "ops", Role: DomainRoleViewer},
+		{User: "alice", Role: "owner"},
+		{User: "alice", Instance: "a/b", Role: DomainRoleViewer},
+	} {
+		c.Assert(check_members([]DomainMember{bad}), Equals, ErrBadDomainMember)
+	}
+}
+
+func (suite *MembershipTests) TestMemberRole(c *C) {
+	members := []DomainMember{
+		{User: "alice", Role: DomainRoleAdmin},
+		{Group: "dev", Role: DomainRoleViewer},
+		{Group: "dev", Instance: "staging", Role: DomainRoleEditor},
+		{User: "bob", Instance: "production", Role: DomainRoleViewer},
+	}
+	c.Assert(member_role(members, "alice", nil, ""), Equals, DomainRoleAdmin)
+	c.Assert(member_role(members, "alice", nil, "production"), Equals, DomainRoleAdmin)
+	c.Assert(member_role(members, "carol", []string{"dev"}, ""), Equals, DomainRoleViewer)
+	c.Assert(member_role(members, "carol", []string{"dev"}, "staging"), Equals, DomainRoleEditor)
+	c.Assert(member_role(members, "bob", nil, ""), Equals, "")
+	c.Assert(member_role(members, "bob", nil, "production"), Equals, DomainRoleViewer)
+
+	c.Assert(is_member(members, "bob", nil), Equals, true)
+	c.Assert(is_member(members, "dave", []string{"ops"}), Equals, false)
+
+	c.Assert(has_role(nil, test_context("dave"), "", DomainRoleAdmin), Equals, true)
+	c.Assert(has_role(members, test_context("bob"), "production", DomainRoleEditor), Equals, false)
+}
+
+func (suite *DomainTests) TestMembership(c *C) {
+	s := NewService(suite.store)
+	_, err := s.CreateDomain(suite.c, &Domain{Class: "blinker.com", Name: "API"})
+	c.Assert(err, Equals, nil)
+	for _, i := range []string{"production", "staging"} {
+		_, err := s.AddInstance(suite.c, "blinker.com", &DomainInstance{Name: i})
+		c.Assert(err, Equals, nil)
+	}
+
+	// The creator is the first admin
+	members, err := s.GetMembers(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(members.Members, DeepEquals, []DomainMember{{User: "test", Role: DomainRoleAdmin}})
+
+	_, err = s.SaveMembers(suite.c, "blinker.com", &DomainMembers{Members: []DomainMember{{Role: "admin"}}})
+	c.Assert(err, Equals, ErrBadDomainMember)
+	_, err = s.SaveMembers(suite.c, "blinker.com", &DomainMembers{Members: []DomainMember{
+		{User: "test", Role: DomainRoleAdmin},
+		{Group: "dev", Instance: "staging", Role: DomainRoleEditor},
+	}})
+	c.Assert(err, Equals, nil)
+
+	// Updating the domain keeps its members
+	_, err = s.UpdateDomain(suite.c, &Domain{Class: "blinker.com", Name: "Blinker"})
+	c.Assert(err, Equals, nil)
+	members, err = s.GetMembers(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(len(members.Members), Equals, 2)
+
+	// Open to all
+	_, err = s.CreateDomain(group_context{}, &Domain{Class: "acme.com"})
+	c.Assert(err, Equals, nil)
+
+	dev := group_context{user: "carol", groups: []string{"dev"}}
+	other := test_context("other")
+
+	list, err := s.ListDomains(dev)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list), Equals, 2)
+	list, err = s.ListDomains(other)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list), Equals, 1)
+	c.Assert(list[0].Class, Equals, "acme.com")
+
+	detail, err := s.GetDomain(dev, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(detail.Instances, DeepEquals, []string{"staging"})
+	c.Assert(len(detail.InstanceInfo), Equals, 1)
+	detail, err = s.GetDomain(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(detail.Instances, DeepEquals, []string{"production", "staging"})
+	_, err = s.GetDomain(other, "blinker.com")
+	c.Assert(err, Equals, ErrForbidden)
+
+	c.Assert(s.CheckMembership(dev, "blinker.com", "staging", DomainRoleEditor), Equals, nil)
+	c.Assert(s.CheckMembership(dev, "blinker.com", "staging", DomainRoleAdmin), Equals, ErrForbidden)
+	c.Assert(s.CheckMembership(dev, "blinker.com", "production", DomainRoleViewer), Equals, ErrForbidden)
+	c.Assert(s.CheckMembership(dev, "blinker.com", "", DomainRoleViewer), Equals, ErrForbidden)
+	c.Assert(s.CheckMembership(other, "acme.com", "", DomainRoleAdmin), Equals, nil)
+	c.Assert(s.CheckMembership(other, "unmanaged.com", "dev", DomainRoleEditor), Equals, nil)
+}
@@ -0,0 +1,141 @@
+package env
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"sort"
+)
+
+// Returns a list of the changes that will turn the from env into the to env.
+func diff(from, to EnvList) *EnvChange {
+	change := &EnvChange{Update: EnvList{}}
+	for k, v := range to {
+		if old, has := from[k]; !has || fmt.Sprintf("%v", old) != fmt.Sprintf("%v", v) {
+			change.Update[k] = v
+		}
+	}
+	for k, _ := range from {
+		if _, has := to[k]; !has {
+			change.Delete = append(change.Delete, k)
+		}
+	}
+	sort.Strings(change.Delete)
+	return change
+}
+
+// Compares the source env against the target
+func compare(source, target EnvList) *EnvDiff {
+	result := &EnvDiff{
+		Added:   EnvList{},
+		Removed: EnvList{},
+		Changed: map[string]EnvValueChange{},
+	}
+	for k, v := range source {
+		to, has := target[k]
+		switch {
+		case !has:
+			result.Added[k] = v
+		case fmt.Sprintf("%v", v) != fmt.Sprintf("%v", to):
+			result.Changed[k] = EnvValueChange{From: fmt.Sprintf("%v", to), To: fmt.Sprintf("%v", v)}
+		}
+	}
+	for k, v := range target {
+		if _, has := source[k]; !has {
+			result.Removed[k] = v
+		}
+	}
+	return result
+}
+
+// Picks the keys out of the diff.  Keys that are not in the diff are ignored.
+func promotion(d *EnvDiff, keys []string) *EnvChange {
+	change := &EnvChange{Update: EnvList{}}
+	for _, k := range keys {
+		if v, has := d.Added[k]; has {
+			change.Update[k] = v
+		}
+		if v, has := d.Changed[k]; has {
+			change.Update[k] = v.To
+		}
+		if _, has := d.Removed[k]; has {
+			change.Delete = append(change.Delete, k)
+		}
+	}
+	return change
+}
+
+// Loads the env as it is stored, with the secrets encrypted
+func (this *Service) load_list(domain, service, version string) (EnvList, Revision, error) {
+	_, l, err := this.load(env_root(domain, service, version))
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, -1, ErrNotFound
+	case err != nil:
+		return nil, -1, err
+	}
+	return l.list(), calculate_rev(l), nil
+}
+
+// EnvService
+//
+// Secrets are compared as they are stored, so no secret key is needed.  Each is sealed with a
+// nonce of its own, so a secret shows as changed unless it was promoted from the other env.
+func (this *Service) DiffEnv(c Context, domain, service, version, toDomain, toService, toVersion string) (*EnvDiff, error) {
+	glog.Infoln("DiffEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version,
+		"ToDomain=", toDomain, "ToService=", toService, "ToVersion=", toVersion)
+
+	source, _, err := this.load_list(domain, service, version)
+	if err != nil {
+		return nil, err
+	}
+	target, _, err := this.load_list(toDomain, toService, toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	d := compare(source, target)
+	d.Added = mask_list(d.Added)
+	d.Removed = mask_list(d.Removed)
+	for k, v := range d.Changed {
+		d.Changed[k] = EnvValueChange{From: mask(v.From), To: mask(v.To)}
+	}
+	return d, nil
+}
+
+// EnvService
+//
+// Secrets are copied as they are stored and stay secret in the target.  Their values cannot
+// be checked against the schema of the target without decrypting them, so only their
+// presence is.
+func (this *Service) PromoteEnv(c Context, domain, service, version, toDomain, toService, toVersion string,
+	keys []string) (Revision, error) {
+	glog.Infoln("PromoteEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version,
+		"ToDomain=", toDomain, "ToService=", toService, "ToVersion=", toVersion, "Keys=", keys)
+
+	source, _, err := this.load_list(domain, service, version)
+	if err != nil {
+		return -1, err
+	}
+	target, rev, err := this.load_list(toDomain, toService, toVersion)
+	if err != nil {
+		return -1, err
+	}
+	change := promotion(compare(source, target), keys)
+
+	checked := &EnvChange{Update: EnvList{}, Delete: change.Delete}
+	for k, v := range change.Update {
+		if is_secret(fmt.Sprintf("%v", v)) {
+			v = nil
+		}
+		checked.Update[k] = v
+	}
+	if err := this.check_change(toDomain, toService, toVersion, checked, rev); err != nil {
+		return -1, err
+	}
+
+	// Saving against the revision we compared with means a change to the target in between conflicts.
+	root := env_root(toDomain, toService, toVersion)
+	return this.save(c, root, change, false, rev, &EnvHistoryEntry{})
+}
@@ -0,0 +1,43 @@
+package env
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type DiffTests struct{}
+
+var _ = Suite(&DiffTests{})
+
+func (suite *DiffTests) TestCompareAndPromote(c *C) {
+	staging := EnvList{"DB_URL": "db-staging", "FEATURE_X": "on", "POOL_SIZE": "10"}
+	production := EnvList{"DB_URL": "db-production", "POOL_SIZE": "10", "LEGACY": "1"}
+
+	d := compare(staging, production)
+	c.Assert(d.Added, DeepEquals, EnvList{"FEATURE_X": "on"})
+	c.Assert(d.Removed, DeepEquals, EnvList{"LEGACY": "1"})
+	c.Assert(d.Changed, DeepEquals, map[string]EnvValueChange{
+		"DB_URL": EnvValueChange{From: "db-production", To: "db-staging"},
+	})
+
+	change := promotion(d, []string{"FEATURE_X", "LEGACY", "POOL_SIZE"})
+	c.Assert(change.Update, DeepEquals, EnvList{"FEATURE_X": "on"})
+	c.Assert(change.Delete, DeepEquals, []string{"LEGACY"})
+}
+
+func (suite *DiffTests) TestDiff(c *C) {
+	change := diff(EnvList{"A": "1", "B": "2"}, EnvList{"A": "1", "B": "3", "C": "4"})
+	c.Assert(change.Update, DeepEquals, EnvList{"B": "3", "C": "4"})
+	c.Assert(len(change.Delete), Equals, 0)
+}
+
+// Values that are not strings compare and show as they are saved
+func (suite *DiffTests) TestNotStrings(c *C) {
+	d := compare(EnvList{"POOL_SIZE": 10, "DEBUG": true}, EnvList{"POOL_SIZE": "10", "DEBUG": "false"})
+	c.Assert(d.Changed, DeepEquals, map[string]EnvValueChange{
+		"DEBUG": EnvValueChange{From: "false", To: "true"},
+	})
+	c.Assert(diff(EnvList{"POOL_SIZE": "10"}, EnvList{"POOL_SIZE": 10}).Update, DeepEquals, EnvList{})
+	c.Assert(mask_list(EnvList{"POOL_SIZE": 10}), DeepEquals, EnvList{"POOL_SIZE": "10"})
+	c.Assert(merge([]string{EnvLayerClass}, []EnvList{{"POOL_SIZE": 10}})["POOL_SIZE"].Value, Equals, "10")
+}
@@ -1,10 +1,15 @@
 package env
 
 import (
+	"crypto/cipher"
 	"fmt"
 	"github.com/golang/glog"
 	. "github.com/infradash/redpill/pkg/api"
-	"github.com/qorio/maestro/pkg/zk"
+	"github.com/infradash/redpill/pkg/kv"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"time"
 )
 
 const (
@@ -12,145 +17,285 @@ const (
 )
 
 type Service struct {
-	conn     zk.ZK
-	listEnvs func(string) ([]Env, error)
+	conn   kv.Store
+	cipher cipher.AEAD
 }
 
-func NewService(pool func() zk.ZK, listEnvs func(string) ([]Env, error)) EnvService {
+// The secret key is used to encrypt the values of secret keys.  Without it secrets
+// cannot be written or revealed.
+func NewService(store kv.Store, secretKey []byte) (EnvService, error) {
 	s := new(Service)
-	s.conn = pool()
-	s.listEnvs = listEnvs
-	return s
+	s.conn = store
+	c, err := new_cipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	s.cipher = c
+	return s, nil
+}
+
+// Envs are at /{domain}/{service}/{version}/env.  Without a version the env is a layer that
+// is shared by all the versions of the service in the domain.
+func env_root(domain, service, version string) string {
+	if version == "" {
+		return fmt.Sprintf("/%s/%s/env", domain, service)
+	}
+	return fmt.Sprintf("/%s/%s/%s/env", domain, service, version)
+}
+
+type leaf struct {
+	value   string
+	version int32
+}
+
+// Leaves of an env, keyed by the path relative to the env root.
+type leaves map[string]leaf
+
+func (this leaves) list() EnvList {
+	list := EnvList{}
+	for k, l := range this {
+		list[filepath.Base(k)] = l.value
+	}
+	return list
 }
 
-/// TODO -- this is actually not very accurate to use only the Cversion, which is a version
-/// number associated with the number of children of a znode.  A true version should be
-/// calculated based on the content of the children or some hash of all the children's versions
-func (this *Service) calculate_rev_from_parent(zn *zk.Node) Revision {
-	return Revision(zn.Stats.Cversion)
+// The revision of an env is derived from the content of all the keys under the env root:
+// the relative path, value and version of every leaf are hashed in key order.  Any
+// edit, addition or removal of a key therefore changes the revision, unlike the Cversion
+// of the root which only tracks the number of children.
+func calculate_rev(l leaves) Revision {
+	keys := []string{}
+	for k, _ := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New32a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", k, l[k].value, l[k].version)
+	}
+	return Revision(h.Sum32() & 0x7fffffff) // negative revisions are used for errors
 }
 
-func (this *Service) ListEnvs(c Context, domainClass string) ([]Env, error) {
-	return this.listEnvs(domainClass)
+// Loads the root of the env and all its leaves
+func (this *Service) load(root string) (*kv.Node, leaves, error) {
+	zn, err := this.conn.Get(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes, err := kv.Walk(this.conn, root, func(n *kv.Node) bool {
+		return n.IsLeaf()
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	l := leaves{}
+	for _, n := range nodes {
+		l[n.GetPath()[len(root):]] = leaf{value: n.GetValueString(), version: n.Version}
+	}
+	return zn, l, nil
 }
 
 // EnvService
 func (this *Service) GetEnv(c Context, domain, service, version string) (EnvList, Revision, error) {
-	key := fmt.Sprintf("/%s/%s/%s/env", domain, service, version)
+	key := env_root(domain, service, version)
 	glog.Infoln("GetEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version, "Key=", key)
-	zn, err := this.conn.Get(key)
-	if err != nil {
+	_, l, err := this.load(key)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, -1, ErrNotFound
+	case err != nil:
 		return nil, -1, err
 	}
-
-	list := EnvList{}
-	_, err = zn.VisitChildrenRecursive(func(n *zk.Node) bool {
-		if n.IsLeaf() {
-			list[n.GetBasename()] = n.GetValueString()
-		}
-		return false
-	})
-	return list, this.calculate_rev_from_parent(zn), nil
+	return mask_list(l.list()), calculate_rev(l), nil
 }
 
 // EnvService
-func (this *Service) NewEnv(c Context, domain, service, version string, vars *EnvList) (Revision, error) {
+func (this *Service) NewEnv(c Context, domain, service, version string, vars *EnvList, secret ...string) (Revision, error) {
 	glog.Infoln("NewEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version)
 
-	root := fmt.Sprintf("/%s/%s/%s/env", domain, service, version)
+	root := env_root(domain, service, version)
 
 	_, err := this.conn.Get(root)
 	switch {
 	case err == nil:
 		return -1, ErrConflict
-	case err != zk.ErrNotExist:
+	case err != kv.ErrNotExist:
 		return -1, err
-	case err == zk.ErrNotExist:
+	case err == kv.ErrNotExist:
 		// continue
 	}
 
-	// everything ok. commit changes.  Note this is not atomic!
+	if err := check_plain(*vars); err != nil {
+		return -1, err
+	}
+	if err := this.check_new(domain, service, version, *vars); err != nil {
+		return -1, err
+	}
+
+	// The multi does not create parents so make sure /{domain}/{service}/{version} is there.
+	if err := this.ensure(filepath.Dir(root)); err != nil {
+		return -1, err
+	}
+	if err := this.ensure(history_root(root)); err != nil {
+		return -1, err
+	}
+
+	record := &EnvHistoryEntry{User: c.UserId(), Timestamp: time.Now().Unix()}
+	after := leaves{}
+	secrets := to_set(secret)
+
+	// Creating the root in the same transaction means a concurrent NewEnv will conflict.
+	ops := []kv.Op{kv.OpCreate(root, []byte{})}
 	for key, create := range *vars {
 		k := fmt.Sprintf("%s/%s", root, key)
-		v := fmt.Sprintf("%s", create)
-		_, err := this.conn.Create(k, []byte(v))
+		v, err := this.seal(key, fmt.Sprintf("%v", create), secrets, after)
 		if err != nil {
 			return -1, err
 		}
+		ops = append(ops, kv.OpCreate(k, []byte(v)))
+		after["/"+key] = leaf{value: v, version: 0}
+		record.Changes = append(record.Changes, EnvKeyChange{Key: key, Action: EnvKeyAdd, New: v})
 	}
 
-	zn, err := this.conn.Get(root)
-	switch {
-	case err != nil:
+	rev := calculate_rev(after)
+	record.Revision = rev
+	op, err := history_op(root, record)
+	if err != nil {
+		return -1, err
+	}
+	if err := this.commit(append(ops, op)); err != nil {
 		return -1, err
 	}
-	return this.calculate_rev_from_parent(zn), nil
+	return rev, nil
 }
 
-func (this *Service) SaveEnv(c Context, domain, service, version string, change *EnvChange, rev Revision) error {
+func (this *Service) SaveEnv(c Context, domain, service, version string, change *EnvChange, rev Revision) (Revision, error) {
 	glog.Infoln("SaveEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version, "Rev=", rev)
 
-	root := fmt.Sprintf("/%s/%s/%s/env", domain, service, version)
-	if zn, err := this.conn.Get(root); err != nil && err != zk.ErrNotExist {
-		return err
-	} else if this.calculate_rev_from_parent(zn) != rev {
-		return ErrConflict
+	root := env_root(domain, service, version)
+	if err := check_plain(change.Update); err != nil {
+		return -1, err
+	}
+	if err := this.check_change(domain, service, version, change, rev); err != nil {
+		return -1, err
+	}
+	return this.save(c, root, change, false, rev, &EnvHistoryEntry{})
+}
+
+// Applies the change and records it in the history.  The record is filled in with the user,
+// time, the old and new values and the new revision.  If sealed is true the values in the
+// change are already in the form that is stored and are not encrypted again.
+func (this *Service) save(c Context, root string, change *EnvChange, sealed bool, rev Revision, record *EnvHistoryEntry) (Revision, error) {
+	zn, before, err := this.load(root)
+	switch {
+	case err == kv.ErrNotExist:
+		return -1, ErrNotFound
+	case err != nil:
+		return -1, err
+	}
+	if calculate_rev(before) != rev {
+		return -1, ErrConflict
+	}
+
+	if err := this.ensure(history_root(root)); err != nil {
+		return -1, err
+	}
+
+	record.User = c.UserId()
+	record.Timestamp = time.Now().Unix()
+
+	after := leaves{}
+	for k, l := range before {
+		after[k] = l
 	}
 
-	creates := []string{}
-	updates := []struct {
-		Node  *zk.Node
-		Value []byte
-	}{}
+	// Every change touches the root at the version we checked above.  Any other writer
+	// committing in between bumps that version and one of us gets a conflict.
+	ops := []kv.Op{kv.OpSet(root, zn.Value, zn.Version)}
+	changed := map[string]bool{}
+	secrets := to_set(change.Secret)
+
 	for key, update := range change.Update {
-		n, err := this.conn.Get(fmt.Sprintf("%s/%s", root, key))
-		v := fmt.Sprintf("%s", update)
-		switch {
-		case err == zk.ErrNotExist:
-			creates = append(creates, v)
-		case err != nil:
-			return err
-		default:
-			updates = append(updates, struct {
-				Node  *zk.Node
-				Value []byte
-			}{n, []byte(v)})
+		k := "/" + key
+		v := fmt.Sprintf("%v", update)
+		if !sealed {
+			if v, err = this.seal(key, v, secrets, before); err != nil {
+				return -1, err
+			}
+		}
+		if l, has := before[k]; has {
+			ops = append(ops, kv.OpSet(root+k, []byte(v), l.version))
+			after[k] = leaf{value: v, version: l.version + 1}
+			record.Changes = append(record.Changes, EnvKeyChange{Key: key, Action: EnvKeyUpdate, Old: l.value, New: v})
+		} else {
+			ops = append(ops, kv.OpCreate(root+k, []byte(v)))
+			after[k] = leaf{value: v, version: 0}
+			record.Changes = append(record.Changes, EnvKeyChange{Key: key, Action: EnvKeyAdd, New: v})
 		}
+		changed[k] = true
 	}
 
-	deletes := []*zk.Node{}
-	for _, delete := range change.Delete {
-		k := fmt.Sprintf("%s/%s", root, delete)
-		n, err := this.conn.Get(k)
-		switch {
-		case err == zk.ErrNotExist:
-		case err != nil:
-			return err
-		default:
-			deletes = append(deletes, n)
+	for _, key := range change.Delete {
+		k := "/" + key
+		if l, has := before[k]; has && !changed[k] {
+			ops = append(ops, kv.OpDelete(root+k, l.version))
+			delete(after, k)
+			record.Changes = append(record.Changes, EnvKeyChange{Key: key, Action: EnvKeyDelete, Old: l.value})
+			changed[k] = true
 		}
 	}
 
-	// everything ok. commit changes.  Note this is not atomic!
-	for key, create := range creates {
-		k := fmt.Sprintf("%s/%s", root, key)
-		v := fmt.Sprintf("%s", create)
-		_, err := this.conn.Create(k, []byte(v))
-		if err != nil {
-			return err
+	// The revision covers the keys we are not changing as well.  Check that they are
+	// still what we hashed.
+	for k, l := range before {
+		if !changed[k] {
+			ops = append(ops, kv.OpCheck(root+k, l.version))
 		}
 	}
-	for _, update := range updates {
-		err := update.Node.Set(update.Value)
-		if err != nil {
-			return err
-		}
+
+	new_rev := calculate_rev(after)
+	record.Revision = new_rev
+	op, err := history_op(root, record)
+	if err != nil {
+		return -1, err
 	}
-	for _, delete := range deletes {
-		err := delete.Delete()
-		if err != nil {
+	if err := this.commit(append(ops, op)); err != nil {
+		return -1, err
+	}
+	return new_rev, nil
+}
+
+// Creates the node if it does not exist
+func (this *Service) ensure(path string) error {
+	_, err := this.conn.Get(path)
+	switch {
+	case err == kv.ErrNotExist:
+		if _, err := this.conn.Create(path, []byte{}); err != nil && err != kv.ErrNodeExists {
 			return err
 		}
+	case err != nil:
+		return err
 	}
 	return nil
 }
+
+// Commits all the operations as a single transaction.  Failures due to nodes that were
+// created, changed or removed since we read them are reported as conflicts.
+func (this *Service) commit(ops []kv.Op) error {
+	_, err := this.conn.Multi(ops...)
+	switch {
+	case err == kv.ErrBadVersion, err == kv.ErrNodeExists, err == kv.ErrNotExist:
+		return ErrConflict
+	default:
+		return err
+	}
+}
+
+func to_set(keys []string) map[string]bool {
+	set := map[string]bool{}
+	for _, k := range keys {
+		set[k] = true
+	}
+	return set
+}
@@ -0,0 +1,425 @@
+package env
+
+import (
+	"fmt"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnv(t *testing.T) { TestingT(t) }
+
+type test_context string
+
+func (t test_context) UserId() string {
+	return string(t)
+}
+func (t test_context) Groups() []string {
+	return nil
+}
+func (t test_context) UrlParameter(k string) string {
+	return ""
+}
+
+type EnvTests struct {
+	store   kv.Store
+	c       Context
+	version string
+}
+
+var _ = Suite(&EnvTests{})
+
+func (suite *EnvTests) SetUpSuite(c *C) {
+	c.Log("Connecting to zk")
+	store, err := kv.NewZkStore([]string{"localhost:2181"}, 5*time.Second)
+	c.Assert(err, Equals, nil)
+	suite.setup(store)
+}
+
+func (suite *EnvTests) setup(store kv.Store) {
+	suite.store = store
+	suite.c = test_context("test")
+	suite.version = fmt.Sprintf("v%d", time.Now().Unix())
+}
+
+// The same tests with a BoltDB store
+type BoltEnvTests struct {
+	EnvTests
+}
+
+var _ = Suite(&BoltEnvTests{})
+
+func (suite *BoltEnvTests) SetUpSuite(c *C) {
+	store, err := kv.OpenBoltStore(filepath.Join(c.MkDir(), "env.db"))
+	c.Assert(err, Equals, nil)
+	suite.setup(store)
+}
+
+func (suite *BoltEnvTests) TearDownSuite(c *C) {
+	suite.store.Close()
+}
+
+func (suite *EnvTests) TestNewAndSaveEnv(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	rev, err := env.NewEnv(suite.c, "unit-test.env", "test", suite.version, &EnvList{
+		"DB_URL":    "mysql://localhost",
+		"POOL_SIZE": "10",
+	})
+	c.Assert(err, Equals, nil)
+
+	// again should conflict
+	_, err = env.NewEnv(suite.c, "unit-test.env", "test", suite.version, &EnvList{"DB_URL": "x"})
+	c.Assert(err, Equals, ErrConflict)
+
+	rev2, err := env.SaveEnv(suite.c, "unit-test.env", "test", suite.version, &EnvChange{
+		Update: EnvList{"DB_URL": "mysql://db", "NEW_KEY": "new"},
+		Delete: []string{"POOL_SIZE"},
+	}, rev)
+	c.Assert(err, Equals, nil)
+	c.Assert(rev2, Not(Equals), rev)
+
+	list, rev3, err := env.GetEnv(suite.c, "unit-test.env", "test", suite.version)
+	c.Assert(err, Equals, nil)
+	c.Assert(rev3, Equals, rev2)
+	c.Assert(list["DB_URL"], Equals, "mysql://db")
+	c.Assert(list["NEW_KEY"], Equals, "new")
+	_, has := list["POOL_SIZE"]
+	c.Assert(has, Equals, false)
+
+	// stale revision
+	_, err = env.SaveEnv(suite.c, "unit-test.env", "test", suite.version, &EnvChange{
+		Update: EnvList{"DB_URL": "mysql://stale"},
+	}, rev)
+	c.Assert(err, Equals, ErrConflict)
+
+	list, _, err = env.GetEnv(suite.c, "unit-test.env", "test", suite.version)
+	c.Assert(err, Equals, nil)
+	c.Assert(list["DB_URL"], Equals, "mysql://db")
+
+	_, _, err = env.GetEnv(suite.c, "unit-test.env", "test", "no-such-version")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+// A key changed between the read and the commit
+func (suite *EnvTests) TestCommitConflict(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+	_, err = env.NewEnv(suite.c, "unit-test.env", "commit", suite.version, &EnvList{"A": "1"})
+	c.Assert(err, Equals, nil)
+
+	key := env_root("unit-test.env", "commit", suite.version) + "/A"
+	_, err = suite.store.Set(key, []byte("2"), -1)
+	c.Assert(err, Equals, nil)
+	err = env.(*Service).commit([]kv.Op{kv.OpSet(key, []byte("3"), 0)})
+	c.Assert(err, Equals, ErrConflict)
+	err = env.(*Service).commit([]kv.Op{kv.OpCreate(key, []byte("3"))})
+	c.Assert(err, Equals, ErrConflict)
+
+	list, _, err := env.GetEnv(suite.c, "unit-test.env", "commit", suite.version)
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, EnvList{"A": "2"})
+}
+
+func (suite *EnvTests) TestRevisionChangesOnValueEdit(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	version := suite.version + "-edit"
+	rev, err := env.NewEnv(suite.c, "unit-test.env", "test", version, &EnvList{"KEY": "value1"})
+	c.Assert(err, Equals, nil)
+
+	// Editing a value in place does not change the number of children but must change the revision
+	rev2, err := env.SaveEnv(suite.c, "unit-test.env", "test", version, &EnvChange{
+		Update: EnvList{"KEY": "value2"},
+	}, rev)
+	c.Assert(err, Equals, nil)
+	c.Assert(rev2, Not(Equals), rev)
+
+	_, err = env.SaveEnv(suite.c, "unit-test.env", "test", version, &EnvChange{
+		Update: EnvList{"KEY": "value3"},
+	}, rev)
+	c.Assert(err, Equals, ErrConflict)
+}
+
+func (suite *EnvTests) TestHistoryAndRollback(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	version := suite.version + "-history"
+	rev1, err := env.NewEnv(suite.c, "unit-test.env", "test", version, &EnvList{"DB_URL": "db1"})
+	c.Assert(err, Equals, nil)
+
+	rev2, err := env.SaveEnv(suite.c, "unit-test.env", "test", version, &EnvChange{
+		Update: EnvList{"DB_URL": "db2", "POOL_SIZE": "5"},
+	}, rev1)
+	c.Assert(err, Equals, nil)
+
+	history, err := env.ListEnvHistory(suite.c, "unit-test.env", "test", version)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(history), Equals, 2)
+	c.Assert(history[0].Revision, Equals, rev1)
+	c.Assert(history[1].Revision, Equals, rev2)
+	c.Assert(history[1].User, Equals, "test")
+	c.Assert(history[1].Changes[0], DeepEquals, EnvKeyChange{Key: "DB_URL", Action: EnvKeyUpdate, Old: "db1", New: "db2"})
+
+	old, err := env.GetEnvAt(suite.c, "unit-test.env", "test", version, rev1)
+	c.Assert(err, Equals, nil)
+	c.Assert(old, DeepEquals, EnvList{"DB_URL": "db1"})
+
+	rev3, err := env.RollbackEnv(suite.c, "unit-test.env", "test", version, rev1, rev2)
+	c.Assert(err, Equals, nil)
+
+	list, rev, err := env.GetEnv(suite.c, "unit-test.env", "test", version)
+	c.Assert(err, Equals, nil)
+	c.Assert(rev, Equals, rev3)
+	c.Assert(list, DeepEquals, EnvList{"DB_URL": "db1"})
+
+	history, err = env.ListEnvHistory(suite.c, "unit-test.env", "test", version)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(history), Equals, 3)
+	c.Assert(history[2].RollbackTo, Equals, rev1)
+}
+
+func (suite *EnvTests) TestSecrets(c *C) {
+	env, err := NewService(suite.store, []byte("0123456789abcdef"))
+	c.Assert(err, Equals, nil)
+
+	version := suite.version + "-secret"
+	rev, err := env.NewEnv(suite.c, "unit-test.env", "test", version, &EnvList{
+		"DB_URL":      "mysql://localhost",
+		"DB_PASSWORD": "hunter2",
+	}, "DB_PASSWORD")
+	c.Assert(err, Equals, nil)
+
+	list, rev2, err := env.GetEnv(suite.c, "unit-test.env", "test", version)
+	c.Assert(err, Equals, nil)
+	c.Assert(rev2, Equals, rev)
+	c.Assert(list["DB_PASSWORD"], Equals, EnvSecretMask)
+	c.Assert(list["DB_URL"], Equals, "mysql://localhost")
+
+	stored, err := suite.store.Get("/unit-test.env/test/" + version + "/env/DB_PASSWORD")
+	c.Assert(err, Equals, nil)
+	c.Assert(stored.GetValueString(), Not(Equals), "hunter2")
+
+	revealed, _, err := env.RevealEnv(suite.c, "unit-test.env", "test", version)
+	c.Assert(err, Equals, nil)
+	c.Assert(revealed["DB_PASSWORD"], Equals, "hunter2")
+	audit, err := suite.store.Children("/_redpill/env_audit/unit-test.env/test/" + version)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(audit), Equals, 1)
+
+	// Plain values that look sealed are not taken
+	_, err = env.SaveEnv(suite.c, "unit-test.env", "test", version, &EnvChange{Update: EnvList{"DB_URL": "secret://xyz"}}, rev)
+	c.Assert(err, FitsTypeOf, &EnvValidationError{})
+
+	// Nor is a masked secret written back
+	_, err = env.SaveEnv(suite.c, "unit-test.env", "test", version, &EnvChange{Update: list}, rev)
+	c.Assert(err, FitsTypeOf, &EnvValidationError{})
+	revealed, _, err = env.RevealEnv(suite.c, "unit-test.env", "test", version)
+	c.Assert(err, Equals, nil)
+	c.Assert(revealed["DB_PASSWORD"], Equals, "hunter2")
+}
+
+// Diff and promote work on the stored values and need no secret key
+func (suite *EnvTests) TestDiffAndPromoteSecrets(c *C) {
+	keyed, err := NewService(suite.store, []byte("0123456789abcdef"))
+	c.Assert(err, Equals, nil)
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	staging, production := suite.version+"-staging", suite.version+"-production"
+	_, err = keyed.NewEnv(suite.c, "unit-test.env", "test", staging, &EnvList{
+		"DB_PASSWORD": "hunter2",
+		"POOL_SIZE":   10,
+	}, "DB_PASSWORD")
+	c.Assert(err, Equals, nil)
+	_, err = env.NewEnv(suite.c, "unit-test.env", "test", production, &EnvList{"POOL_SIZE": "10"})
+	c.Assert(err, Equals, nil)
+
+	d, err := env.DiffEnv(suite.c, "unit-test.env", "test", staging, "unit-test.env", "test", production)
+	c.Assert(err, Equals, nil)
+	c.Assert(d.Added, DeepEquals, EnvList{"DB_PASSWORD": EnvSecretMask})
+	c.Assert(d.Changed, DeepEquals, map[string]EnvValueChange{})
+
+	_, err = env.PromoteEnv(suite.c, "unit-test.env", "test", staging, "unit-test.env", "test", production,
+		[]string{"DB_PASSWORD"})
+	c.Assert(err, Equals, nil)
+	list, _, err := env.GetEnv(suite.c, "unit-test.env", "test", production)
+	c.Assert(err, Equals, nil)
+	c.Assert(list["DB_PASSWORD"], Equals, EnvSecretMask)
+	revealed, _, err := keyed.RevealEnv(suite.c, "unit-test.env", "test", production)
+	c.Assert(err, Equals, nil)
+	c.Assert(revealed["DB_PASSWORD"], Equals, "hunter2")
+
+	// Copied as stored, so the same on both sides now
+	d, err = env.DiffEnv(suite.c, "unit-test.env", "test", staging, "unit-test.env", "test", production)
+	c.Assert(err, Equals, nil)
+	c.Assert(d.Added, DeepEquals, EnvList{})
+	c.Assert(d.Changed, DeepEquals, map[string]EnvValueChange{})
+}
+
+func (suite *EnvTests) TestListEnvs(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	class := fmt.Sprintf("list-%d.test", time.Now().Unix())
+	for _, instance := range []string{"dev", "staging"} {
+		for _, version := range []string{"v1.0", "v1.1"} {
+			_, err := env.NewEnv(suite.c, instance+"."+class, "blinker", version, &EnvList{"A": "a"})
+			c.Assert(err, Equals, nil)
+		}
+	}
+	_, err = suite.store.Create("/dev."+class+"/blinker/live",
+		[]byte("/dev."+class+"/blinker/v1.1/container/blinker,/dev."+class+"/blinker/v1.1/env"))
+	c.Assert(err, Equals, nil)
+
+	// The env of the service itself, with its history and a schema, are not versions
+	rev, err := env.NewEnv(suite.c, "dev."+class, "blinker", "", &EnvList{"env": "a"})
+	c.Assert(err, Equals, nil)
+	_, err = env.SaveEnv(suite.c, "dev."+class, "blinker", "", &EnvChange{Update: EnvList{"env": "b"}}, rev)
+	c.Assert(err, Equals, nil)
+	err = env.SaveEnvSchema(suite.c, "dev."+class, "blinker", &EnvSchema{
+		Keys: map[string]EnvKeySchema{"env": EnvKeySchema{}},
+	})
+	c.Assert(err, Equals, nil)
+	for _, node := range []string{"env", "env_history", "env_schema"} {
+		_, err = suite.store.Get("/dev." + class + "/blinker/" + node)
+		c.Assert(err, Equals, nil)
+	}
+
+	envs, err := env.ListEnvs(suite.c, class)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(envs), Equals, 1)
+	c.Assert(envs[0].Service, Equals, "blinker")
+	c.Assert(envs[0].Instances, DeepEquals, []string{"dev", "staging"})
+	c.Assert(envs[0].Versions, DeepEquals, []string{"v1.0", "v1.1"})
+	c.Assert(envs[0].Live, DeepEquals, map[string]string{"dev": "v1.1"})
+}
+
+func (suite *EnvTests) TestSchema(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	service := fmt.Sprintf("schema-%d", time.Now().Unix())
+	pool_size := "10"
+	err = env.SaveEnvSchema(suite.c, "env", service, &EnvSchema{
+		Keys: map[string]EnvKeySchema{
+			"DATABASE_URL": EnvKeySchema{Required: true, Type: EnvTypeUrl},
+			"POOL_SIZE":    EnvKeySchema{Type: EnvTypeInt, Default: &pool_size},
+		},
+	})
+	c.Assert(err, Equals, nil)
+
+	_, err = env.NewEnv(suite.c, "unit-test.env", service, suite.version, &EnvList{"DATABSE_URL": "mysql://localhost"})
+	c.Assert(err, FitsTypeOf, &EnvValidationError{})
+	c.Assert(err.(*EnvValidationError).Errors, DeepEquals, []EnvFieldError{{Key: "DATABASE_URL", Error: "required"}})
+
+	rev, err := env.NewEnv(suite.c, "unit-test.env", service, suite.version, &EnvList{"DATABASE_URL": "mysql://localhost"})
+	c.Assert(err, Equals, nil)
+
+	list, _, err := env.GetEnv(suite.c, "unit-test.env", service, suite.version)
+	c.Assert(err, Equals, nil)
+	c.Assert(list["POOL_SIZE"], Equals, "10")
+
+	_, err = env.SaveEnv(suite.c, "unit-test.env", service, suite.version, &EnvChange{Update: EnvList{"POOL_SIZE": "ten"}}, rev)
+	c.Assert(err, FitsTypeOf, &EnvValidationError{})
+
+	_, err = env.SaveEnv(suite.c, "unit-test.env", service, suite.version, &EnvChange{Delete: []string{"DATABASE_URL"}}, rev)
+	c.Assert(err, FitsTypeOf, &EnvValidationError{})
+
+	result, err := env.ValidateEnv(suite.c, "unit-test.env", service, suite.version)
+	c.Assert(err, Equals, nil)
+	c.Assert(result.Valid, Equals, true)
+}
+
+func (suite *EnvTests) TestLayers(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	service := fmt.Sprintf("layers-%d", time.Now().Unix())
+	_, err = env.NewEnv(suite.c, "env", service, "", &EnvList{"LOG_LEVEL": "info", "REGION": "us-west-2"})
+	c.Assert(err, Equals, nil)
+	_, err = env.NewEnv(suite.c, "unit-test.env", service, "", &EnvList{"LOG_LEVEL": "debug"})
+	c.Assert(err, Equals, nil)
+	_, err = env.NewEnv(suite.c, "unit-test.env", service, suite.version, &EnvList{"DB_URL": "mysql://localhost"})
+	c.Assert(err, Equals, nil)
+
+	resolved, err := env.ResolveEnv(suite.c, "unit-test.env", service, suite.version)
+	c.Assert(err, Equals, nil)
+	c.Assert(resolved, DeepEquals, map[string]EnvResolvedValue{
+		"REGION":    {Value: "us-west-2", Layer: EnvLayerClass},
+		"LOG_LEVEL": {Value: "debug", Layer: EnvLayerInstance, Overrides: []string{EnvLayerClass}},
+		"DB_URL":    {Value: "mysql://localhost", Layer: EnvLayerVersion},
+	})
+}
+
+func (suite *EnvTests) TestWatch(c *C) {
+	env, err := NewService(suite.store, nil)
+	c.Assert(err, Equals, nil)
+
+	version := suite.version + "-watch"
+	rev, err := env.NewEnv(suite.c, "unit-test.env", "test", version, &EnvList{"A": "a", "B": "b"})
+	c.Assert(err, Equals, nil)
+
+	stop := make(chan bool)
+	events, err := env.WatchEnv(suite.c, "unit-test.env", "test", version, stop)
+	c.Assert(err, Equals, nil)
+
+	rev, err = env.SaveEnv(suite.c, "unit-test.env", "test", version,
+		&EnvChange{Update: EnvList{"A": "a2"}, Delete: []string{"B"}}, rev)
+	c.Assert(err, Equals, nil)
+
+	received := []EnvChangeEvent{}
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			c.Fatal("No events")
+		}
+	}
+	c.Assert(received, DeepEquals, []EnvChangeEvent{
+		{Key: "A", Action: EnvKeyUpdate, Value: "a2", Revision: rev},
+		{Key: "B", Action: EnvKeyDelete, Revision: rev},
+	})
+
+	// Watch is set again after it fires
+	rev, err = env.SaveEnv(suite.c, "unit-test.env", "test", version, &EnvChange{Update: EnvList{"C": "c"}}, rev)
+	c.Assert(err, Equals, nil)
+	select {
+	case event := <-events:
+		c.Assert(event, DeepEquals, EnvChangeEvent{Key: "C", Action: EnvKeyAdd, Value: "c", Revision: rev})
+	case <-time.After(5 * time.Second):
+		c.Fatal("No events")
+	}
+
+	// Keys written directly, and not through the env api, are seen as well
+	root := env_root("unit-test.env", "test", version)
+	_, err = suite.store.Set(root+"/A", []byte("a3"), -1)
+	c.Assert(err, Equals, nil)
+	_, err = suite.store.Create(root+"/D", []byte("d"))
+	c.Assert(err, Equals, nil)
+	received = []EnvChangeEvent{}
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			event.Revision = 0
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			c.Fatal("No events")
+		}
+	}
+	c.Assert(received, DeepEquals, []EnvChangeEvent{
+		{Key: "A", Action: EnvKeyUpdate, Value: "a3"},
+		{Key: "D", Action: EnvKeyAdd, Value: "d"},
+	})
+
+	close(stop)
+	for _ = range events {
+	}
+}
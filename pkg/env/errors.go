@@ -0,0 +1,10 @@
+package env
+
+import (
+	"errors"
+)
+
+var (
+	ErrNoSecretKey  = errors.New("no-secret-key")
+	ErrBadSecretKey = errors.New("bad-secret-key")
+)
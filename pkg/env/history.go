@@ -0,0 +1,143 @@
+package env
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"path/filepath"
+	"sort"
+)
+
+// History of an env is kept next to it, at /{domain}/{service}/{version}/env_history.
+// Each change is a sequential node holding the json of the EnvHistoryEntry and is created
+// in the same transaction as the change itself.
+func history_root(root string) string {
+	return filepath.Join(filepath.Dir(root), "env_history")
+}
+
+func history_op(root string, record *EnvHistoryEntry) (kv.Op, error) {
+	sort.Sort(by_key(record.Changes))
+	buff, err := json.Marshal(record)
+	if err != nil {
+		return kv.Op{}, err
+	}
+	return kv.OpCreateSequential(history_root(root)+"/rev-", buff), nil
+}
+
+type by_key []EnvKeyChange
+
+func (p by_key) Len() int           { return len(p) }
+func (p by_key) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p by_key) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Oldest first
+func (this *Service) history(root string) ([]EnvHistoryEntry, error) {
+	zn, err := this.conn.Get(history_root(root))
+	switch {
+	case err == kv.ErrNotExist:
+		return []EnvHistoryEntry{}, nil
+	case err != nil:
+		return nil, err
+	}
+	children, err := this.conn.Children(zn.Path)
+	if err != nil {
+		return nil, err
+	}
+	// Sequence numbers are zero padded so sorting the names sorts by sequence
+	sort.Sort(by_path(children))
+	result := []EnvHistoryEntry{}
+	for _, n := range children {
+		record := EnvHistoryEntry{}
+		if err := json.Unmarshal(n.GetValue(), &record); err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+type by_path []*kv.Node
+
+func (p by_path) Len() int           { return len(p) }
+func (p by_path) Less(i, j int) bool { return p[i].GetPath() < p[j].GetPath() }
+func (p by_path) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// EnvService
+func (this *Service) ListEnvHistory(c Context, domain, service, version string) ([]EnvHistoryEntry, error) {
+	glog.Infoln("ListEnvHistory:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version)
+	history, err := this.history(env_root(domain, service, version))
+	if err != nil {
+		return nil, err
+	}
+	// Secrets are recorded encrypted but there is no need to show even that.
+	for i, record := range history {
+		for j, change := range record.Changes {
+			history[i].Changes[j].Old = mask(change.Old)
+			history[i].Changes[j].New = mask(change.New)
+		}
+	}
+	return history, nil
+}
+
+// EnvService
+func (this *Service) GetEnvAt(c Context, domain, service, version string, rev Revision) (EnvList, error) {
+	glog.Infoln("GetEnvAt:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version, "Rev=", rev)
+	env, err := this.env_at(env_root(domain, service, version), rev)
+	if err != nil {
+		return nil, err
+	}
+	return mask_list(env), nil
+}
+
+// Returns the env as stored, with secrets encrypted.  Starts from the current env and undoes the recorded changes, newest first, until we
+// reach the record that produced the revision.
+func (this *Service) env_at(root string, rev Revision) (EnvList, error) {
+	_, l, err := this.load(root)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	env := l.list()
+	if calculate_rev(l) == rev {
+		return env, nil
+	}
+
+	history, err := this.history(root)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Revision == rev {
+			return env, nil
+		}
+		for _, change := range history[i].Changes {
+			switch change.Action {
+			case EnvKeyAdd:
+				delete(env, change.Key)
+			case EnvKeyUpdate, EnvKeyDelete:
+				env[change.Key] = change.Old
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// EnvService
+func (this *Service) RollbackEnv(c Context, domain, service, version string, to, rev Revision) (Revision, error) {
+	glog.Infoln("RollbackEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version,
+		"To=", to, "Rev=", rev)
+
+	root := env_root(domain, service, version)
+	target, err := this.env_at(root, to)
+	if err != nil {
+		return -1, err
+	}
+	_, l, err := this.load(root)
+	if err != nil {
+		return -1, err
+	}
+	return this.save(c, root, diff(l.list(), target), true, rev, &EnvHistoryEntry{RollbackTo: to})
+}
@@ -0,0 +1,115 @@
+package env
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+)
+
+// Values shared by all the versions of a service are set in the layers below the env of the
+// version:
+//
+//	/{domain_class}/{service}/env                    the class layer
+//	/{domain_instance}.{domain_class}/{service}/env  the instance layer
+//	/{domain_instance}.{domain_class}/{service}/{version}/env
+//
+// The layers are envs without a version and are read and written like any other env.
+type env_layer struct {
+	name string
+	root string
+}
+
+// Lowest first
+func layers(domain, service, version string) []env_layer {
+	return []env_layer{
+		{name: EnvLayerClass, root: env_root(domain_class(domain), service, "")},
+		{name: EnvLayerInstance, root: env_root(domain, service, "")},
+		{name: EnvLayerVersion, root: env_root(domain, service, version)},
+	}
+}
+
+// Loads the stored values of the layers.  Layers that do not exist are empty.  Returns
+// ErrNotFound if none of them exist.
+func (this *Service) load_layers(layers []env_layer) ([]EnvList, error) {
+	lists := []EnvList{}
+	found := false
+	for _, layer := range layers {
+		_, l, err := this.load(layer.root)
+		switch {
+		case err == kv.ErrNotExist:
+			lists = append(lists, EnvList{})
+		case err != nil:
+			return nil, err
+		default:
+			lists = append(lists, l.list())
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return lists, nil
+}
+
+// The stored values a version inherits from the layers below it
+func (this *Service) inherited(domain, service string) (EnvList, error) {
+	lists, err := this.load_layers(layers(domain, service, "")[0:2])
+	switch {
+	case err == ErrNotFound:
+		return EnvList{}, nil
+	case err != nil:
+		return nil, err
+	}
+	inherited := EnvList{}
+	for _, list := range lists {
+		for k, v := range list {
+			inherited[k] = v
+		}
+	}
+	return inherited, nil
+}
+
+// Each layer overrides the ones before it
+func merge(names []string, lists []EnvList) map[string]EnvResolvedValue {
+	resolved := map[string]EnvResolvedValue{}
+	for i, list := range lists {
+		for k, v := range list {
+			value := EnvResolvedValue{Value: fmt.Sprintf("%v", v), Layer: names[i]}
+			if below, has := resolved[k]; has {
+				value.Overrides = append(below.Overrides, below.Layer)
+			}
+			resolved[k] = value
+		}
+	}
+	return resolved
+}
+
+// Resolves the stored values of the env
+func (this *Service) resolve(domain, service, version string) (map[string]EnvResolvedValue, error) {
+	l := layers(domain, service, version)
+	lists, err := this.load_layers(l)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, layer := range l {
+		names = append(names, layer.name)
+	}
+	return merge(names, lists), nil
+}
+
+// EnvService
+func (this *Service) ResolveEnv(c Context, domain, service, version string) (map[string]EnvResolvedValue, error) {
+	glog.Infoln("ResolveEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version)
+
+	resolved, err := this.resolve(domain, service, version)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range resolved {
+		v.Value = mask(v.Value)
+		resolved[k] = v
+	}
+	return resolved, nil
+}
@@ -0,0 +1,33 @@
+package env
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type LayerTests struct{}
+
+var _ = Suite(&LayerTests{})
+
+func (suite *LayerTests) TestLayers(c *C) {
+	l := layers("dev.blinker.com", "blinker", "v1.0")
+	c.Assert(l, DeepEquals, []env_layer{
+		{name: EnvLayerClass, root: "/blinker.com/blinker/env"},
+		{name: EnvLayerInstance, root: "/dev.blinker.com/blinker/env"},
+		{name: EnvLayerVersion, root: "/dev.blinker.com/blinker/v1.0/env"},
+	})
+}
+
+func (suite *LayerTests) TestMerge(c *C) {
+	resolved := merge([]string{EnvLayerClass, EnvLayerInstance, EnvLayerVersion}, []EnvList{
+		{"LOG_LEVEL": "info", "REGION": "us-west-2", "POOL_SIZE": "10"},
+		{"LOG_LEVEL": "debug", "POOL_SIZE": "5"},
+		{"POOL_SIZE": "20", "DB_URL": "mysql://localhost"},
+	})
+	c.Assert(resolved, DeepEquals, map[string]EnvResolvedValue{
+		"REGION":    {Value: "us-west-2", Layer: EnvLayerClass},
+		"LOG_LEVEL": {Value: "debug", Layer: EnvLayerInstance, Overrides: []string{EnvLayerClass}},
+		"POOL_SIZE": {Value: "20", Layer: EnvLayerVersion, Overrides: []string{EnvLayerClass, EnvLayerInstance}},
+		"DB_URL":    {Value: "mysql://localhost", Layer: EnvLayerVersion},
+	})
+}
@@ -0,0 +1,147 @@
+package env
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Envs of a domain class are found by walking the tree the dash agents write to:
+//
+//	/{domain_instance}.{domain_class}/{service}/{version}/env
+//	/{domain_instance}.{domain_class}/{service}/live
+//
+// The live node holds the comma separated paths the agent is running from, e.g.
+// /dev.blinker.com/blinker/v1.0/container/blinker,/dev.blinker.com/blinker/v1.0/env
+// so the live version is the path segment after the service.
+const live_node = "live"
+
+// The children of a service that are not versions: the env, history and schema of the
+// service itself, and the live node.
+var reserved_nodes = map[string]bool{
+	"env":         true,
+	"env_history": true,
+	"env_schema":  true,
+	live_node:     true,
+}
+
+func live_version(domain, service, value string) string {
+	value = strings.TrimSpace(strings.Split(value, ",")[0])
+	prefix := "/" + domain + "/" + service + "/"
+	switch {
+	case strings.HasPrefix(value, prefix):
+		return strings.Split(value[len(prefix):], "/")[0]
+	case strings.Contains(value, "/"):
+		return ""
+	default:
+		// A bare version
+		return value
+	}
+}
+
+// EnvService
+func (this *Service) ListEnvs(c Context, domainClass string) ([]Env, error) {
+	glog.Infoln("ListEnvs:", c.UserId(), "DomainClass=", domainClass)
+
+	top, err := this.conn.Get("/")
+	if err != nil {
+		return nil, err
+	}
+	domains, err := this.conn.Children(top.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	envs := map[string]*Env{}
+	suffix := "." + domainClass
+	for _, d := range domains {
+		domain := filepath.Base(d.GetPath())
+		if !strings.HasSuffix(domain, suffix) || len(domain) == len(suffix) {
+			continue
+		}
+		instance := domain[0 : len(domain)-len(suffix)]
+
+		services, err := this.conn.Children(d.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range services {
+			service := filepath.Base(s.GetPath())
+			versions, live, err := this.versions(domain, s)
+			if err != nil {
+				return nil, err
+			}
+			if len(versions) == 0 {
+				continue
+			}
+			env, has := envs[service]
+			if !has {
+				env = &Env{Domain: domainClass, Service: service, Live: map[string]string{}}
+				envs[service] = env
+			}
+			env.Instances = append(env.Instances, instance)
+			env.Versions = append(env.Versions, versions...)
+			if live != "" {
+				env.Live[instance] = live
+			}
+		}
+	}
+
+	names := []string{}
+	for service, _ := range envs {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+
+	result := []Env{}
+	for _, service := range names {
+		env := envs[service]
+		sort.Strings(env.Instances)
+		env.Versions = unique(env.Versions)
+		result = append(result, *env)
+	}
+	return result, nil
+}
+
+// Versions of the service that have an env and the live version, if any.
+func (this *Service) versions(domain string, s *kv.Node) ([]string, string, error) {
+	service := filepath.Base(s.GetPath())
+	children, err := this.conn.Children(s.Path)
+	if err != nil {
+		return nil, "", err
+	}
+	versions := []string{}
+	live := ""
+	for _, v := range children {
+		version := filepath.Base(v.GetPath())
+		switch {
+		case version == live_node:
+			live = live_version(domain, service, v.GetValueString())
+			continue
+		case reserved_nodes[version]:
+			continue
+		}
+		_, err := this.conn.Get(v.GetPath() + "/env")
+		switch {
+		case err == kv.ErrNotExist:
+			continue
+		case err != nil:
+			return nil, "", err
+		}
+		versions = append(versions, version)
+	}
+	return versions, live, nil
+}
+
+func unique(list []string) []string {
+	set := to_set(list)
+	result := []string{}
+	for k, _ := range set {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,18 @@
+package env
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type ListTests struct{}
+
+var _ = Suite(&ListTests{})
+
+func (suite *ListTests) TestLiveVersion(c *C) {
+	c.Assert(live_version("dev.blinker.com", "blinker",
+		"/dev.blinker.com/blinker/v1.0/container/blinker,/dev.blinker.com/blinker/v1.0/env"), Equals, "v1.0")
+	c.Assert(live_version("dev.blinker.com", "blinker", "/dev.blinker.com/blinker/develop/env"), Equals, "develop")
+	c.Assert(live_version("dev.blinker.com", "blinker", "v1.1"), Equals, "v1.1")
+	c.Assert(live_version("dev.blinker.com", "blinker", "/staging.blinker.com/blinker/v1.1/env"), Equals, "")
+	c.Assert(live_version("dev.blinker.com", "blinker", ""), Equals, "")
+}
@@ -0,0 +1,283 @@
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schemas apply to all the instances of a domain class and are kept at
+// /{domain_class}/{service}/env_schema
+func schema_path(domainClass, service string) string {
+	return fmt.Sprintf("/%s/%s/env_schema", domainClass, service)
+}
+
+// The domain of an env is {domain_instance}.{domain_class}
+func domain_class(domain string) string {
+	if dot := strings.Index(domain, "."); dot >= 0 {
+		return domain[dot+1:]
+	}
+	return domain
+}
+
+// Returns nil if the service has no schema
+func (this *Service) schema(domainClass, service string) (*EnvSchema, error) {
+	zn, err := this.conn.Get(schema_path(domainClass, service))
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	schema := new(EnvSchema)
+	if err := json.Unmarshal(zn.GetValue(), schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// EnvService
+func (this *Service) GetEnvSchema(c Context, domainClass, service string) (*EnvSchema, error) {
+	glog.Infoln("GetEnvSchema:", c.UserId(), "DomainClass=", domainClass, "Service=", service)
+	schema, err := this.schema(domainClass, service)
+	switch {
+	case err != nil:
+		return nil, err
+	case schema == nil:
+		return nil, ErrNotFound
+	}
+	return schema, nil
+}
+
+// EnvService
+func (this *Service) SaveEnvSchema(c Context, domainClass, service string, schema *EnvSchema) error {
+	glog.Infoln("SaveEnvSchema:", c.UserId(), "DomainClass=", domainClass, "Service=", service)
+
+	if errs := check_schema(schema); len(errs) > 0 {
+		return &EnvValidationError{Message: "invalid-schema", Errors: errs}
+	}
+	buff, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+	path := schema_path(domainClass, service)
+	zn, err := this.conn.Get(path)
+	switch {
+	case err == kv.ErrNotExist:
+		_, err = this.conn.Create(path, buff)
+		return err
+	case err != nil:
+		return err
+	}
+	_, err = this.conn.Set(path, buff, zn.Version)
+	return err
+}
+
+// EnvService
+func (this *Service) ValidateEnv(c Context, domain, service, version string) (*EnvValidation, error) {
+	glog.Infoln("ValidateEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version)
+
+	schema, err := this.schema(domain_class(domain), service)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := this.resolve(domain, service, version)
+	if err != nil {
+		return nil, err
+	}
+
+	// The env is checked with all its layers
+	list := EnvList{}
+	for k, v := range resolved {
+		value, err := this.decrypt(v.Value)
+		switch {
+		case err == ErrNoSecretKey:
+			// Without the key only the presence of secrets can be checked
+			list[k] = nil
+		case err != nil:
+			return nil, err
+		default:
+			list[k] = value
+		}
+	}
+
+	errs := validate(schema, list, list)
+	return &EnvValidation{Valid: len(errs) == 0, Errors: errs}, nil
+}
+
+// Checks the values of the keys being written, and that the env after the write has all the
+// required keys.  A nil value is not checked.
+func validate(schema *EnvSchema, written, after EnvList) []EnvFieldError {
+	errs := []EnvFieldError{}
+	if schema == nil {
+		return errs
+	}
+	for key, value := range written {
+		ks, has := schema.Keys[key]
+		switch {
+		case !has && schema.Strict:
+			errs = append(errs, EnvFieldError{Key: key, Error: "unknown-key"})
+		case has && value != nil:
+			if e := check_value(ks, fmt.Sprintf("%v", value)); e != "" {
+				errs = append(errs, EnvFieldError{Key: key, Error: e})
+			}
+		}
+	}
+	for key, ks := range schema.Keys {
+		if _, has := after[key]; ks.Required && !has {
+			errs = append(errs, EnvFieldError{Key: key, Error: "required"})
+		}
+	}
+	sort.Sort(by_field(errs))
+	return errs
+}
+
+// Returns the error for the value, or an empty string if it is valid
+func check_value(ks EnvKeySchema, value string) string {
+	switch ks.Type {
+	case EnvTypeInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return "not-an-int"
+		}
+	case EnvTypeFloat:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "not-a-float"
+		}
+	case EnvTypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "not-a-bool"
+		}
+	case EnvTypeUrl:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return "not-a-url"
+		}
+	}
+	if len(ks.Enum) > 0 {
+		found := false
+		for _, e := range ks.Enum {
+			found = found || e == value
+		}
+		if !found {
+			return "not-in-enum"
+		}
+	}
+	if ks.Pattern != "" {
+		if p, err := regexp.Compile("^(?:" + ks.Pattern + ")$"); err != nil || !p.MatchString(value) {
+			return "pattern-mismatch"
+		}
+	}
+	return ""
+}
+
+func check_schema(schema *EnvSchema) []EnvFieldError {
+	errs := []EnvFieldError{}
+	for key, ks := range schema.Keys {
+		switch ks.Type {
+		case "", EnvTypeString, EnvTypeInt, EnvTypeFloat, EnvTypeBool, EnvTypeUrl:
+		default:
+			errs = append(errs, EnvFieldError{Key: key, Error: "bad-type"})
+			continue
+		}
+		if _, err := regexp.Compile("^(?:" + ks.Pattern + ")$"); err != nil {
+			errs = append(errs, EnvFieldError{Key: key, Error: "bad-pattern"})
+			continue
+		}
+		if ks.Default != nil && check_value(ks, *ks.Default) != "" {
+			errs = append(errs, EnvFieldError{Key: key, Error: "bad-default"})
+		}
+	}
+	sort.Sort(by_field(errs))
+	return errs
+}
+
+// Adds the defaults of the keys that are neither in the env nor in the layers below it.  A
+// default must not override a value that is inherited.
+func apply_defaults(schema *EnvSchema, vars, inherited EnvList) {
+	if schema == nil {
+		return
+	}
+	for key, ks := range schema.Keys {
+		_, has := vars[key]
+		_, below := inherited[key]
+		if !has && !below && ks.Default != nil {
+			vars[key] = *ks.Default
+		}
+	}
+}
+
+type by_field []EnvFieldError
+
+func (p by_field) Len() int           { return len(p) }
+func (p by_field) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p by_field) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Checks a new env against the schema after filling in the defaults.  Layers are not checked
+// on their own since the keys of an env can come from any of them.  They are checked as part
+// of the envs of the versions.
+func (this *Service) check_new(domain, service, version string, vars EnvList) error {
+	if version == "" {
+		return nil
+	}
+	schema, err := this.schema(domain_class(domain), service)
+	if err != nil || schema == nil {
+		return err
+	}
+	after, err := this.inherited(domain, service)
+	if err != nil {
+		return err
+	}
+	apply_defaults(schema, vars, after)
+	for k, v := range vars {
+		after[k] = v
+	}
+	if errs := validate(schema, vars, after); len(errs) > 0 {
+		return &EnvValidationError{Message: "invalid-env", Errors: errs}
+	}
+	return nil
+}
+
+// Checks that applying the change to the env at the revision does not break the schema
+func (this *Service) check_change(domain, service, version string, change *EnvChange, rev Revision) error {
+	if version == "" {
+		return nil
+	}
+	schema, err := this.schema(domain_class(domain), service)
+	if err != nil || schema == nil {
+		return err
+	}
+	_, before, err := this.load(env_root(domain, service, version))
+	switch {
+	case err == kv.ErrNotExist:
+		return ErrNotFound
+	case err != nil:
+		return err
+	case calculate_rev(before) != rev:
+		return ErrConflict
+	}
+	after, err := this.inherited(domain, service)
+	if err != nil {
+		return err
+	}
+	for key, value := range before.list() {
+		after[key] = value
+	}
+	for _, key := range change.Delete {
+		if _, has := change.Update[key]; !has {
+			delete(after, key)
+		}
+	}
+	for key, value := range change.Update {
+		after[key] = value
+	}
+	if errs := validate(schema, change.Update, after); len(errs) > 0 {
+		return &EnvValidationError{Message: "invalid-env", Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package env
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type SchemaTests struct{}
+
+var _ = Suite(&SchemaTests{})
+
+func default_value(v string) *string {
+	return &v
+}
+
+var test_schema = &EnvSchema{
+	Strict: true,
+	Keys: map[string]EnvKeySchema{
+		"DATABASE_URL": EnvKeySchema{Required: true, Type: EnvTypeUrl},
+		"POOL_SIZE":    EnvKeySchema{Type: EnvTypeInt, Default: default_value("10")},
+		"LOG_LEVEL":    EnvKeySchema{Enum: []string{"debug", "info", "warn"}},
+		"REGION":       EnvKeySchema{Pattern: "[a-z]+-[a-z]+-[0-9]"},
+		"DEBUG":        EnvKeySchema{Type: EnvTypeBool},
+	},
+}
+
+func (suite *SchemaTests) TestValidate(c *C) {
+	vars := EnvList{
+		"DATABASE_URL": "mysql://localhost:3306/db",
+		"LOG_LEVEL":    "info",
+		"REGION":       "us-west-2",
+	}
+	apply_defaults(test_schema, vars, EnvList{})
+	c.Assert(vars["POOL_SIZE"], Equals, "10")
+
+	inherits := EnvList{}
+	apply_defaults(test_schema, inherits, EnvList{"POOL_SIZE": "20"})
+	c.Assert(inherits, DeepEquals, EnvList{})
+	c.Assert(validate(test_schema, vars, vars), DeepEquals, []EnvFieldError{})
+
+	bad := EnvList{
+		"DATABSE_URL": "mysql://localhost:3306/db",
+		"POOL_SIZE":   "ten",
+		"LOG_LEVEL":   "verbose",
+		"REGION":      "us-west-2a",
+		"DEBUG":       "maybe",
+	}
+	c.Assert(validate(test_schema, bad, bad), DeepEquals, []EnvFieldError{
+		{Key: "DATABASE_URL", Error: "required"},
+		{Key: "DATABSE_URL", Error: "unknown-key"},
+		{Key: "DEBUG", Error: "not-a-bool"},
+		{Key: "LOG_LEVEL", Error: "not-in-enum"},
+		{Key: "POOL_SIZE", Error: "not-an-int"},
+		{Key: "REGION", Error: "pattern-mismatch"},
+	})
+
+	// Nil values are secrets that cannot be read, only their presence is checked
+	secret := EnvList{"DATABASE_URL": nil}
+	c.Assert(validate(test_schema, secret, secret), DeepEquals, []EnvFieldError{})
+
+	c.Assert(validate(nil, bad, bad), DeepEquals, []EnvFieldError{})
+}
+
+func (suite *SchemaTests) TestCheckSchema(c *C) {
+	c.Assert(check_schema(test_schema), DeepEquals, []EnvFieldError{})
+
+	c.Assert(check_schema(&EnvSchema{
+		Keys: map[string]EnvKeySchema{
+			"A": EnvKeySchema{Type: "number"},
+			"B": EnvKeySchema{Pattern: "[a-"},
+			"C": EnvKeySchema{Type: EnvTypeInt, Default: default_value("x")},
+		},
+	}), DeepEquals, []EnvFieldError{
+		{Key: "A", Error: "bad-type"},
+		{Key: "B", Error: "bad-pattern"},
+		{Key: "C", Error: "bad-default"},
+	})
+}
+
+func (suite *SchemaTests) TestDomainClass(c *C) {
+	c.Assert(domain_class("dev.blinker.com"), Equals, "blinker.com")
+	c.Assert(domain_class("local"), Equals, "local")
+}
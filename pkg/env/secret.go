@@ -0,0 +1,184 @@
+package env
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secret values are stored in zk as secret://<base64 of nonce + AES-GCM sealed value>,
+// much like env:// is used for pointers to other keys.
+const (
+	secret_prefix = "secret://"
+)
+
+func is_secret(stored string) bool {
+	return strings.Index(stored, secret_prefix) == 0
+}
+
+// The key is AES-128, 192 or 256 depending on its length.
+func new_cipher(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrBadSecretKey
+	}
+	return cipher.NewGCM(block)
+}
+
+func (this *Service) encrypt(value string) (string, error) {
+	if this.cipher == nil {
+		return "", ErrNoSecretKey
+	}
+	nonce := make([]byte, this.cipher.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := this.cipher.Seal(nonce, nonce, []byte(value), nil)
+	return secret_prefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (this *Service) decrypt(stored string) (string, error) {
+	if !is_secret(stored) {
+		return stored, nil
+	}
+	if this.cipher == nil {
+		return "", ErrNoSecretKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored[len(secret_prefix):])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < this.cipher.NonceSize() {
+		return "", ErrBadSecretKey
+	}
+	nonce := sealed[0:this.cipher.NonceSize()]
+	value, err := this.cipher.Open(nil, nonce, sealed[this.cipher.NonceSize():], nil)
+	if err != nil {
+		return "", ErrBadSecretKey
+	}
+	return string(value), nil
+}
+
+// Returns the value to store.  Values of keys that are marked secret or that are already
+// secret are encrypted.  Values that are already sealed, like secrets promoted from another
+// env, are stored as they are.  The mask is never stored as a secret, so that a masked value
+// that is read and written back cannot replace the secret.
+func (this *Service) seal(key, value string, secret map[string]bool, before leaves) (string, error) {
+	if is_secret(value) {
+		return value, nil
+	}
+	if l, has := before["/"+key]; secret[key] || (has && is_secret(l.value)) {
+		if value == EnvSecretMask {
+			return "", &EnvValidationError{Message: "invalid-env", Errors: []EnvFieldError{
+				{Key: key, Error: "secret-mask"},
+			}}
+		}
+		return this.encrypt(value)
+	}
+	return value, nil
+}
+
+// Plain values may not look like sealed ones, or they would be taken for secrets
+func check_plain(vars EnvList) error {
+	errs := []EnvFieldError{}
+	for k, v := range vars {
+		if is_secret(fmt.Sprintf("%v", v)) {
+			errs = append(errs, EnvFieldError{Key: k, Error: "secret-prefix"})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Sort(by_field(errs))
+	return &EnvValidationError{Message: "invalid-env", Errors: errs}
+}
+
+func mask(stored string) string {
+	if is_secret(stored) {
+		return EnvSecretMask
+	}
+	return stored
+}
+
+func mask_list(list EnvList) EnvList {
+	masked := EnvList{}
+	for k, v := range list {
+		masked[k] = mask(fmt.Sprintf("%v", v))
+	}
+	return masked
+}
+
+func (this *Service) reveal_list(list EnvList) (EnvList, error) {
+	revealed := EnvList{}
+	for k, v := range list {
+		value, err := this.decrypt(fmt.Sprintf("%v", v))
+		if err != nil {
+			return nil, err
+		}
+		revealed[k] = value
+	}
+	return revealed, nil
+}
+
+// Reveals are recorded at /_redpill/env_audit/{domain}/{service}/{version}, which the
+// registry api does not reach, so that the records cannot be changed or removed.
+func audit_root(root string) string {
+	return "/_redpill/env_audit" + filepath.Dir(root)
+}
+
+// EnvService
+func (this *Service) RevealEnv(c Context, domain, service, version string) (EnvList, Revision, error) {
+	root := env_root(domain, service, version)
+	glog.Infoln("RevealEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version)
+
+	_, l, err := this.load(root)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, -1, ErrNotFound
+	case err != nil:
+		return nil, -1, err
+	}
+
+	list := l.list()
+	rev := calculate_rev(l)
+	revealed, err := this.reveal_list(list)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	record := EnvRevealEntry{User: c.UserId(), Timestamp: time.Now().Unix(), Revision: rev, Keys: []string{}}
+	for k, v := range list {
+		if is_secret(fmt.Sprintf("%v", v)) {
+			record.Keys = append(record.Keys, k)
+		}
+	}
+	sort.Strings(record.Keys)
+
+	// Nothing is revealed unless the audit record is written
+	if err := this.ensure(audit_root(root)); err != nil {
+		return nil, -1, err
+	}
+	buff, err := json.Marshal(record)
+	if err != nil {
+		return nil, -1, err
+	}
+	if _, err := this.conn.Multi(kv.OpCreateSequential(audit_root(root)+"/reveal-", buff)); err != nil {
+		return nil, -1, err
+	}
+	glog.Infoln("Revealed secrets:", c.UserId(), "Root=", root, "Keys=", record.Keys)
+	return revealed, rev, nil
+}
@@ -0,0 +1,77 @@
+package env
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type SecretTests struct{}
+
+var _ = Suite(&SecretTests{})
+
+func (suite *SecretTests) TestEncryptDecrypt(c *C) {
+	cipher, err := new_cipher([]byte("0123456789abcdef0123456789abcdef"))
+	c.Assert(err, Equals, nil)
+	s := &Service{cipher: cipher}
+
+	stored, err := s.encrypt("hunter2")
+	c.Assert(err, Equals, nil)
+	c.Assert(is_secret(stored), Equals, true)
+	c.Assert(stored, Not(Equals), "secret://hunter2")
+
+	value, err := s.decrypt(stored)
+	c.Assert(err, Equals, nil)
+	c.Assert(value, Equals, "hunter2")
+
+	// Plain values pass through
+	value, err = s.decrypt("plain")
+	c.Assert(err, Equals, nil)
+	c.Assert(value, Equals, "plain")
+
+	c.Assert(mask_list(EnvList{"A": stored, "B": "b"}), DeepEquals, EnvList{"A": EnvSecretMask, "B": "b"})
+}
+
+func (suite *SecretTests) TestSealKeepsSecretsSecret(c *C) {
+	cipher, err := new_cipher([]byte("0123456789abcdef"))
+	c.Assert(err, Equals, nil)
+	s := &Service{cipher: cipher}
+
+	stored, err := s.seal("PASSWORD", "p1", map[string]bool{"PASSWORD": true}, leaves{})
+	c.Assert(err, Equals, nil)
+	c.Assert(is_secret(stored), Equals, true)
+
+	// Not marked but already secret
+	stored, err = s.seal("PASSWORD", "p2", map[string]bool{}, leaves{"/PASSWORD": leaf{value: stored}})
+	c.Assert(err, Equals, nil)
+	c.Assert(is_secret(stored), Equals, true)
+
+	stored, err = s.seal("HOST", "localhost", map[string]bool{}, leaves{})
+	c.Assert(err, Equals, nil)
+	c.Assert(stored, Equals, "localhost")
+
+	// The mask does not replace a secret
+	_, err = s.seal("PASSWORD", EnvSecretMask, map[string]bool{}, leaves{"/PASSWORD": leaf{value: "secret://abc"}})
+	c.Assert(err, DeepEquals, &EnvValidationError{Message: "invalid-env", Errors: []EnvFieldError{
+		{Key: "PASSWORD", Error: "secret-mask"},
+	}})
+	_, err = s.seal("TOKEN", EnvSecretMask, map[string]bool{"TOKEN": true}, leaves{})
+	c.Assert(err, FitsTypeOf, &EnvValidationError{})
+}
+
+func (suite *SecretTests) TestNoKey(c *C) {
+	s := &Service{}
+	_, err := s.seal("PASSWORD", "p1", map[string]bool{"PASSWORD": true}, leaves{})
+	c.Assert(err, Equals, ErrNoSecretKey)
+
+	_, err = new_cipher([]byte("short"))
+	c.Assert(err, Equals, ErrBadSecretKey)
+}
+
+func (suite *SecretTests) TestCheckPlain(c *C) {
+	c.Assert(check_plain(EnvList{"A": "a", "B": 1}), Equals, nil)
+	err := check_plain(EnvList{"A": "secret://abc", "B": "b"})
+	c.Assert(err, DeepEquals, &EnvValidationError{Message: "invalid-env", Errors: []EnvFieldError{
+		{Key: "A", Error: "secret-prefix"},
+	}})
+	c.Assert(audit_root("/dev.blinker.com/blinker/v1/env"), Equals, "/_redpill/env_audit/dev.blinker.com/blinker/v1")
+}
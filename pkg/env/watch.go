@@ -0,0 +1,133 @@
+package env
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"path/filepath"
+	"sort"
+)
+
+// The changes that turn before into after, in key order
+func changes(before, after leaves, rev Revision) []EnvChangeEvent {
+	events := []EnvChangeEvent{}
+	for k, l := range after {
+		old, has := before[k]
+		switch {
+		case !has:
+			events = append(events, EnvChangeEvent{Key: filepath.Base(k), Action: EnvKeyAdd, Value: mask(l.value), Revision: rev})
+		case old.value != l.value || old.version != l.version:
+			events = append(events, EnvChangeEvent{Key: filepath.Base(k), Action: EnvKeyUpdate, Value: mask(l.value), Revision: rev})
+		}
+	}
+	for k, _ := range before {
+		if _, has := after[k]; !has {
+			events = append(events, EnvChangeEvent{Key: filepath.Base(k), Action: EnvKeyDelete, Revision: rev})
+		}
+	}
+	sort.Sort(by_event_key(events))
+	return events
+}
+
+type by_event_key []EnvChangeEvent
+
+func (p by_event_key) Len() int           { return len(p) }
+func (p by_event_key) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p by_event_key) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Sets the watches on the node at path and on every node below it, unless they are still set,
+// and adds the nodes to seen.  The exists watch fires when the node is created, changed or
+// deleted and the children watch when a child is added or removed.  They are set before the
+// nodes are read, so a change made while we read fires them and is not lost.
+func (this *Service) watch_nodes(path string, watches *kv.Watches, seen map[string]bool) error {
+	seen[path] = true
+	if err := watches.Watch(path); err != nil {
+		return err
+	}
+	err := watches.WatchChildren(path)
+	switch {
+	case err == kv.ErrNotExist:
+		// Not there, or deleted since.  The exists watch fires when that changes.
+		return nil
+	case err != nil:
+		return err
+	}
+
+	children, err := this.conn.Children(path)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil
+	case err != nil:
+		return err
+	}
+	for _, child := range children {
+		if err := this.watch_nodes(child.GetPath(), watches, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnvService
+//
+// Commits through the env api set the data of the env root, but keys can also be written
+// directly, through the registry api or by agents.  So the root, its children and every key
+// are watched.  Watches fire only once: each time one fires it is set again, the watches of
+// keys that are gone are stopped and the env is read again to find what changed.  The channel
+// is closed when stop is closed or sent to.
+func (this *Service) WatchEnv(c Context, domain, service, version string, stop <-chan bool) (<-chan EnvChangeEvent, error) {
+	root := env_root(domain, service, version)
+	glog.Infoln("WatchEnv:", c.UserId(), "Domain=", domain, "Service=", service, "Version=", version)
+
+	_, before, err := this.load(root)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	events := make(chan EnvChangeEvent)
+	go this.watch(root, before, events, stop)
+	return events, nil
+}
+
+func (this *Service) watch(root string, before leaves, events chan<- EnvChangeEvent, stop <-chan bool) {
+	defer close(events)
+	watches := kv.NewWatches(this.conn)
+	defer watches.Close()
+	for {
+		seen := map[string]bool{}
+		if err := this.watch_nodes(root, watches, seen); err != nil {
+			glog.Warningln("Cannot watch", root, "Err=", err)
+			return
+		}
+		watches.Keep(seen)
+
+		_, after, err := this.load(root)
+		switch {
+		case err == kv.ErrNotExist:
+			// Deleted.  Keep watching in case it is created again.
+			after = leaves{}
+		case err != nil:
+			glog.Warningln("Cannot load", root, "Err=", err)
+			return
+		}
+
+		for _, event := range changes(before, after, calculate_rev(after)) {
+			select {
+			case events <- event:
+			case <-stop:
+				return
+			}
+		}
+		before = after
+
+		select {
+		case <-watches.Fired():
+		case <-stop:
+			glog.Infoln("Stopped watching", root)
+			return
+		}
+	}
+}
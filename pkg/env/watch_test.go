@@ -0,0 +1,29 @@
+package env
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type WatchTests struct{}
+
+var _ = Suite(&WatchTests{})
+
+func (suite *WatchTests) TestChanges(c *C) {
+	before := leaves{
+		"/A": leaf{value: "a", version: 0},
+		"/B": leaf{value: "b", version: 0},
+		"/C": leaf{value: "secret://xxx", version: 0},
+	}
+	after := leaves{
+		"/A": leaf{value: "a", version: 0},
+		"/C": leaf{value: "secret://yyy", version: 1},
+		"/D": leaf{value: "d", version: 0},
+	}
+	c.Assert(changes(before, after, 7), DeepEquals, []EnvChangeEvent{
+		{Key: "B", Action: EnvKeyDelete, Revision: 7},
+		{Key: "C", Action: EnvKeyUpdate, Value: EnvSecretMask, Revision: 7},
+		{Key: "D", Action: EnvKeyAdd, Value: "d", Revision: 7},
+	})
+	c.Assert(changes(after, after, 7), DeepEquals, []EnvChangeEvent{})
+}
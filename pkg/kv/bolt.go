@@ -0,0 +1,475 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrBadPath         = errors.New("kv-bad-path")
+	ErrEphemeralParent = errors.New("kv-ephemeral-parent")
+)
+
+const bolt_bucket = "kv"
+
+// What is kept for each node, keyed by its path
+type bolt_record struct {
+	Value       []byte `json:"value"`
+	Version     int32  `json:"version"`
+	Cversion    int32  `json:"cversion"`
+	NumChildren int32  `json:"num_children"`
+	Owner       int64  `json:"owner,omitempty"`
+}
+
+// The db and the watches are shared by all the sessions
+type bolt_db struct {
+	db       *bolt.DB
+	lock     sync.Mutex
+	watches  map[string][]chan bool
+	sessions int64
+}
+
+type bolt_store struct {
+	shared  *bolt_db
+	session int64
+	root    bool
+}
+
+// A store in a BoltDB file, for a single server.  Watches only see the changes made through
+// the stores of this process.  Sessions end when the process does, so the ephemeral nodes
+// left in the file are removed when it is opened.
+func OpenBoltStore(file string) (Store, error) {
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bolt_bucket))
+		if err != nil {
+			return err
+		}
+		t := &bolt_tx{b: b}
+		_, err = t.get("/")
+		switch {
+		case err == ErrNotExist:
+			return t.put("/", &bolt_record{})
+		case err != nil:
+			return err
+		}
+		return t.delete_ephemerals(-1)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	shared := &bolt_db{db: db, watches: map[string][]chan bool{}}
+	return &bolt_store{shared: shared, session: shared.next_session(), root: true}, nil
+}
+
+func (this *bolt_db) next_session() int64 {
+	return atomic.AddInt64(&this.sessions, 1)
+}
+
+func exists_watch(path string) string {
+	return "e:" + path
+}
+
+func children_watch(path string) string {
+	return "c:" + path
+}
+
+func (this *bolt_db) watch(key string, f func()) chan<- bool {
+	fire := make(chan bool, 1)
+	stop := make(chan bool, 1)
+
+	this.lock.Lock()
+	this.watches[key] = append(this.watches[key], fire)
+	this.lock.Unlock()
+
+	go func() {
+		select {
+		case <-fire:
+			// Stopped before it fired
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			f()
+		case <-stop:
+			this.unwatch(key, fire)
+		}
+	}()
+	return stop
+}
+
+func (this *bolt_db) unwatch(key string, fire chan bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	list := this.watches[key]
+	for i, w := range list {
+		if w == fire {
+			this.watches[key] = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(this.watches[key]) == 0 {
+		delete(this.watches, key)
+	}
+}
+
+// Fires the watches, each only once
+func (this *bolt_db) notify(keys []string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, key := range keys {
+		for _, fire := range this.watches[key] {
+			fire <- true
+		}
+		delete(this.watches, key)
+	}
+}
+
+// Runs f in a read write transaction and fires the watches of what changed once committed
+func (this *bolt_store) update(f func(t *bolt_tx) error) error {
+	t := &bolt_tx{}
+	err := this.shared.db.Update(func(tx *bolt.Tx) error {
+		t.b = tx.Bucket([]byte(bolt_bucket))
+		return f(t)
+	})
+	if err != nil {
+		return err
+	}
+	this.shared.notify(t.events)
+	return nil
+}
+
+func (this *bolt_store) view(f func(t *bolt_tx) error) error {
+	return this.shared.db.View(func(tx *bolt.Tx) error {
+		return f(&bolt_tx{b: tx.Bucket([]byte(bolt_bucket))})
+	})
+}
+
+func (this *bolt_store) Get(path string) (n *Node, err error) {
+	err = this.view(func(t *bolt_tx) error {
+		n, err = t.node(path)
+		return err
+	})
+	return
+}
+
+func (this *bolt_store) Children(path string) (nodes []*Node, err error) {
+	err = this.view(func(t *bolt_tx) error {
+		nodes, err = t.children(path)
+		return err
+	})
+	return
+}
+
+func (this *bolt_store) Create(path string, value []byte) (n *Node, err error) {
+	err = this.update(func(t *bolt_tx) error {
+		if err := check_path(path); err != nil {
+			return err
+		}
+		parent := ""
+		for _, p := range strings.Split(strings.Trim(filepath.Dir(path), "/"), "/") {
+			if p == "" {
+				continue
+			}
+			parent = parent + "/" + p
+			_, err := t.get(parent)
+			switch {
+			case err == ErrNotExist:
+				if _, err := t.create(parent, []byte{}, 0, false); err != nil {
+					return err
+				}
+			case err != nil:
+				return err
+			}
+		}
+		if _, err := t.create(path, value, 0, false); err != nil {
+			return err
+		}
+		n, err = t.node(path)
+		return err
+	})
+	return
+}
+
+func (this *bolt_store) Set(path string, value []byte, version int32) (n *Node, err error) {
+	err = this.update(func(t *bolt_tx) error {
+		if err := t.set(path, value, version); err != nil {
+			return err
+		}
+		n, err = t.node(path)
+		return err
+	})
+	return
+}
+
+func (this *bolt_store) Delete(path string, version int32) error {
+	return this.update(func(t *bolt_tx) error {
+		return t.delete(path, version)
+	})
+}
+
+func (this *bolt_store) Multi(ops ...Op) (created []string, err error) {
+	err = this.update(func(t *bolt_tx) error {
+		created = make([]string, len(ops))
+		for i, op := range ops {
+			var err error
+			switch op.kind {
+			case op_create:
+				owner := int64(0)
+				if op.ephemeral {
+					owner = this.session
+				}
+				created[i], err = t.create(op.path, op.value, owner, op.sequential)
+			case op_set:
+				err = t.set(op.path, op.value, op.version)
+			case op_delete:
+				err = t.delete(op.path, op.version)
+			case op_check:
+				err = t.check(op.path, op.version)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (this *bolt_store) Watch(path string, f func()) (chan<- bool, error) {
+	return this.shared.watch(exists_watch(path), f), nil
+}
+
+func (this *bolt_store) WatchChildren(path string, f func()) (chan<- bool, error) {
+	// Set before the node is checked so a delete in between is not missed
+	stop := this.shared.watch(children_watch(path), f)
+	if _, err := this.Get(path); err != nil {
+		stop <- true
+		return nil, err
+	}
+	return stop, nil
+}
+
+func (this *bolt_store) Session() (Store, error) {
+	return &bolt_store{shared: this.shared, session: this.shared.next_session()}, nil
+}
+
+func (this *bolt_store) Close() error {
+	err := this.update(func(t *bolt_tx) error {
+		return t.delete_ephemerals(this.session)
+	})
+	if err != nil {
+		return err
+	}
+	if this.root {
+		return this.shared.db.Close()
+	}
+	return nil
+}
+
+// A read or read write transaction.  Events are the watches to fire after the commit.
+type bolt_tx struct {
+	b      *bolt.Bucket
+	events []string
+}
+
+func check_path(path string) error {
+	if !strings.HasPrefix(path, "/") || filepath.Clean(path) != path {
+		return ErrBadPath
+	}
+	return nil
+}
+
+func (this *bolt_tx) get(path string) (*bolt_record, error) {
+	if err := check_path(path); err != nil {
+		return nil, err
+	}
+	v := this.b.Get([]byte(path))
+	if v == nil {
+		return nil, ErrNotExist
+	}
+	r := new(bolt_record)
+	if err := json.Unmarshal(v, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (this *bolt_tx) put(path string, r *bolt_record) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return this.b.Put([]byte(path), v)
+}
+
+func (this *bolt_tx) node(path string) (*Node, error) {
+	r, err := this.get(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		Path:        path,
+		Value:       r.Value,
+		Version:     r.Version,
+		Cversion:    r.Cversion,
+		NumChildren: r.NumChildren,
+		Owner:       r.Owner,
+	}, nil
+}
+
+func (this *bolt_tx) children(path string) ([]*Node, error) {
+	if _, err := this.get(path); err != nil {
+		return nil, err
+	}
+	prefix := path + "/"
+	if path == "/" {
+		prefix = "/"
+	}
+	nodes := []*Node{}
+	c := this.b.Cursor()
+	for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+		name := string(k)[len(prefix):]
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		n, err := this.node(string(k))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func check_version(r *bolt_record, version int32) error {
+	if version != -1 && r.Version != version {
+		return ErrBadVersion
+	}
+	return nil
+}
+
+// Returns the path of the node, which for sequential nodes has the sequence number
+// appended.  Like ZK the number is the cversion of the parent.
+func (this *bolt_tx) create(path string, value []byte, owner int64, sequential bool) (string, error) {
+	if err := check_path(path); err != nil || path == "/" {
+		return "", ErrBadPath
+	}
+	parent := filepath.Dir(path)
+	pr, err := this.get(parent)
+	if err != nil {
+		return "", err
+	}
+	if pr.Owner != 0 {
+		return "", ErrEphemeralParent
+	}
+	if sequential {
+		path = fmt.Sprintf("%s%010d", path, pr.Cversion)
+	}
+	if _, err := this.get(path); err == nil {
+		return "", ErrNodeExists
+	} else if err != ErrNotExist {
+		return "", err
+	}
+	if err := this.put(path, &bolt_record{Value: value, Owner: owner}); err != nil {
+		return "", err
+	}
+	pr.Cversion++
+	pr.NumChildren++
+	if err := this.put(parent, pr); err != nil {
+		return "", err
+	}
+	this.events = append(this.events, exists_watch(path), children_watch(parent))
+	return path, nil
+}
+
+func (this *bolt_tx) set(path string, value []byte, version int32) error {
+	r, err := this.get(path)
+	if err != nil {
+		return err
+	}
+	if err := check_version(r, version); err != nil {
+		return err
+	}
+	r.Value = value
+	r.Version++
+	this.events = append(this.events, exists_watch(path))
+	return this.put(path, r)
+}
+
+func (this *bolt_tx) delete(path string, version int32) error {
+	r, err := this.get(path)
+	if err != nil {
+		return err
+	}
+	if err := check_version(r, version); err != nil {
+		return err
+	}
+	if r.NumChildren > 0 {
+		return ErrNotEmpty
+	}
+	if path == "/" {
+		return ErrBadPath
+	}
+	if err := this.b.Delete([]byte(path)); err != nil {
+		return err
+	}
+	parent := filepath.Dir(path)
+	pr, err := this.get(parent)
+	if err != nil {
+		return err
+	}
+	pr.Cversion++
+	pr.NumChildren--
+	if err := this.put(parent, pr); err != nil {
+		return err
+	}
+	this.events = append(this.events, exists_watch(path), children_watch(path), children_watch(parent))
+	return nil
+}
+
+func (this *bolt_tx) check(path string, version int32) error {
+	r, err := this.get(path)
+	if err != nil {
+		return err
+	}
+	return check_version(r, version)
+}
+
+// Deletes the ephemeral nodes of the session, or of all sessions if session is -1
+func (this *bolt_tx) delete_ephemerals(session int64) error {
+	paths := []string{}
+	err := this.b.ForEach(func(k, v []byte) error {
+		r := new(bolt_record)
+		if err := json.Unmarshal(v, r); err != nil {
+			return err
+		}
+		if r.Owner != 0 && (session == -1 || r.Owner == session) {
+			paths = append(paths, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := this.delete(path, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package kv
+
+import (
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestKv(t *testing.T) { TestingT(t) }
+
+type BoltTests struct {
+	file  string
+	store Store
+}
+
+var _ = Suite(&BoltTests{})
+
+func (suite *BoltTests) SetUpTest(c *C) {
+	suite.file = filepath.Join(c.MkDir(), "kv.db")
+	store, err := OpenBoltStore(suite.file)
+	c.Assert(err, Equals, nil)
+	suite.store = store
+}
+
+func (suite *BoltTests) TearDownTest(c *C) {
+	suite.store.Close()
+}
+
+func paths(nodes []*Node) []string {
+	list := []string{}
+	for _, n := range nodes {
+		list = append(list, n.Path)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func fired(c *C, ch <-chan bool) {
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		c.Fatal("Watch did not fire")
+	}
+}
+
+func (suite *BoltTests) TestCreateSetDelete(c *C) {
+	s := suite.store
+
+	n, err := s.Create("/a/b/c", []byte("c"))
+	c.Assert(err, Equals, nil)
+	c.Assert(n.Version, Equals, int32(0))
+
+	a, err := s.Get("/a")
+	c.Assert(err, Equals, nil)
+	c.Assert(a.NumChildren, Equals, int32(1))
+	c.Assert(a.Cversion, Equals, int32(1))
+
+	_, err = s.Create("/a/b/c", []byte("c"))
+	c.Assert(err, Equals, ErrNodeExists)
+	_, err = s.Get("/a/x")
+	c.Assert(err, Equals, ErrNotExist)
+	_, err = s.Get("a/b/")
+	c.Assert(err, Equals, ErrBadPath)
+
+	n, err = s.Set("/a/b/c", []byte("c2"), 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(n.Version, Equals, int32(1))
+	c.Assert(n.GetValueString(), Equals, "c2")
+	_, err = s.Set("/a/b/c", []byte("c3"), 0)
+	c.Assert(err, Equals, ErrBadVersion)
+
+	c.Assert(s.Delete("/a/b", -1), Equals, ErrNotEmpty)
+	c.Assert(s.Delete("/a/b/c", 0), Equals, ErrBadVersion)
+	c.Assert(s.Delete("/a/b/c", 1), Equals, nil)
+
+	b, err := s.Get("/a/b")
+	c.Assert(err, Equals, nil)
+	c.Assert(b.NumChildren, Equals, int32(0))
+	c.Assert(b.Cversion, Equals, int32(2))
+}
+
+func (suite *BoltTests) TestChildrenAndWalk(c *C) {
+	s := suite.store
+	for _, p := range []string{"/a/b", "/a/b-1", "/a/b/c", "/a/b/c/d", "/ab"} {
+		_, err := s.Create(p, []byte(p))
+		c.Assert(err, Equals, nil)
+	}
+
+	children, err := s.Children("/a")
+	c.Assert(err, Equals, nil)
+	c.Assert(paths(children), DeepEquals, []string{"/a/b", "/a/b-1"})
+
+	top, err := s.Children("/")
+	c.Assert(err, Equals, nil)
+	c.Assert(paths(top), DeepEquals, []string{"/a", "/ab"})
+
+	all, err := Walk(s, "/a", nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(paths(all), DeepEquals, []string{"/a/b", "/a/b-1", "/a/b/c", "/a/b/c/d"})
+
+	leaves, err := Walk(s, "/a", func(n *Node) bool { return n.IsLeaf() })
+	c.Assert(err, Equals, nil)
+	c.Assert(paths(leaves), DeepEquals, []string{"/a/b-1", "/a/b/c/d"})
+
+	_, err = s.Children("/x")
+	c.Assert(err, Equals, ErrNotExist)
+}
+
+func (suite *BoltTests) TestMulti(c *C) {
+	s := suite.store
+	_, err := s.Create("/q", nil)
+	c.Assert(err, Equals, nil)
+
+	created, err := s.Multi(
+		OpCreateSequential("/q/item-", []byte("1")),
+		OpCreateSequential("/q/item-", []byte("2")),
+		OpCreate("/q/x", nil),
+	)
+	c.Assert(err, Equals, nil)
+	c.Assert(created, DeepEquals, []string{"/q/item-0000000000", "/q/item-0000000001", "/q/x"})
+
+	// All or nothing
+	_, err = s.Multi(OpSet("/q/x", []byte("x"), 0), OpCheck("/q/item-0000000000", 5))
+	c.Assert(err, Equals, ErrBadVersion)
+	x, err := s.Get("/q/x")
+	c.Assert(err, Equals, nil)
+	c.Assert(x.Version, Equals, int32(0))
+
+	_, err = s.Multi(OpDelete("/q/x", 0), OpCreate("/q/x/y", nil))
+	c.Assert(err, Equals, ErrNotExist)
+	_, err = s.Get("/q/x")
+	c.Assert(err, Equals, nil)
+}
+
+// Each operation that fails makes the multi fail with why, and nothing is changed
+func multi_errors(c *C, s Store, root string) {
+	_, err := s.Create(root+"/x/y", []byte("y"))
+	c.Assert(err, Equals, nil)
+
+	for _, t := range []struct {
+		ops []Op
+		op  int
+		err error
+	}{
+		{[]Op{OpSet(root+"/x", []byte("x"), 0), OpSet(root+"/x/y", []byte("y"), 3)}, 1, ErrBadVersion},
+		{[]Op{OpCheck(root+"/x", 1)}, 0, ErrBadVersion},
+		{[]Op{OpCreate(root+"/z", nil), OpCreate(root+"/z", nil)}, 1, ErrNodeExists},
+		{[]Op{OpCreate(root+"/none/z", nil)}, 0, ErrNotExist},
+		{[]Op{OpDelete(root+"/x/y", 0), OpSet(root+"/x/y", nil, -1)}, 1, ErrNotExist},
+		{[]Op{OpDelete(root+"/x", -1)}, 0, ErrNotEmpty},
+	} {
+		op, err := FailedOp(s, t.ops...)
+		c.Assert(err, Equals, t.err)
+		c.Assert(op, Equals, t.op)
+
+		_, err = s.Multi(t.ops...)
+		c.Assert(err, Equals, t.err)
+	}
+
+	op, err := FailedOp(s, OpSet(root+"/x", nil, -1), OpDelete(root+"/x/y", 0), OpDelete(root+"/x", 1))
+	c.Assert(err, Equals, nil)
+	c.Assert(op, Equals, -1)
+
+	x, err := s.Get(root + "/x")
+	c.Assert(err, Equals, nil)
+	c.Assert(x.Version, Equals, int32(0))
+	_, err = s.Get(root + "/z")
+	c.Assert(err, Equals, ErrNotExist)
+}
+
+func (suite *BoltTests) TestMultiErrors(c *C) {
+	multi_errors(c, suite.store, "/multi")
+}
+
+// Only the watches that fired are set again, and those of nodes no longer wanted are stopped
+func watches_kept(c *C, s Store, root string) {
+	_, err := s.Create(root+"/a", []byte("a"))
+	c.Assert(err, Equals, nil)
+	_, err = s.Create(root+"/b", []byte("b"))
+	c.Assert(err, Equals, nil)
+
+	w := NewWatches(s)
+	all := map[string]bool{root: true, root + "/a": true, root + "/b": true}
+	set := func() {
+		for path, _ := range all {
+			c.Assert(w.Watch(path), Equals, nil)
+			c.Assert(w.WatchChildren(path), Equals, nil)
+		}
+	}
+	set()
+	stops := map[string]*armed{}
+	for k, a := range w.armed {
+		stops[k] = a
+	}
+	for i := 0; i < 3; i++ {
+		_, err = s.Set(root+"/a", []byte("a"), -1)
+		c.Assert(err, Equals, nil)
+		fired(c, w.Fired())
+		set()
+	}
+	c.Assert(len(w.armed), Equals, 6)
+	for k, a := range w.armed {
+		if k == "e:"+root+"/a" {
+			c.Assert(a, Not(Equals), stops[k])
+		} else {
+			c.Assert(a, Equals, stops[k])
+		}
+	}
+
+	w.Keep(map[string]bool{root: true, root + "/a": true})
+	c.Assert(len(w.armed), Equals, 4)
+	w.Close()
+	c.Assert(len(w.armed), Equals, 0)
+}
+
+func (suite *BoltTests) TestWatchesKept(c *C) {
+	watches_kept(c, suite.store, "/watches")
+}
+
+func (suite *BoltTests) TestWatches(c *C) {
+	s := suite.store
+
+	created := make(chan bool, 1)
+	_, err := s.Watch("/w", func() { created <- true })
+	c.Assert(err, Equals, nil)
+	_, err = s.Create("/w", nil)
+	c.Assert(err, Equals, nil)
+	fired(c, created)
+
+	child := make(chan bool, 1)
+	_, err = s.WatchChildren("/w", func() { child <- true })
+	c.Assert(err, Equals, nil)
+	changed := make(chan bool, 1)
+	_, err = s.Watch("/w", func() { changed <- true })
+	c.Assert(err, Equals, nil)
+
+	_, err = s.Create("/w/a", nil)
+	c.Assert(err, Equals, nil)
+	fired(c, child)
+	_, err = s.Set("/w", []byte("v"), -1)
+	c.Assert(err, Equals, nil)
+	fired(c, changed)
+
+	// Stopped watches do not fire
+	stopped := make(chan bool, 1)
+	stop, err := s.Watch("/w", func() { stopped <- true })
+	c.Assert(err, Equals, nil)
+	stop <- true
+	_, err = s.Set("/w", []byte("v2"), -1)
+	c.Assert(err, Equals, nil)
+	select {
+	case <-stopped:
+		c.Fatal("Stopped watch fired")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = s.WatchChildren("/none", func() {})
+	c.Assert(err, Equals, ErrNotExist)
+}
+
+func (suite *BoltTests) TestEphemeral(c *C) {
+	session, err := suite.store.Session()
+	c.Assert(err, Equals, nil)
+
+	_, err = suite.store.Create("/live", nil)
+	c.Assert(err, Equals, nil)
+	created, err := session.Multi(OpCreateEphemeralSequential("/live/member-", []byte("m")))
+	c.Assert(err, Equals, nil)
+
+	n, err := suite.store.Get(created[0])
+	c.Assert(err, Equals, nil)
+	c.Assert(n.Owner, Not(Equals), int64(0))
+
+	_, err = suite.store.Multi(OpCreate(created[0]+"/child", nil))
+	c.Assert(err, Equals, ErrEphemeralParent)
+
+	deleted := make(chan bool, 1)
+	_, err = suite.store.Watch(created[0], func() { deleted <- true })
+	c.Assert(err, Equals, nil)
+
+	c.Assert(session.Close(), Equals, nil)
+	fired(c, deleted)
+	_, err = suite.store.Get(created[0])
+	c.Assert(err, Equals, ErrNotExist)
+}
+
+func (suite *BoltTests) TestReopen(c *C) {
+	session, err := suite.store.Session()
+	c.Assert(err, Equals, nil)
+	_, err = session.Multi(OpCreateEphemeral("/e", nil))
+	c.Assert(err, Equals, nil)
+	_, err = suite.store.Create("/p", []byte("p"))
+	c.Assert(err, Equals, nil)
+
+	// Bolt holds a lock on the file so only close the db, not the session
+	c.Assert(suite.store.(*bolt_store).shared.db.Close(), Equals, nil)
+
+	store, err := OpenBoltStore(suite.file)
+	c.Assert(err, Equals, nil)
+	suite.store = store
+
+	p, err := store.Get("/p")
+	c.Assert(err, Equals, nil)
+	c.Assert(p.GetValueString(), Equals, "p")
+
+	// Sessions do not outlive the process
+	_, err = store.Get("/e")
+	c.Assert(err, Equals, ErrNotExist)
+}
+
+func (suite *BoltTests) TestJoin(c *C) {
+	c.Assert(Join("/", "a"), Equals, "/a")
+	c.Assert(Join("/a", "b"), Equals, "/a/b")
+}
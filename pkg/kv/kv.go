@@ -0,0 +1,225 @@
+// Package kv is the hierarchical key value store that the services keep their data in.  It
+// has the semantics of ZooKeeper: nodes have values and children, each set of the value bumps
+// its version and each child added or removed bumps the cversion of the parent.  Ephemeral
+// nodes go away with the session that created them.
+package kv
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+var (
+	ErrNotExist   = errors.New("kv-not-exist")
+	ErrNodeExists = errors.New("kv-node-exists")
+	ErrBadVersion = errors.New("kv-bad-version")
+	ErrNotEmpty   = errors.New("kv-not-empty")
+
+	ErrTooManySessions = errors.New("kv-too-many-sessions")
+)
+
+type Node struct {
+	Path        string
+	Value       []byte
+	Version     int32
+	Cversion    int32
+	NumChildren int32
+
+	// Session of an ephemeral node, zero for persistent nodes
+	Owner int64
+}
+
+func (this *Node) GetPath() string {
+	return this.Path
+}
+
+func (this *Node) GetBasename() string {
+	return filepath.Base(this.Path)
+}
+
+func (this *Node) GetValue() []byte {
+	return this.Value
+}
+
+func (this *Node) GetValueString() string {
+	return string(this.Value)
+}
+
+func (this *Node) IsLeaf() bool {
+	return this.NumChildren == 0
+}
+
+type Store interface {
+	Get(path string) (*Node, error)
+	// The children of the node, in no particular order
+	Children(path string) ([]*Node, error)
+	// Creates the node and any missing parents
+	Create(path string, value []byte) (*Node, error)
+	// Sets the value if the version matches.  A version of -1 matches any version.
+	Set(path string, value []byte, version int32) (*Node, error)
+	// Deletes the node if the version matches.  A version of -1 matches any version.
+	Delete(path string, version int32) error
+
+	// Executes all the operations or none of them.  Parents of created nodes are not created.
+	// Returns the paths of the nodes created, in the order of the operations, and empty
+	// strings for the other operations.
+	Multi(ops ...Op) ([]string, error)
+
+	// Calls f once, when the node is created, changed or deleted.  Send to or close the
+	// returned channel to stop watching.
+	Watch(path string, f func()) (chan<- bool, error)
+	// Calls f once, when a child is added or removed or the node is deleted.
+	WatchChildren(path string, f func()) (chan<- bool, error)
+
+	// A new session on the same store.  The ephemeral nodes created in the session are
+	// removed when it is closed.  Returns ErrTooManySessions if the store allows no more.
+	Session() (Store, error)
+	Close() error
+}
+
+const (
+	op_create = iota
+	op_set
+	op_delete
+	op_check
+)
+
+// An operation in a multi.  Use OpCreate, OpSet, OpDelete and OpCheck to construct.
+type Op struct {
+	kind       int
+	path       string
+	value      []byte
+	version    int32
+	ephemeral  bool
+	sequential bool
+}
+
+func OpCreate(path string, value []byte) Op {
+	return Op{kind: op_create, path: path, value: value}
+}
+
+// The name of the node is suffixed with a sequence number assigned by the store.
+func OpCreateSequential(path string, value []byte) Op {
+	return Op{kind: op_create, path: path, value: value, sequential: true}
+}
+
+// The node is removed when the session that created it ends.
+func OpCreateEphemeral(path string, value []byte) Op {
+	return Op{kind: op_create, path: path, value: value, ephemeral: true}
+}
+
+func OpCreateEphemeralSequential(path string, value []byte) Op {
+	return Op{kind: op_create, path: path, value: value, ephemeral: true, sequential: true}
+}
+
+func OpSet(path string, value []byte, version int32) Op {
+	return Op{kind: op_set, path: path, value: value, version: version}
+}
+
+func OpDelete(path string, version int32) Op {
+	return Op{kind: op_delete, path: path, version: version}
+}
+
+func OpCheck(path string, version int32) Op {
+	return Op{kind: op_check, path: path, version: version}
+}
+
+// Visits all the nodes under the path, depth first, and returns the ones accepted.  A nil
+// accept accepts all.
+func Walk(store Store, path string, accept func(*Node) bool) ([]*Node, error) {
+	children, err := store.Children(path)
+	if err != nil {
+		return nil, err
+	}
+	list := []*Node{}
+	for _, n := range children {
+		l, err := Walk(store, n.Path, accept)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, l...)
+		if accept == nil || accept(n) {
+			list = append(list, n)
+		}
+	}
+	return list, nil
+}
+
+// The path of the child
+func Join(path, child string) string {
+	if path == "/" {
+		return "/" + child
+	}
+	return path + "/" + child
+}
+
+// What the operations of a multi see of a node as they are applied in order
+type op_node struct {
+	exists   bool
+	version  int32
+	children int32
+}
+
+// Applies the operations in turn to what is in the store now, without changing it.  Returns
+// the index of the first that fails and why, or -1 and nil if none of them does.
+func FailedOp(store Store, ops ...Op) (int, error) {
+	nodes := map[string]*op_node{}
+	get := func(path string) (*op_node, error) {
+		if n, has := nodes[path]; has {
+			return n, nil
+		}
+		n := &op_node{}
+		zn, err := store.Get(path)
+		switch {
+		case err == ErrNotExist:
+		case err != nil:
+			return nil, err
+		default:
+			n.exists, n.version, n.children = true, zn.Version, zn.NumChildren
+		}
+		nodes[path] = n
+		return n, nil
+	}
+	for i, op := range ops {
+		n, err := get(op.path)
+		if err != nil {
+			return -1, err
+		}
+		parent, err := get(filepath.Dir(op.path))
+		if err != nil {
+			return -1, err
+		}
+		if op.kind == op_create {
+			switch {
+			case !parent.exists:
+				return i, ErrNotExist
+			case op.sequential:
+				// The name is not known until it is created
+				parent.children++
+			case n.exists:
+				return i, ErrNodeExists
+			default:
+				*n = op_node{exists: true}
+				parent.children++
+			}
+			continue
+		}
+		switch {
+		case !n.exists:
+			return i, ErrNotExist
+		case op.version != -1 && n.version != op.version:
+			return i, ErrBadVersion
+		}
+		switch op.kind {
+		case op_set:
+			n.version++
+		case op_delete:
+			if n.children > 0 {
+				return i, ErrNotEmpty
+			}
+			n.exists = false
+			parent.children--
+		}
+	}
+	return -1, nil
+}
@@ -0,0 +1,99 @@
+package kv
+
+import (
+	"sync"
+)
+
+// A watch that is set and has not fired
+type armed struct {
+	path string
+	stop chan<- bool
+}
+
+// Watches on a set of nodes, each kept set until the node is no longer wanted.  Watches fire
+// only once, and only the ones that fired are set again, so that there is never more than
+// one of each kind on a node however often they fire.
+type Watches struct {
+	store Store
+	fired chan bool
+
+	lock  sync.Mutex
+	armed map[string]*armed
+}
+
+func NewWatches(store Store) *Watches {
+	return &Watches{store: store, fired: make(chan bool, 1), armed: map[string]*armed{}}
+}
+
+// Receives once any of the watches has fired since the last receive
+func (this *Watches) Fired() <-chan bool {
+	return this.fired
+}
+
+// Sets the exists watch on the node unless it is still set
+func (this *Watches) Watch(path string) error {
+	return this.set("e:"+path, path, this.store.Watch)
+}
+
+// Sets the children watch on the node unless it is still set
+func (this *Watches) WatchChildren(path string) error {
+	return this.set("c:"+path, path, this.store.WatchChildren)
+}
+
+func (this *Watches) set(key, path string, watch func(string, func()) (chan<- bool, error)) error {
+	this.lock.Lock()
+	if _, has := this.armed[key]; has {
+		this.lock.Unlock()
+		return nil
+	}
+	a := &armed{path: path}
+	this.armed[key] = a
+	this.lock.Unlock()
+
+	stop, err := watch(path, func() {
+		this.lock.Lock()
+		if this.armed[key] == a {
+			delete(this.armed, key)
+		}
+		this.lock.Unlock()
+		select {
+		case this.fired <- true:
+		default:
+		}
+	})
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if err != nil {
+		if this.armed[key] == a {
+			delete(this.armed, key)
+		}
+		return err
+	}
+	a.stop = stop
+	return nil
+}
+
+func stop_watch(stop chan<- bool) {
+	select {
+	case stop <- true:
+	default:
+	}
+}
+
+// Stops the watches on the nodes that are not in paths
+func (this *Watches) Keep(paths map[string]bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for key, a := range this.armed {
+		if !paths[a.path] {
+			stop_watch(a.stop)
+			delete(this.armed, key)
+		}
+	}
+}
+
+// Stops all the watches
+func (this *Watches) Close() {
+	this.Keep(map[string]bool{})
+}
@@ -0,0 +1,283 @@
+package kv
+
+import (
+	"github.com/golang/glog"
+	"github.com/samuel/go-zookeeper/zk"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many sessions a store can have open besides its own.  Each is a connection to ZooKeeper
+// with its own heartbeat, and ZooKeeper limits the connections from a host (maxClientCnxns,
+// 60 by default), so they are not to be opened freely.
+var ZkMaxSessions = 50
+
+type zk_store struct {
+	servers []string
+	timeout time.Duration
+	conn    *zk.Conn
+
+	lock    sync.Mutex
+	watches map[string]*zk_watchers
+
+	// How many sessions are open, shared by the store and the sessions opened from it
+	sessions *int32
+	session  bool
+	closed   int32
+}
+
+var zk_acl = zk.WorldACL(zk.PermAll)
+
+func zk_connect(servers []string, timeout time.Duration) (*zk_store, error) {
+	conn, _, err := zk.Connect(servers, timeout)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infoln("Connected to zk:", servers)
+	return &zk_store{servers: servers, timeout: timeout, conn: conn, watches: map[string]*zk_watchers{}}, nil
+}
+
+// A store in ZooKeeper.  Each session is a connection of its own, and at most ZkMaxSessions
+// of them can be open at once.
+func NewZkStore(servers []string, timeout time.Duration) (Store, error) {
+	s, err := zk_connect(servers, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.sessions = new(int32)
+	return s, nil
+}
+
+func zk_err(err error) error {
+	switch err {
+	case zk.ErrNoNode:
+		return ErrNotExist
+	case zk.ErrNodeExists:
+		return ErrNodeExists
+	case zk.ErrBadVersion:
+		return ErrBadVersion
+	case zk.ErrNotEmpty:
+		return ErrNotEmpty
+	default:
+		return err
+	}
+}
+
+func zk_node(path string, value []byte, stat *zk.Stat) *Node {
+	n := &Node{Path: path, Value: value}
+	if stat != nil {
+		n.Version = stat.Version
+		n.Cversion = stat.Cversion
+		n.NumChildren = stat.NumChildren
+		n.Owner = stat.EphemeralOwner
+	}
+	return n
+}
+
+func (this *zk_store) Get(path string) (*Node, error) {
+	value, stat, err := this.conn.Get(path)
+	if err != nil {
+		return nil, zk_err(err)
+	}
+	return zk_node(path, value, stat), nil
+}
+
+func (this *zk_store) Children(path string) ([]*Node, error) {
+	names, _, err := this.conn.Children(path)
+	if err != nil {
+		return nil, zk_err(err)
+	}
+	nodes := []*Node{}
+	for _, name := range names {
+		n, err := this.Get(Join(path, name))
+		switch {
+		case err == ErrNotExist:
+			// Deleted since we listed it
+			continue
+		case err != nil:
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (this *zk_store) Create(path string, value []byte) (*Node, error) {
+	parent := ""
+	for _, p := range strings.Split(strings.Trim(filepath.Dir(path), "/"), "/") {
+		if p == "" {
+			continue
+		}
+		parent = parent + "/" + p
+		_, err := this.conn.Create(parent, []byte{}, 0, zk_acl)
+		if err != nil && err != zk.ErrNodeExists {
+			return nil, zk_err(err)
+		}
+	}
+	if _, err := this.conn.Create(path, value, 0, zk_acl); err != nil {
+		return nil, zk_err(err)
+	}
+	return this.Get(path)
+}
+
+func (this *zk_store) Set(path string, value []byte, version int32) (*Node, error) {
+	stat, err := this.conn.Set(path, value, version)
+	if err != nil {
+		return nil, zk_err(err)
+	}
+	return zk_node(path, value, stat), nil
+}
+
+func (this *zk_store) Delete(path string, version int32) error {
+	return zk_err(this.conn.Delete(path, version))
+}
+
+func zk_op(op Op) interface{} {
+	switch op.kind {
+	case op_create:
+		flags := int32(0)
+		if op.ephemeral {
+			flags |= zk.FlagEphemeral
+		}
+		if op.sequential {
+			flags |= zk.FlagSequence
+		}
+		return &zk.CreateRequest{Path: op.path, Data: op.value, Acl: zk_acl, Flags: flags}
+	case op_set:
+		return &zk.SetDataRequest{Path: op.path, Data: op.value, Version: op.version}
+	case op_delete:
+		return &zk.DeleteRequest{Path: op.path, Version: op.version}
+	default:
+		return &zk.CheckVersionRequest{Path: op.path, Version: op.version}
+	}
+}
+
+func (this *zk_store) Multi(ops ...Op) ([]string, error) {
+	requests := make([]interface{}, len(ops))
+	for i, op := range ops {
+		requests[i] = zk_op(op)
+	}
+	results, err := this.conn.Multi(requests...)
+	switch {
+	case err == zk.ErrAPIError:
+		// The client cannot read the error of the operation that failed, so it is found by
+		// applying the operations again to what is there now.
+		if i, failed := FailedOp(this, ops...); i >= 0 {
+			return nil, failed
+		}
+		glog.Warningln("Multi failed but its operations apply now. Ops=", len(ops))
+		return nil, ErrBadVersion
+	case err != nil:
+		return nil, zk_err(err)
+	}
+	created := make([]string, len(ops))
+	for i, op := range ops {
+		if op.kind == op_create && i < len(results) {
+			created[i] = results[i].String
+		}
+	}
+	return created, nil
+}
+
+// The callers waiting on one watch of the connection.  The client keeps a watch until it
+// fires, so the callers share one watch per node rather than each setting another.
+type zk_watchers struct {
+	next  int
+	funcs map[int]func()
+	done  chan bool
+}
+
+func exists_key(path string) string {
+	return "e:" + path
+}
+
+func children_key(path string) string {
+	return "c:" + path
+}
+
+// Calls f when the watch fires, unless stopped first.  The watch is set with set unless the
+// connection already has it.
+func (this *zk_store) watch(key string, set func() (<-chan zk.Event, error), f func()) (chan<- bool, error) {
+	this.lock.Lock()
+	w, has := this.watches[key]
+	if !has {
+		events, err := set()
+		if err != nil {
+			this.lock.Unlock()
+			return nil, zk_err(err)
+		}
+		w = &zk_watchers{funcs: map[int]func(){}, done: make(chan bool)}
+		this.watches[key] = w
+		go func() {
+			<-events
+			this.lock.Lock()
+			delete(this.watches, key)
+			funcs := w.funcs
+			w.funcs = map[int]func(){}
+			close(w.done)
+			this.lock.Unlock()
+			for _, f := range funcs {
+				f()
+			}
+		}()
+	}
+	id := w.next
+	w.next++
+	w.funcs[id] = f
+	this.lock.Unlock()
+
+	stop := make(chan bool, 1)
+	go func() {
+		select {
+		case <-stop:
+			this.lock.Lock()
+			delete(w.funcs, id)
+			this.lock.Unlock()
+		case <-w.done:
+		}
+	}()
+	return stop, nil
+}
+
+func (this *zk_store) Watch(path string, f func()) (chan<- bool, error) {
+	return this.watch(exists_key(path), func() (<-chan zk.Event, error) {
+		_, _, events, err := this.conn.ExistsW(path)
+		return events, err
+	}, f)
+}
+
+func (this *zk_store) WatchChildren(path string, f func()) (chan<- bool, error) {
+	return this.watch(children_key(path), func() (<-chan zk.Event, error) {
+		_, _, events, err := this.conn.ChildrenW(path)
+		return events, err
+	}, f)
+}
+
+// Returns ErrTooManySessions if ZkMaxSessions are open already
+func (this *zk_store) Session() (Store, error) {
+	if atomic.AddInt32(this.sessions, 1) > int32(ZkMaxSessions) {
+		atomic.AddInt32(this.sessions, -1)
+		return nil, ErrTooManySessions
+	}
+	s, err := zk_connect(this.servers, this.timeout)
+	if err != nil {
+		atomic.AddInt32(this.sessions, -1)
+		return nil, err
+	}
+	s.sessions, s.session = this.sessions, true
+	return s, nil
+}
+
+func (this *zk_store) Close() error {
+	if !atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		return nil
+	}
+	this.conn.Close()
+	if this.session {
+		atomic.AddInt32(this.sessions, -1)
+	}
+	return nil
+}
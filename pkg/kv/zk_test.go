@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"fmt"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ZkTests struct {
+	store Store
+	root  string
+}
+
+var _ = Suite(&ZkTests{})
+
+func (suite *ZkTests) SetUpSuite(c *C) {
+	c.Log("Connecting to zk")
+	store, err := NewZkStore([]string{"localhost:2181"}, 5*time.Second)
+	c.Assert(err, Equals, nil)
+	suite.store = store
+	suite.root = fmt.Sprintf("/unit-test/kv/%d", time.Now().UnixNano())
+}
+
+func (suite *ZkTests) TearDownSuite(c *C) {
+	suite.store.Close()
+}
+
+func (suite *ZkTests) TestMultiErrors(c *C) {
+	multi_errors(c, suite.store, suite.root+"/multi")
+}
+
+func (suite *ZkTests) TestWatchesKept(c *C) {
+	root := suite.root + "/watches"
+	watches_kept(c, suite.store, root)
+
+	// The connection keeps one watch of each kind on a node however many wait on it
+	s := suite.store.(*zk_store)
+	first, second := NewWatches(s), NewWatches(s)
+	for _, w := range []*Watches{first, second, first} {
+		c.Assert(w.Watch(root+"/b"), Equals, nil)
+		c.Assert(w.WatchChildren(root+"/b"), Equals, nil)
+	}
+	s.lock.Lock()
+	c.Assert(len(s.watches[exists_key(root+"/b")].funcs), Equals, 2)
+	c.Assert(len(s.watches[children_key(root+"/b")].funcs), Equals, 2)
+	s.lock.Unlock()
+
+	_, err := s.Set(root+"/b", []byte("b"), -1)
+	c.Assert(err, Equals, nil)
+	fired(c, first.Fired())
+	fired(c, second.Fired())
+	s.lock.Lock()
+	_, has := s.watches[exists_key(root+"/b")]
+	s.lock.Unlock()
+	c.Assert(has, Equals, false)
+	first.Close()
+	second.Close()
+}
+
+func (suite *ZkTests) TestMaxSessions(c *C) {
+	max := ZkMaxSessions
+	defer func() { ZkMaxSessions = max }()
+	ZkMaxSessions = 2
+
+	first, err := suite.store.Session()
+	c.Assert(err, Equals, nil)
+	second, err := first.Session()
+	c.Assert(err, Equals, nil)
+	_, err = suite.store.Session()
+	c.Assert(err, Equals, ErrTooManySessions)
+
+	// Closing twice frees one
+	c.Assert(first.Close(), Equals, nil)
+	c.Assert(first.Close(), Equals, nil)
+	third, err := suite.store.Session()
+	c.Assert(err, Equals, nil)
+	_, err = suite.store.Session()
+	c.Assert(err, Equals, ErrTooManySessions)
+	second.Close()
+	third.Close()
+}
@@ -40,6 +40,10 @@ func (c *context) UserId() string {
 	return c.userId()
 }
 
+func (c *context) Groups() []string {
+	return nil
+}
+
 func (c *context) UrlParameter(k string) string {
 	return c.urlParameter(k)
 }
@@ -109,3 +109,11 @@ func (this orchestrate_instances) Get(id string) (*Instance, error) {
 func (this orchestrate_instances) List(domain, orchestration string) ([]Instance, error) {
 	return load_instances_for_domain_orchestration(boltdb, domain, orchestration)
 }
+
+func (this orchestrate_instances) ListClass(domainClass, orchestration string) ([]Instance, error) {
+	return load_instances_for_class_orchestration(boltdb, domainClass, orchestration)
+}
+
+func (this orchestrate_instances) ListAll() ([]Instance, error) {
+	return load_all_instances(boltdb)
+}
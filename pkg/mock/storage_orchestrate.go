@@ -7,6 +7,7 @@ import (
 	"github.com/golang/glog"
 	. "github.com/infradash/redpill/pkg/orchestrate"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -195,3 +196,51 @@ func load_instances_for_domain_orchestration(boltdb *bolt.DB, domain, orchestrat
 	})
 	return result, err
 }
+
+// The domains of the class each have a bucket of their own
+func load_instances_for_class_orchestration(boltdb *bolt.DB, domainClass, orchestration string) ([]Instance, error) {
+	domains := []string{}
+	err := boltdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbBucketOrchestrateInstancesByDomain))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil && strings.HasSuffix(string(k), "."+domainClass) {
+				domains = append(domains, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := []Instance{}
+	for _, domain := range domains {
+		list, err := load_instances_for_domain_orchestration(boltdb, domain, orchestration)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, list...)
+	}
+	return result, nil
+}
+
+func load_all_instances(boltdb *bolt.DB) ([]Instance, error) {
+	result := []Instance{}
+	err := boltdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(dbBucketOrchestrateInstancesById))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			m := &Instance{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return err
+			}
+			result = append(result, *m)
+			return nil
+		})
+	})
+	return result, err
+}
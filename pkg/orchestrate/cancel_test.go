@@ -0,0 +1,177 @@
+package orchestrate
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/task"
+	. "gopkg.in/check.v1"
+	"strings"
+	"time"
+)
+
+type CancelTests struct {
+	storage *memory_storage
+	service *Service
+	c       Context
+}
+
+var _ = Suite(&CancelTests{})
+
+func (suite *CancelTests) SetUpTest(c *C) {
+	suite.storage = new_memory_storage()
+	suite.service = NewService(nil,
+		func() ModelStorage { return suite.storage },
+		func() InstanceStorage { return memory_instances{suite.storage} },
+		pubsub.Broker("kfka://localhost:9092"), "").(*Service)
+	suite.service.local = local_executor{grace: 100 * time.Millisecond}
+	suite.c = test_context("test")
+}
+
+func (suite *CancelTests) start(c *C, script string) OrchestrationInstance {
+	m := &Model{}
+	m.Name = "script"
+	m.Cmd = &task.Cmd{Path: "/bin/sh", Args: []string{"-c", script}}
+	suite.storage.Save("test.com", m)
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "script", nil)
+	c.Assert(err, Equals, nil)
+	return instance
+}
+
+// Waits for the instance to get to the status, or to have exited when status is ""
+func wait_for(c *C, service OrchestrateService, id, status string) OrchestrationInfo {
+	for i := 0; i < 500; i++ {
+		instance, err := service.GetOrchestration(test_context("test"), "", "", id)
+		c.Assert(err, Equals, nil)
+		info := instance.Info()
+		if (status != "" && info.Status == status) || (status == "" && info.ExitCode != 0) {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("Instance did not get to:", id, status)
+	return OrchestrationInfo{}
+}
+
+func (suite *CancelTests) TestCancel(c *C) {
+	instance := suite.start(c, "echo started; sleep 30")
+	id := instance.Info().Id
+	wait_for(c, suite.service, id, OrchestrationRunning)
+	// Running before the script has printed anything
+	for i := 0; i < 500 && !strings.HasPrefix(test_pubsub.get(*instance.Log()), "started\n"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	begin := time.Now()
+	cancelled, err := suite.service.CancelOrchestration(suite.c, "integration.test.com", "script", id)
+	c.Assert(err, Equals, nil)
+	c.Assert(cancelled.Info().Status, Equals, OrchestrationCancelled)
+	c.Assert(cancelled.Info().CompletionTime.IsZero(), Equals, false)
+	history := cancelled.Info().History
+	c.Assert(history[len(history)-1].From, Equals, OrchestrationRunning)
+	c.Assert(history[len(history)-1].To, Equals, OrchestrationCancelled)
+	c.Assert(history[len(history)-1].User, Equals, "test")
+
+	// Stopped by the signal, and how it exited is kept
+	info := wait_for(c, suite.service, id, "")
+	c.Assert(time.Since(begin) < 5*time.Second, Equals, true)
+	c.Assert(info.Status, Equals, OrchestrationCancelled)
+	c.Assert(info.ExitCode, Equals, -1)
+	c.Assert(info.Error, Equals, "")
+	c.Assert(len(info.History), Equals, 3)
+
+	output := test_pubsub.get(*instance.Log())
+	c.Assert(strings.HasPrefix(output, "started\n"), Equals, true)
+	c.Assert(strings.Contains(output, "Cancelled by test\n"), Equals, true)
+	c.Assert(len(suite.service.running), Equals, 0)
+}
+
+func (suite *CancelTests) TestKill(c *C) {
+	instance := suite.start(c, "trap '' TERM; sleep 30")
+	id := instance.Info().Id
+	wait_for(c, suite.service, id, OrchestrationRunning)
+	time.Sleep(50 * time.Millisecond)
+
+	begin := time.Now()
+	_, err := suite.service.CancelOrchestration(suite.c, "integration.test.com", "script", id)
+	c.Assert(err, Equals, nil)
+
+	info := wait_for(c, suite.service, id, "")
+	c.Assert(time.Since(begin) >= 100*time.Millisecond, Equals, true)
+	c.Assert(time.Since(begin) < 5*time.Second, Equals, true)
+	c.Assert(info.Status, Equals, OrchestrationCancelled)
+}
+
+func (suite *CancelTests) TestCannotCancel(c *C) {
+	instance := suite.start(c, "exit 0")
+	id := instance.Info().Id
+	wait(c, suite.service, id)
+
+	_, err := suite.service.CancelOrchestration(suite.c, "integration.test.com", "script", id)
+	c.Assert(err, Equals, ErrBadTransition)
+
+	_, err = suite.service.CancelOrchestration(suite.c, "production.test.com", "script", id)
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = suite.service.CancelOrchestration(suite.c, "integration.test.com", "other", id)
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = suite.service.CancelOrchestration(suite.c, "integration.test.com", "script", "no-such-instance")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (suite *CancelTests) TestTimeout(c *C) {
+	m := &Model{Timeout: "100ms"}
+	m.Name = "slow"
+	m.Cmd = &task.Cmd{Path: "/bin/sh", Args: []string{"-c", "sleep 30"}}
+	c.Assert(suite.service.SaveOrchestrationModel(suite.c, "test.com", m), Equals, nil)
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "slow", nil)
+	c.Assert(err, Equals, nil)
+	id := instance.Info().Id
+
+	begin := time.Now()
+	info := wait_for(c, suite.service, id, "")
+	c.Assert(time.Since(begin) < 5*time.Second, Equals, true)
+	c.Assert(info.Status, Equals, OrchestrationTimedOut)
+	c.Assert(info.ExitCode, Equals, -1)
+	c.Assert(info.History[len(info.History)-1].From, Equals, OrchestrationRunning)
+	c.Assert(strings.Contains(test_pubsub.get(*instance.Log()), "Timed out after 100ms\n"), Equals, true)
+	c.Assert(len(suite.service.running), Equals, 0)
+
+	m.Timeout = "soon"
+	c.Assert(suite.service.SaveOrchestrationModel(suite.c, "test.com", m), Equals, ErrBadTimeout)
+	m.Timeout = "-1s"
+	c.Assert(suite.service.SaveOrchestrationModel(suite.c, "test.com", m), Equals, ErrBadTimeout)
+}
+
+func (suite *CancelTests) TestInterrupted(c *C) {
+	m := &Model{}
+	m.Name = "script"
+	for _, status := range []string{OrchestrationPending, OrchestrationRunning, OrchestrationSucceeded} {
+		instance := m.NewInstance("integration.test.com")
+		record(&instance.InstanceInfo, OrchestrationPending, "test", time.Now())
+		if status != OrchestrationPending {
+			record(&instance.InstanceInfo, OrchestrationRunning, "", time.Now())
+		}
+		if status == OrchestrationSucceeded {
+			record(&instance.InstanceInfo, OrchestrationSucceeded, "", time.Now())
+		}
+		suite.storage.instances[instance.InstanceInfo.Id] = *instance
+	}
+
+	// Restarted
+	NewService(nil,
+		func() ModelStorage { return suite.storage },
+		func() InstanceStorage { return memory_instances{suite.storage} },
+		pubsub.Broker("kfka://localhost:9092"), "")
+
+	failed := 0
+	for _, instance := range suite.storage.instances {
+		switch instance.InstanceInfo.Status {
+		case OrchestrationFailed:
+			failed++
+			c.Assert(instance.InstanceInfo.Error, Equals, ErrInterrupted.Error())
+			c.Assert(instance.InstanceInfo.CompletionTime.IsZero(), Equals, false)
+		default:
+			c.Assert(instance.InstanceInfo.Status, Equals, OrchestrationSucceeded)
+		}
+	}
+	c.Assert(failed, Equals, 2)
+}
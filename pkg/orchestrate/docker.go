@@ -0,0 +1,118 @@
+package orchestrate
+
+import (
+	_docker "github.com/fsouza/go-dockerclient"
+	"github.com/golang/glog"
+	"io"
+	"time"
+)
+
+// Runs the docker section of the model as a container on the docker endpoint.  The name of
+// the container and the entries of its Env and Cmd are templates.  The image is pulled if the
+// docker host does not have it.  The container is removed once it exits.  Stopping it gives
+// the container the grace period to exit before it is killed.
+type docker_executor struct {
+	endpoint string
+	grace    time.Duration
+}
+
+func (this docker_executor) create(client *_docker.Client, opts _docker.CreateContainerOptions) (*_docker.Container, error) {
+	container, err := client.CreateContainer(opts)
+	if err != _docker.ErrNoSuchImage {
+		return container, err
+	}
+	glog.Infoln("Pulling Image=", opts.Config.Image)
+	repository, tag := _docker.ParseRepositoryTag(opts.Config.Image)
+	err = client.PullImage(_docker.PullImageOptions{Repository: repository, Tag: tag}, _docker.AuthConfiguration{})
+	if err != nil {
+		return nil, err
+	}
+	return client.CreateContainer(opts)
+}
+
+func (this docker_executor) Execute(instance *Instance, log io.Writer, stop <-chan bool) (int, error) {
+	control := instance.InstanceModel.Docker
+	if control.Config == nil || control.Image == "" {
+		return -1, ErrNoImage
+	}
+	data := instance.template_data()
+	config := *control.Config
+	name, err := render(control.ContainerName, data)
+	if err != nil {
+		return -1, err
+	}
+	if config.Env, err = render_all(config.Env, data); err != nil {
+		return -1, err
+	}
+	if config.Cmd, err = render_all(config.Cmd, data); err != nil {
+		return -1, err
+	}
+	config.AttachStdout, config.AttachStderr = true, true
+
+	client, err := _docker.NewClient(this.endpoint)
+	if err != nil {
+		return -1, err
+	}
+	container, err := this.create(client, _docker.CreateContainerOptions{
+		Name:       name,
+		Config:     &config,
+		HostConfig: control.HostConfig,
+	})
+	if err != nil {
+		return -1, err
+	}
+	glog.Infoln("Instance=", instance.InstanceInfo.Id, "Container=", container.ID, "Name=", name)
+	defer func() {
+		err := client.RemoveContainer(_docker.RemoveContainerOptions{ID: container.ID, RemoveVolumes: true, Force: true})
+		if err != nil {
+			glog.Warningln("Instance=", instance.InstanceInfo.Id, "Container=", container.ID, "Err=", err)
+		}
+	}()
+
+	// Attached before it starts so that none of the output is missed
+	attached := make(chan error, 1)
+	success := make(chan struct{})
+	go func() {
+		attached <- client.AttachToContainer(_docker.AttachToContainerOptions{
+			Container:    container.ID,
+			OutputStream: log,
+			ErrorStream:  log,
+			Logs:         true,
+			Stream:       true,
+			Stdout:       true,
+			Stderr:       true,
+			RawTerminal:  config.Tty,
+			Success:      success,
+		})
+	}()
+	select {
+	case <-success:
+		success <- struct{}{}
+	case err := <-attached:
+		return -1, err
+	}
+
+	if err := client.StartContainer(container.ID, control.HostConfig); err != nil {
+		return -1, err
+	}
+	exited := make(chan bool)
+	defer close(exited)
+	go func() {
+		select {
+		case <-exited:
+		case <-stop:
+			err := client.StopContainer(container.ID, uint(this.grace.Seconds()))
+			if err != nil {
+				glog.Warningln("Instance=", instance.InstanceInfo.Id, "Container=", container.ID, "Err=", err)
+			}
+		}
+	}()
+	code, err := client.WaitContainer(container.ID)
+	if err != nil {
+		return -1, err
+	}
+	if err := <-attached; err != nil {
+		glog.Warningln("Instance=", instance.InstanceInfo.Id, "Container=", container.ID, "Err=", err)
+	}
+	return code, nil
+}
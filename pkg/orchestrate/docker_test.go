@@ -0,0 +1,165 @@
+package orchestrate
+
+import (
+	_docker "github.com/fsouza/go-dockerclient"
+	dockertest "github.com/fsouza/go-dockerclient/testing"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/maestro/pkg/docker"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/task"
+	. "gopkg.in/check.v1"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DockerTests struct {
+	storage *memory_storage
+	service OrchestrateService
+	c       Context
+	server  *dockertest.DockerServer
+	created chan *_docker.Container
+}
+
+var _ = Suite(&DockerTests{})
+
+// The containers of the fake docker server run until they are changed to not be running.
+// Those started with an EXIT_CODE in their env exit with it as soon as they start.
+func (suite *DockerTests) SetUpTest(c *C) {
+	suite.storage = new_memory_storage()
+	suite.c = test_context("test")
+
+	containers := make(chan *_docker.Container, 16)
+	server, err := dockertest.NewServer("127.0.0.1:0", containers, nil)
+	c.Assert(err, Equals, nil)
+	suite.server = server
+	suite.created = make(chan *_docker.Container, 16)
+	go func() {
+		for container := range containers {
+			if !container.State.Running {
+				suite.created <- container
+				continue
+			}
+			for _, env := range container.Config.Env {
+				if strings.HasPrefix(env, "EXIT_CODE=") {
+					code, _ := strconv.Atoi(env[len("EXIT_CODE="):])
+					server.MutateContainer(container.ID, _docker.State{ExitCode: code})
+				}
+			}
+		}
+	}()
+
+	suite.service = NewService(nil,
+		func() ModelStorage { return suite.storage },
+		func() InstanceStorage { return memory_instances{suite.storage} },
+		pubsub.Broker("kfka://localhost:9092"), server.URL())
+}
+
+func (suite *DockerTests) TearDownTest(c *C) {
+	suite.server.Stop()
+}
+
+func (suite *DockerTests) docker_model(name string, control *docker.ContainerControl, context OrchestrationContext) {
+	m := &Model{DefaultContext: context, Docker: control}
+	m.Name = task.TaskName(name)
+	suite.storage.Save("test.com", m)
+}
+
+func (suite *DockerTests) TestRunContainer(c *C) {
+	suite.docker_model("build", &docker.ContainerControl{
+		Config: &_docker.Config{
+			Image: "infradash/builder:1",
+			Env:   []string{"GIT_BRANCH={{.Context.branch}}", "DOMAIN={{.Domain}}", "EXIT_CODE=2"},
+			Cmd:   []string{"build", "{{.Context.tag}}"},
+		},
+		ContainerName: "{{.Name}}-{{.Context.tag}}",
+	}, OrchestrationContext{"branch": "develop", "tag": "v1"})
+
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "build",
+		OrchestrationContext{"tag": "v2"})
+	c.Assert(err, Equals, nil)
+
+	info := wait(c, suite.service, instance.Info().Id)
+	c.Assert(info.Error, Equals, "")
+	c.Assert(info.Status, Equals, OrchestrationFailed)
+	c.Assert(info.ExitCode, Equals, 2)
+
+	created := <-suite.created
+	c.Assert(created.Name, Equals, "build-v2")
+	c.Assert(created.Image, Equals, "infradash/builder:1")
+	c.Assert(created.Config.Env, DeepEquals,
+		[]string{"GIT_BRANCH=develop", "DOMAIN=integration.test.com", "EXIT_CODE=2"})
+	c.Assert(created.Config.Cmd, DeepEquals, []string{"build", "v2"})
+
+	// What the fake server gives for the output of any container
+	c.Assert(strings.Contains(test_pubsub.get(*instance.Log()), "Something happened\n"), Equals, true)
+
+	// Removed once it exited
+	client, err := _docker.NewClient(suite.server.URL())
+	c.Assert(err, Equals, nil)
+	list, err := client.ListContainers(_docker.ListContainersOptions{All: true})
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list), Equals, 0)
+}
+
+func (suite *DockerTests) TestSucceeded(c *C) {
+	suite.docker_model("migrate", &docker.ContainerControl{
+		Config: &_docker.Config{Image: "infradash/migrate", Env: []string{"EXIT_CODE=0"}},
+	}, nil)
+
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "migrate", nil)
+	c.Assert(err, Equals, nil)
+
+	info := wait(c, suite.service, instance.Info().Id)
+	c.Assert(info.Error, Equals, "")
+	c.Assert(info.Status, Equals, OrchestrationSucceeded)
+	c.Assert(info.ExitCode, Equals, 0)
+}
+
+func (suite *DockerTests) TestBadTemplate(c *C) {
+	suite.docker_model("bad", &docker.ContainerControl{
+		Config:        &_docker.Config{Image: "infradash/migrate"},
+		ContainerName: "{{.Name",
+	}, nil)
+	suite.docker_model("noimage", &docker.ContainerControl{Config: &_docker.Config{}}, nil)
+
+	for _, name := range []string{"bad", "noimage"} {
+		instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", name, nil)
+		c.Assert(err, Equals, nil)
+
+		info := wait(c, suite.service, instance.Info().Id)
+		c.Assert(info.Status, Equals, OrchestrationFailed)
+		c.Assert(info.Error, Not(Equals), "")
+	}
+}
+
+func (suite *DockerTests) TestCancel(c *C) {
+	suite.docker_model("serve", &docker.ContainerControl{
+		Config: &_docker.Config{Image: "infradash/server"},
+	}, nil)
+
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "serve", nil)
+	c.Assert(err, Equals, nil)
+	id := instance.Info().Id
+	wait_for(c, suite.service, id, OrchestrationRunning)
+
+	cancelled, err := suite.service.CancelOrchestration(suite.c, "integration.test.com", "serve", id)
+	c.Assert(err, Equals, nil)
+	c.Assert(cancelled.Info().Status, Equals, OrchestrationCancelled)
+
+	// Stopped and removed
+	client, err := _docker.NewClient(suite.server.URL())
+	c.Assert(err, Equals, nil)
+	for i := 0; i < 500; i++ {
+		list, err := client.ListContainers(_docker.ListContainersOptions{All: true})
+		c.Assert(err, Equals, nil)
+		if len(list) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	list, err := client.ListContainers(_docker.ListContainersOptions{All: true})
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list), Equals, 0)
+	c.Assert(len(suite.service.(*Service).running), Equals, 0)
+}
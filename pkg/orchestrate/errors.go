@@ -6,4 +6,7 @@ import (
 
 var (
 	ErrTypeMismatch = errors.New("type-mismatch")
+	ErrNoCmd        = errors.New("no-cmd")
+	ErrNoImage      = errors.New("no-image")
+	ErrInterrupted  = errors.New("interrupted")
 )
@@ -0,0 +1,161 @@
+package orchestrate
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"io"
+	"text/template"
+	"time"
+)
+
+// Runs an orchestration instance to completion, writing its output to the log.  Returns the exit
+// code of what it ran.  Closing stop asks what it runs to exit, and kills it if it has not
+// exited after a grace period.
+type Executor interface {
+	Execute(instance *Instance, log io.Writer, stop <-chan bool) (int, error)
+}
+
+// What the templates of a model are rendered against: the default context of the model
+// merged with the context the orchestration was started with, as .Context, and the domain,
+// name and id of the instance.
+func (this *Instance) template_data() map[string]interface{} {
+	context := map[string]interface{}{}
+	for k, v := range this.InstanceModel.DefaultContext {
+		context[k] = v
+	}
+	for k, v := range this.InstanceContext {
+		context[k] = v
+	}
+	return map[string]interface{}{
+		"Context": context,
+		"Domain":  this.InstanceInfo.Domain,
+		"Name":    this.InstanceInfo.Name,
+		"Id":      this.InstanceInfo.Id,
+	}
+}
+
+func render(s string, data map[string]interface{}) (string, error) {
+	t, err := template.New(s).Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var buff bytes.Buffer
+	if err := t.Execute(&buff, data); err != nil {
+		return "", err
+	}
+	return buff.String(), nil
+}
+
+func render_all(list []string, data map[string]interface{}) ([]string, error) {
+	rendered := make([]string, len(list))
+	for i, s := range list {
+		r, err := render(s, data)
+		if err != nil {
+			return nil, err
+		}
+		rendered[i] = r
+	}
+	return rendered, nil
+}
+
+// Writes the output of an instance to glog when there is no broker for instance logs
+type glog_writer struct {
+	id string
+}
+
+func (this glog_writer) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		glog.Infoln("Instance=", this.id, string(line))
+	}
+	return len(p), nil
+}
+
+func (this *Service) log_topic(instance *Instance) pubsub.Topic {
+	if !this.broker.Valid() {
+		return ""
+	}
+	info := instance.InstanceInfo
+	return this.broker.Topic("/orchestrate/" + info.Domain + "/" + info.Name + "/" + info.Id)
+}
+
+func (this *Service) log_writer(instance *Instance) io.Writer {
+	if instance.InstanceLog.Valid() {
+		pub, err := this.broker.PubSub("redpill-orchestrate")
+		if err == nil {
+			return pubsub.GetWriter(instance.InstanceLog, pub)
+		}
+		glog.Warningln("Instance=", instance.InstanceInfo.Id, "Broker=", this.broker, "Err=", err)
+	}
+	return glog_writer{id: instance.InstanceInfo.Id}
+}
+
+// Models with a docker section run in a container, the others as a local process
+func (this *Service) executor(instance *Instance) Executor {
+	if instance.InstanceModel.Docker != nil {
+		return this.docker
+	}
+	return this.local
+}
+
+// Runs the pending instance and saves how it completed.  It is not run if it is no longer
+// pending.  It can be stopped from when it is running, and is stopped and TimedOut once it
+// has run for the timeout of its model.
+func (this *Service) execute(id string) {
+	stop := make(chan bool)
+	instance, err := this.transition(id, OrchestrationRunning, "", func(*OrchestrationInfo) {
+		this.running[id] = stop
+	})
+	if err != nil {
+		glog.Warningln("Instance=", id, "Not run. Err=", err)
+		return
+	}
+	log := this.log_writer(instance)
+	timeout, err := instance.InstanceModel.GetTimeout()
+	if err != nil {
+		glog.Warningln("Instance=", id, "Timeout=", instance.InstanceModel.Timeout, "Err=", err)
+		this.transition(id, OrchestrationFailed, "", func(info *OrchestrationInfo) {
+			delete(this.running, id)
+			info.Error = err.Error()
+		})
+		return
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			if _, err := this.stop(id, OrchestrationTimedOut, ""); err == nil {
+				fmt.Fprintf(log, "Timed out after %s\n", timeout)
+			}
+		})
+		defer timer.Stop()
+	}
+	code, failed := this.executor(instance).Execute(instance, log, stop)
+	this.lock.Lock()
+	delete(this.running, id)
+	this.lock.Unlock()
+
+	status := OrchestrationSucceeded
+	if failed != nil || code != 0 {
+		status = OrchestrationFailed
+	}
+	glog.Infoln("Completed Orchestration=", instance.InstanceInfo.Name, "Domain=", instance.InstanceInfo.Domain,
+		"Instance=", id, "Status=", status, "ExitCode=", code, "Err=", failed)
+	exited := func(info *OrchestrationInfo) {
+		info.ExitCode = code
+		if failed != nil {
+			info.Error = failed.Error()
+		}
+	}
+	_, err = this.transition(id, status, "", exited)
+	if err == ErrBadTransition {
+		// Cancelled or timed out as it ran.  How it exited is still kept.
+		_, err = this.update(id, func(info *OrchestrationInfo) error {
+			exited(info)
+			return nil
+		})
+	}
+	if err != nil {
+		glog.Warningln("Instance=", id, "Err=", err)
+	}
+}
@@ -0,0 +1,238 @@
+package orchestrate
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/task"
+	. "gopkg.in/check.v1"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps the models and instances in memory
+type memory_storage struct {
+	lock      sync.Mutex
+	models    map[string]Model
+	instances map[string]Instance
+}
+
+func (this *memory_storage) GetModels(domainClass string) ([]Model, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	list := []Model{}
+	for _, m := range this.models {
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+func (this *memory_storage) Get(domainClass, name string) (*Model, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	m, has := this.models[name]
+	if !has {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+func (this *memory_storage) Save(domainClass string, model *Model) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.models[model.GetName()] = *model
+	return nil
+}
+
+func (this *memory_storage) Delete(domainClass, name string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.models, name)
+	return nil
+}
+
+type memory_instances struct {
+	*memory_storage
+}
+
+func (this memory_instances) Save(instance *Instance) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.instances[instance.InstanceInfo.Id] = *instance
+	return nil
+}
+
+func (this memory_instances) Get(id string) (*Instance, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	i, has := this.instances[id]
+	if !has {
+		return nil, ErrNotFound
+	}
+	return &i, nil
+}
+
+func (this memory_instances) List(domain, orchestration string) ([]Instance, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	list := []Instance{}
+	for _, i := range this.instances {
+		if i.InstanceInfo.Domain == domain && i.InstanceInfo.Name == orchestration {
+			list = append(list, i)
+		}
+	}
+	return list, nil
+}
+
+func (this memory_instances) ListClass(domainClass, orchestration string) ([]Instance, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	list := []Instance{}
+	for _, i := range this.instances {
+		if strings.HasSuffix(i.InstanceInfo.Domain, "."+domainClass) && i.InstanceInfo.Name == orchestration {
+			list = append(list, i)
+		}
+	}
+	return list, nil
+}
+
+func (this memory_instances) ListAll() ([]Instance, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	list := []Instance{}
+	for _, i := range this.instances {
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// Keeps what is published by topic
+type memory_pubsub struct {
+	lock      sync.Mutex
+	published map[pubsub.Topic]string
+}
+
+func (this *memory_pubsub) Publish(topic pubsub.Topic, message []byte) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.published[topic] += string(message)
+	return nil
+}
+
+func (this *memory_pubsub) Subscribe(topic pubsub.Topic) (<-chan []byte, error) {
+	return nil, pubsub.ErrNotSupported
+}
+
+func (this *memory_pubsub) Close() {
+}
+
+func (this *memory_pubsub) get(topic pubsub.Topic) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.published[topic]
+}
+
+var test_pubsub = &memory_pubsub{published: map[pubsub.Topic]string{}}
+
+func init() {
+	pubsub.Register("kfka", func(id, addr string, options ...interface{}) (pubsub.PubSub, error) {
+		return test_pubsub, nil
+	})
+}
+
+type ExecutorTests struct {
+	storage *memory_storage
+	service OrchestrateService
+	c       Context
+}
+
+var _ = Suite(&ExecutorTests{})
+
+func new_memory_storage() *memory_storage {
+	return &memory_storage{models: map[string]Model{}, instances: map[string]Instance{}}
+}
+
+func (suite *ExecutorTests) SetUpTest(c *C) {
+	suite.storage = new_memory_storage()
+	suite.service = NewService(nil,
+		func() ModelStorage { return suite.storage },
+		func() InstanceStorage { return memory_instances{suite.storage} },
+		pubsub.Broker("kfka://localhost:9092"), "")
+	suite.c = test_context("test")
+}
+
+func (suite *ExecutorTests) model(name string, cmd *task.Cmd, context OrchestrationContext) {
+	m := &Model{DefaultContext: context}
+	m.Name = task.TaskName(name)
+	m.Cmd = cmd
+	suite.storage.Save("test.com", m)
+}
+
+// Waits for the instance to complete
+func wait(c *C, service OrchestrateService, id string) OrchestrationInfo {
+	for i := 0; i < 500; i++ {
+		instance, err := service.GetOrchestration(test_context("test"), "", "", id)
+		c.Assert(err, Equals, nil)
+		if !instance.Info().CompletionTime.IsZero() {
+			return instance.Info()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("Instance did not complete:", id)
+	return OrchestrationInfo{}
+}
+
+func (suite *ExecutorTests) TestRun(c *C) {
+	suite.model("echo", &task.Cmd{
+		Path: "/bin/sh",
+		Args: []string{"-c", "echo {{.Context.greeting}} {{.Context.name}} $SUFFIX; echo {{.Domain}} 1>&2"},
+		Env:  []string{"SUFFIX={{.Name}}"},
+	}, OrchestrationContext{"greeting": "hello", "name": "world"})
+
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "echo",
+		OrchestrationContext{"name": "redpill"}, "a note")
+	c.Assert(err, Equals, nil)
+	c.Assert(instance.Info().Status, Equals, OrchestrationPending)
+	c.Assert(instance.Info().User, Equals, "test")
+	c.Assert(string(*instance.Log()), Equals,
+		"kfka://localhost:9092/orchestrate/integration.test.com/echo/"+instance.Info().Id)
+
+	info := wait(c, suite.service, instance.Info().Id)
+	c.Assert(info.Status, Equals, OrchestrationSucceeded)
+	c.Assert(info.ExitCode, Equals, 0)
+	c.Assert(info.Error, Equals, "")
+	c.Assert(info.Note, Equals, "a note")
+	c.Assert(info.CompletionTime.Before(info.StartTime), Equals, false)
+
+	output := test_pubsub.get(*instance.Log())
+	c.Assert(strings.Contains(output, "hello redpill echo\n"), Equals, true)
+	c.Assert(strings.Contains(output, "integration.test.com\n"), Equals, true)
+}
+
+func (suite *ExecutorTests) TestExitCode(c *C) {
+	suite.model("fail", &task.Cmd{Path: "/bin/sh", Args: []string{"-c", "echo failing; exit 3"}}, nil)
+
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "fail", nil)
+	c.Assert(err, Equals, nil)
+
+	info := wait(c, suite.service, instance.Info().Id)
+	c.Assert(info.Status, Equals, OrchestrationFailed)
+	c.Assert(info.ExitCode, Equals, 3)
+	c.Assert(info.Error, Equals, "")
+	c.Assert(test_pubsub.get(*instance.Log()), Equals, "failing\n")
+}
+
+func (suite *ExecutorTests) TestCannotRun(c *C) {
+	suite.model("missing", &task.Cmd{Path: "/no/such/command"}, nil)
+	suite.model("nocmd", nil, nil)
+
+	for _, name := range []string{"missing", "nocmd"} {
+		instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", name, nil)
+		c.Assert(err, Equals, nil)
+
+		info := wait(c, suite.service, instance.Info().Id)
+		c.Assert(info.Status, Equals, OrchestrationFailed)
+		c.Assert(info.ExitCode, Equals, -1)
+		c.Assert(info.Error, Not(Equals), "")
+	}
+}
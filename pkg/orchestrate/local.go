@@ -0,0 +1,61 @@
+package orchestrate
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Runs the command of the model as a process on this host.  The working dir, path, args and
+// env of the command are templates.  The env is added to that of redpill.  The process is in
+// a group of its own so that stopping it stops what it started as well.
+type local_executor struct {
+	grace time.Duration
+}
+
+func (this local_executor) Execute(instance *Instance, log io.Writer, stop <-chan bool) (int, error) {
+	if instance.InstanceModel.Cmd == nil {
+		return -1, ErrNoCmd
+	}
+	cmd, err := instance.InstanceModel.Cmd.ApplySubstitutions(instance.template_data(), nil)
+	if err != nil {
+		return -1, err
+	}
+
+	process := exec.Command(cmd.Path, cmd.Args...)
+	process.Dir = cmd.Dir
+	process.Env = append(os.Environ(), cmd.Env...)
+	process.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// The same writer for both so that only one of them writes to it at a time
+	process.Stdout, process.Stderr = log, log
+
+	if err := process.Start(); err != nil {
+		return -1, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- process.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-stop:
+		pgid := -process.Process.Pid
+		syscall.Kill(pgid, syscall.SIGTERM)
+		select {
+		case err = <-done:
+		case <-time.After(this.grace):
+			syscall.Kill(pgid, syscall.SIGKILL)
+			err = <-done
+		}
+	}
+	if exit, is := err.(*exec.ExitError); is {
+		return exit.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
@@ -1,32 +1,54 @@
 package orchestrate
 
 import (
+	"fmt"
 	"github.com/golang/glog"
 	. "github.com/infradash/redpill/pkg/api"
-	_ "github.com/qorio/maestro/pkg/pubsub"
-	"github.com/qorio/maestro/pkg/zk"
+	"github.com/infradash/redpill/pkg/kv"
+	"github.com/qorio/maestro/pkg/pubsub"
 	"github.com/qorio/omni/common"
 	"net/http"
+	"sync"
 	"time"
 )
 
 const (
 	EnvZkHosts = "REDPILL_ZK_HOSTS"
+
+	// How long a cancelled instance has to exit before it is killed
+	StopGracePeriod = 10 * time.Second
 )
 
 type Service struct {
-	conn      zk.ZK
+	conn      kv.Store
 	models    ModelStorage
 	instances InstanceStorage
+	broker    pubsub.Broker
+	local     Executor
+	docker    Executor
+
+	// Held to change the status of an instance and for the instances that are running
+	lock    sync.Mutex
+	running map[string]chan bool
 }
 
-func NewService(pool func() zk.ZK,
+// The output of the instances is published to topics of the broker.  Without a valid broker
+// it goes to the log of redpill.  Models with a docker section run on the docker endpoint.
+// The instances interrupted by the last restart are marked Failed.
+func NewService(store kv.Store,
 	models func() ModelStorage,
-	instances func() InstanceStorage) OrchestrateService {
+	instances func() InstanceStorage,
+	broker pubsub.Broker,
+	dockerEndpoint string) OrchestrateService {
 	s := new(Service)
-	s.conn = pool()
+	s.conn = store
 	s.models = models()
 	s.instances = instances()
+	s.broker = broker
+	s.local = local_executor{grace: StopGracePeriod}
+	s.docker = docker_executor{endpoint: dockerEndpoint, grace: StopGracePeriod}
+	s.running = map[string]chan bool{}
+	s.fail_interrupted()
 	return s
 }
 
@@ -69,6 +91,19 @@ func (this *Service) ListInstances(c Context, domain, orchestration string) ([]O
 	return instances, nil
 }
 
+// The instances of the orchestration in all the domain instances of the class
+func (this *Service) ListClassInstances(c Context, domainClass, orchestration string) ([]OrchestrationInstance, error) {
+	instances := []OrchestrationInstance{}
+	list, err := this.instances.ListClass(domainClass, orchestration)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range list {
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
 func (this *Service) StartOrchestration(c Context, domainClass, domainInstance, orchestration string, input OrchestrationContext, note ...string) (OrchestrationInstance, error) {
 	glog.Infoln("Starting Orchestration=", orchestration, "DomainClass=", domainClass, "DomainInstance=", domainInstance)
 	model, err := this.models.Get(domainClass, orchestration)
@@ -83,21 +118,84 @@ func (this *Service) StartOrchestration(c Context, domainClass, domainInstance,
 
 	instance := model.NewInstance(domain)
 	instance.InstanceInfo.User = c.UserId()
-	instance.InstanceInfo.Status = "Started"
 	if len(note) > 0 {
 		instance.InstanceInfo.Note = note[0]
 	}
 	instance.InstanceContext = input
-	//	instance.InstanceLog = pubsub.Topic(key)
+	instance.InstanceLog = this.log_topic(instance)
+	record(&instance.InstanceInfo, OrchestrationPending, c.UserId(), instance.InstanceInfo.StartTime)
 	err = this.instances.Save(instance)
 	if err != nil {
 		return nil, err
 	}
+	go this.execute(instance.InstanceInfo.Id)
 	return instance, nil
 }
 
+// The instance with the history of its status
 func (this *Service) GetOrchestration(c Context, domain, orchestration, instance string) (OrchestrationInstance, error) {
-	return this.instances.Get(instance)
+	found, err := this.instances.Get(instance)
+	switch {
+	case err != nil:
+		return nil, err
+	case found == nil:
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Marks the instance Cancelled by the user and stops it if it is running.  Those watching its
+// log are told.  Returns ErrBadTransition if it has already completed.
+func (this *Service) CancelOrchestration(c Context, domain, orchestration, instance string) (OrchestrationInstance, error) {
+	glog.Infoln("CancelOrchestration:", c.UserId(), "Domain=", domain, "Orchestration=", orchestration, "Instance=", instance)
+	found, err := this.instances.Get(instance)
+	switch {
+	case err != nil:
+		return nil, err
+	case found == nil, found.InstanceInfo.Domain != domain, found.InstanceInfo.Name != orchestration:
+		return nil, ErrNotFound
+	}
+	cancelled, err := this.stop(instance, OrchestrationCancelled, c.UserId())
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(this.log_writer(cancelled), "Cancelled by %s\n", c.UserId())
+	return cancelled, nil
+}
+
+// Moves the instance to the final status and stops it if it is running
+func (this *Service) stop(id, to, user string) (*Instance, error) {
+	return this.transition(id, to, user, func(*OrchestrationInfo) {
+		if stop, has := this.running[id]; has {
+			close(stop)
+			delete(this.running, id)
+		}
+	})
+}
+
+// The instances left Pending or Running when redpill last stopped are no longer run.  They
+// are marked Failed.  Only one redpill is expected to run the orchestrations of a store, or
+// this would fail the instances that another one is running.
+func (this *Service) fail_interrupted() {
+	list, err := this.instances.ListAll()
+	if err != nil {
+		glog.Warningln("Cannot list instances. Err=", err)
+		return
+	}
+	for _, instance := range list {
+		id := instance.InstanceInfo.Id
+		switch instance.InstanceInfo.Status {
+		case OrchestrationPending, OrchestrationRunning:
+			_, err := this.transition(id, OrchestrationFailed, "", func(info *OrchestrationInfo) {
+				info.Error = ErrInterrupted.Error()
+			})
+			if err != nil {
+				glog.Warningln("Instance=", id, "Err=", err)
+				continue
+			}
+			glog.Infoln("Instance=", id, "Status=", instance.InstanceInfo.Status, "Interrupted")
+		}
+	}
 }
 
 func (this *Service) NewOrchestrationModel(c Context, req *http.Request, um Unmarshaler) (OrchestrationModel, error) {
@@ -113,6 +211,9 @@ func (this *Service) SaveOrchestrationModel(c Context, domainClass string, m Orc
 	if !m.IsOrchestrationModel(m) {
 		return ErrTypeMismatch
 	}
+	if _, err := m.(*Model).GetTimeout(); err != nil {
+		return err
+	}
 	return this.models.Save(domainClass, m.(*Model))
 }
 
@@ -15,6 +15,9 @@ type test_context string
 func (t test_context) UserId() string {
 	return string(t)
 }
+func (t test_context) Groups() []string {
+	return nil
+}
 func (t test_context) UrlParameter(k string) string {
 	return ""
 }
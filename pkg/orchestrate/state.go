@@ -0,0 +1,80 @@
+package orchestrate
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"time"
+)
+
+// The states an instance can go to from each state.  The final states have none.
+var transitions = map[string][]string{
+	"": {OrchestrationPending},
+	OrchestrationPending: {OrchestrationRunning, OrchestrationFailed, OrchestrationCancelled,
+		OrchestrationTimedOut},
+	OrchestrationRunning: {OrchestrationSucceeded, OrchestrationFailed, OrchestrationCancelled,
+		OrchestrationTimedOut},
+}
+
+func can_transition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func is_final(status string) bool {
+	return status != "" && len(transitions[status]) == 0
+}
+
+// Records the transition in the history of the instance.  The instance is complete once it
+// is in a final state.
+func record(info *OrchestrationInfo, to, user string, now time.Time) error {
+	if !can_transition(info.Status, to) {
+		return ErrBadTransition
+	}
+	info.History = append(info.History, OrchestrationTransition{From: info.Status, To: to, Time: now, User: user})
+	info.Status = to
+	if is_final(to) {
+		info.CompletionTime = now
+	}
+	return nil
+}
+
+// Reads the instance, changes it and saves it.  This is done under the lock so that the
+// executor and the users do not undo each other's changes.
+func (this *Service) update(id string, change func(*OrchestrationInfo) error) (*Instance, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	instance, err := this.instances.Get(id)
+	switch {
+	case err != nil:
+		return nil, err
+	case instance == nil:
+		return nil, ErrNotFound
+	}
+	if err := change(&instance.InstanceInfo); err != nil {
+		return nil, err
+	}
+	if err := this.instances.Save(instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Moves the saved instance to the status and saves it.  The change, if any, is made to the
+// instance at the same time.
+func (this *Service) transition(id, to, user string, change func(*OrchestrationInfo)) (*Instance, error) {
+	return this.update(id, func(info *OrchestrationInfo) error {
+		if err := record(info, to, user, time.Now()); err != nil {
+			glog.Infoln("Instance=", id, "Status=", info.Status, "To=", to, "Err=", err)
+			return err
+		}
+		if change != nil {
+			change(info)
+		}
+		return nil
+	})
+}
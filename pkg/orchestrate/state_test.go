@@ -0,0 +1,142 @@
+package orchestrate
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"github.com/qorio/maestro/pkg/task"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type StateTests struct {
+	storage *memory_storage
+	service *Service
+	c       Context
+}
+
+var _ = Suite(&StateTests{})
+
+func (suite *StateTests) SetUpTest(c *C) {
+	suite.storage = new_memory_storage()
+	suite.service = NewService(nil,
+		func() ModelStorage { return suite.storage },
+		func() InstanceStorage { return memory_instances{suite.storage} },
+		pubsub.Broker(""), "").(*Service)
+	suite.c = test_context("test")
+}
+
+func (suite *StateTests) TestTransitions(c *C) {
+	valid := [][2]string{
+		{"", OrchestrationPending},
+		{OrchestrationPending, OrchestrationRunning},
+		{OrchestrationPending, OrchestrationCancelled},
+		{OrchestrationPending, OrchestrationFailed},
+		{OrchestrationPending, OrchestrationTimedOut},
+		{OrchestrationRunning, OrchestrationSucceeded},
+		{OrchestrationRunning, OrchestrationFailed},
+		{OrchestrationRunning, OrchestrationCancelled},
+		{OrchestrationRunning, OrchestrationTimedOut},
+	}
+	for _, t := range valid {
+		c.Assert(can_transition(t[0], t[1]), Equals, true, Commentf("%v", t))
+	}
+	invalid := [][2]string{
+		{"", OrchestrationRunning},
+		{OrchestrationPending, OrchestrationSucceeded},
+		{OrchestrationRunning, OrchestrationPending},
+		{OrchestrationRunning, OrchestrationRunning},
+		{OrchestrationSucceeded, OrchestrationFailed},
+		{OrchestrationFailed, OrchestrationRunning},
+		{OrchestrationCancelled, OrchestrationRunning},
+		{OrchestrationTimedOut, OrchestrationCancelled},
+		{OrchestrationRunning, "Started"},
+	}
+	for _, t := range invalid {
+		c.Assert(can_transition(t[0], t[1]), Equals, false, Commentf("%v", t))
+	}
+
+	for _, s := range []string{OrchestrationSucceeded, OrchestrationFailed, OrchestrationCancelled, OrchestrationTimedOut} {
+		c.Assert(is_final(s), Equals, true)
+	}
+	for _, s := range []string{"", OrchestrationPending, OrchestrationRunning} {
+		c.Assert(is_final(s), Equals, false)
+	}
+}
+
+func (suite *StateTests) TestRecord(c *C) {
+	info := &OrchestrationInfo{}
+	start := time.Now()
+	c.Assert(record(info, OrchestrationPending, "test", start), Equals, nil)
+	c.Assert(record(info, OrchestrationSucceeded, "", start), Equals, ErrBadTransition)
+	c.Assert(record(info, OrchestrationRunning, "", start.Add(time.Second)), Equals, nil)
+	c.Assert(info.CompletionTime.IsZero(), Equals, true)
+	c.Assert(record(info, OrchestrationTimedOut, "", start.Add(time.Minute)), Equals, nil)
+
+	c.Assert(info.Status, Equals, OrchestrationTimedOut)
+	c.Assert(info.CompletionTime, Equals, start.Add(time.Minute))
+	c.Assert(info.History, DeepEquals, []OrchestrationTransition{
+		{To: OrchestrationPending, Time: start, User: "test"},
+		{From: OrchestrationPending, To: OrchestrationRunning, Time: start.Add(time.Second)},
+		{From: OrchestrationRunning, To: OrchestrationTimedOut, Time: start.Add(time.Minute)},
+	})
+	c.Assert(record(info, OrchestrationCancelled, "test", start.Add(time.Hour)), Equals, ErrBadTransition)
+	c.Assert(len(info.History), Equals, 3)
+}
+
+func (suite *StateTests) TestHistory(c *C) {
+	m := &Model{}
+	m.Name = "echo"
+	m.Cmd = &task.Cmd{Path: "/bin/sh", Args: []string{"-c", "echo done"}}
+	suite.storage.Save("test.com", m)
+
+	instance, err := suite.service.StartOrchestration(suite.c, "test.com", "integration", "echo", nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(instance.Info().Status, Equals, OrchestrationPending)
+	c.Assert(len(instance.Info().History), Equals, 1)
+
+	info := wait(c, suite.service, instance.Info().Id)
+	c.Assert(info.Status, Equals, OrchestrationSucceeded)
+
+	got, err := suite.service.GetOrchestration(suite.c, "integration.test.com", "echo", info.Id)
+	c.Assert(err, Equals, nil)
+	history := got.Info().History
+	c.Assert(len(history), Equals, 3)
+	c.Assert(history[0].To, Equals, OrchestrationPending)
+	c.Assert(history[0].User, Equals, "test")
+	c.Assert(history[0].Time, Equals, got.Info().StartTime)
+	c.Assert(history[1].From, Equals, OrchestrationPending)
+	c.Assert(history[1].To, Equals, OrchestrationRunning)
+	c.Assert(history[2].From, Equals, OrchestrationRunning)
+	c.Assert(history[2].To, Equals, OrchestrationSucceeded)
+	c.Assert(history[2].Time, Equals, got.Info().CompletionTime)
+	c.Assert(history[1].Time.After(history[2].Time), Equals, false)
+
+	// Completed instances stay as they are
+	_, err = suite.service.transition(info.Id, OrchestrationCancelled, "test", nil)
+	c.Assert(err, Equals, ErrBadTransition)
+	_, err = suite.service.transition("no-such-instance", OrchestrationRunning, "", nil)
+	c.Assert(err, Equals, ErrNotFound)
+
+	_, err = suite.service.GetOrchestration(suite.c, "integration.test.com", "echo", "no-such-instance")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+// An instance cancelled before its executor starts is not run
+func (suite *StateTests) TestNotRun(c *C) {
+	m := &Model{}
+	m.Name = "echo"
+	m.Cmd = &task.Cmd{Path: "/bin/sh", Args: []string{"-c", "echo done"}}
+	instance := m.NewInstance("integration.test.com")
+	record(&instance.InstanceInfo, OrchestrationPending, "test", instance.InstanceInfo.StartTime)
+	suite.storage.instances[instance.InstanceInfo.Id] = *instance
+
+	_, err := suite.service.transition(instance.InstanceInfo.Id, OrchestrationCancelled, "test", nil)
+	c.Assert(err, Equals, nil)
+	suite.service.execute(instance.InstanceInfo.Id)
+
+	got, err := suite.service.GetOrchestration(suite.c, "", "", instance.InstanceInfo.Id)
+	c.Assert(err, Equals, nil)
+	c.Assert(got.Info().Status, Equals, OrchestrationCancelled)
+	c.Assert(len(got.Info().History), Equals, 2)
+	c.Assert(got.Info().History[1].User, Equals, "test")
+}
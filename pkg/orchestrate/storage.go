@@ -0,0 +1,189 @@
+package orchestrate
+
+import (
+	"encoding/json"
+	"github.com/infradash/redpill/pkg/kv"
+	"sort"
+	"strings"
+)
+
+// Instances are kept as json at /_redpill/orchestrate/instance/{domain}/{orchestration}/{id},
+// and /_redpill/orchestrate/id/{id} holds the path of the instance.  They are in the same store
+// as everything else, so they outlive the server that started them.
+const (
+	instance_root    = "/_redpill/orchestrate/instance"
+	instance_id_root = "/_redpill/orchestrate/id"
+)
+
+type kv_instances struct {
+	conn kv.Store
+}
+
+func NewInstanceStorage(store kv.Store) InstanceStorage {
+	return &kv_instances{conn: store}
+}
+
+func orchestration_path(domain, orchestration string) string {
+	return instance_root + "/" + domain + "/" + orchestration
+}
+
+func instance_path(domain, orchestration, id string) string {
+	return orchestration_path(domain, orchestration) + "/" + id
+}
+
+// Creates the node if it does not exist
+func (this *kv_instances) ensure(path string) error {
+	_, err := this.conn.Create(path, []byte{})
+	if err == kv.ErrNodeExists {
+		return nil
+	}
+	return err
+}
+
+// The instance and its id are created together, and only the instance is set after that
+func (this *kv_instances) Save(instance *Instance) error {
+	buff, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	info := instance.InstanceInfo
+	path := instance_path(info.Domain, info.Name, info.Id)
+	_, err = this.conn.Get(instance_id_root + "/" + info.Id)
+	switch {
+	case err == nil:
+		_, err = this.conn.Set(path, buff, -1)
+		return err
+	case err != kv.ErrNotExist:
+		return err
+	}
+	if err := this.ensure(orchestration_path(info.Domain, info.Name)); err != nil {
+		return err
+	}
+	if err := this.ensure(instance_id_root); err != nil {
+		return err
+	}
+	_, err = this.conn.Multi(
+		kv.OpCreate(path, buff),
+		kv.OpCreate(instance_id_root+"/"+info.Id, []byte(path)))
+	return err
+}
+
+func (this *kv_instances) load(path string) (*Instance, error) {
+	zn, err := this.conn.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	instance := new(Instance)
+	if err := json.Unmarshal(zn.Value, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// Returns nil if there is no instance with the id
+func (this *kv_instances) Get(id string) (*Instance, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return nil, nil
+	}
+	zn, err := this.conn.Get(instance_id_root + "/" + id)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	instance, err := this.load(string(zn.Value))
+	if err == kv.ErrNotExist {
+		return nil, nil
+	}
+	return instance, err
+}
+
+// The instances under the path, oldest first
+func (this *kv_instances) list(path string) ([]Instance, error) {
+	nodes, err := this.conn.Children(path)
+	switch {
+	case err == kv.ErrNotExist:
+		return []Instance{}, nil
+	case err != nil:
+		return nil, err
+	}
+	list := []Instance{}
+	for _, n := range nodes {
+		instance := Instance{}
+		if err := json.Unmarshal(n.Value, &instance); err != nil {
+			return nil, err
+		}
+		list = append(list, instance)
+	}
+	sort.Sort(by_start_time(list))
+	return list, nil
+}
+
+type by_start_time []Instance
+
+func (this by_start_time) Len() int {
+	return len(this)
+}
+
+func (this by_start_time) Less(i, j int) bool {
+	return this[i].InstanceInfo.StartTime.Before(this[j].InstanceInfo.StartTime)
+}
+
+func (this by_start_time) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+}
+
+func (this *kv_instances) List(domain, orchestration string) ([]Instance, error) {
+	if strings.Contains(domain, "/") || strings.Contains(orchestration, "/") {
+		return []Instance{}, nil
+	}
+	return this.list(orchestration_path(domain, orchestration))
+}
+
+// The domains of the class are the ones named {domain_instance}.{domain_class}
+func (this *kv_instances) ListClass(domainClass, orchestration string) ([]Instance, error) {
+	domains, err := this.conn.Children(instance_root)
+	switch {
+	case err == kv.ErrNotExist:
+		return []Instance{}, nil
+	case err != nil:
+		return nil, err
+	}
+	result := []Instance{}
+	for _, d := range domains {
+		name := d.Path[len(instance_root)+1:]
+		if !strings.HasSuffix(name, "."+domainClass) {
+			continue
+		}
+		list, err := this.List(name, orchestration)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, list...)
+	}
+	sort.Sort(by_start_time(result))
+	return result, nil
+}
+
+func (this *kv_instances) ListAll() ([]Instance, error) {
+	ids, err := this.conn.Children(instance_id_root)
+	switch {
+	case err == kv.ErrNotExist:
+		return []Instance{}, nil
+	case err != nil:
+		return nil, err
+	}
+	result := []Instance{}
+	for _, id := range ids {
+		instance, err := this.load(string(id.Value))
+		switch {
+		case err == kv.ErrNotExist:
+			continue
+		case err != nil:
+			return nil, err
+		}
+		result = append(result, *instance)
+	}
+	return result, nil
+}
@@ -0,0 +1,109 @@
+package orchestrate
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"github.com/qorio/maestro/pkg/pubsub"
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"time"
+)
+
+type StorageTests struct {
+	file  string
+	store kv.Store
+}
+
+var _ = Suite(&StorageTests{})
+
+func (suite *StorageTests) SetUpTest(c *C) {
+	suite.file = filepath.Join(c.MkDir(), "orchestrate.db")
+	store, err := kv.OpenBoltStore(suite.file)
+	c.Assert(err, Equals, nil)
+	suite.store = store
+}
+
+func (suite *StorageTests) TearDownTest(c *C) {
+	suite.store.Close()
+}
+
+func ids(list []Instance) []string {
+	result := []string{}
+	for _, i := range list {
+		result = append(result, i.InstanceInfo.Id)
+	}
+	return result
+}
+
+func (suite *StorageTests) TestInstances(c *C) {
+	storage := NewInstanceStorage(suite.store)
+
+	none, err := storage.Get("none")
+	c.Assert(err, Equals, nil)
+	c.Assert(none, IsNil)
+	list, err := storage.ListAll()
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, []Instance{})
+
+	m := &Model{}
+	m.Name = "build"
+	start := time.Now()
+	saved := []*Instance{}
+	for i, domain := range []string{"integration.test.com", "staging.test.com", "integration.test.com", "dev.other.com"} {
+		instance := m.NewInstance(domain)
+		instance.InstanceInfo.StartTime = start.Add(time.Duration(-i) * time.Minute)
+		record(&instance.InstanceInfo, OrchestrationPending, "test", time.Now())
+		c.Assert(storage.Save(instance), Equals, nil)
+		saved = append(saved, instance)
+	}
+
+	record(&saved[0].InstanceInfo, OrchestrationRunning, "", time.Now())
+	c.Assert(storage.Save(saved[0]), Equals, nil)
+	found, err := storage.Get(saved[0].InstanceInfo.Id)
+	c.Assert(err, Equals, nil)
+	c.Assert(found.InstanceInfo.Status, Equals, OrchestrationRunning)
+	c.Assert(found.InstanceInfo.Domain, Equals, "integration.test.com")
+	c.Assert(len(found.InstanceInfo.History), Equals, 2)
+
+	list, err = storage.List("integration.test.com", "build")
+	c.Assert(err, Equals, nil)
+	c.Assert(ids(list), DeepEquals, []string{saved[2].InstanceInfo.Id, saved[0].InstanceInfo.Id})
+	list, err = storage.List("integration.test.com", "deploy")
+	c.Assert(err, Equals, nil)
+	c.Assert(list, DeepEquals, []Instance{})
+
+	list, err = storage.ListClass("test.com", "build")
+	c.Assert(err, Equals, nil)
+	c.Assert(ids(list), DeepEquals, []string{saved[2].InstanceInfo.Id, saved[1].InstanceInfo.Id,
+		saved[0].InstanceInfo.Id})
+
+	list, err = storage.ListAll()
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list), Equals, 4)
+}
+
+// The instances are still there after a restart, which fails the ones it interrupted
+func (suite *StorageTests) TestRestart(c *C) {
+	storage := NewInstanceStorage(suite.store)
+	m := &Model{}
+	m.Name = "script"
+	running := m.NewInstance("integration.test.com")
+	record(&running.InstanceInfo, OrchestrationPending, "test", time.Now())
+	record(&running.InstanceInfo, OrchestrationRunning, "", time.Now())
+	c.Assert(storage.Save(running), Equals, nil)
+
+	suite.store.Close()
+	store, err := kv.OpenBoltStore(suite.file)
+	c.Assert(err, Equals, nil)
+	suite.store = store
+
+	service := NewService(store,
+		func() ModelStorage { return new_memory_storage() },
+		func() InstanceStorage { return NewInstanceStorage(store) },
+		pubsub.Broker("kfka://localhost:9092"), "")
+	instance, err := service.GetOrchestration(test_context("test"), "integration.test.com", "script",
+		running.InstanceInfo.Id)
+	c.Assert(err, Equals, nil)
+	c.Assert(instance.Info().Status, Equals, OrchestrationFailed)
+	c.Assert(instance.Info().Error, Equals, ErrInterrupted.Error())
+}
@@ -4,6 +4,7 @@ import (
 	dash "github.com/infradash/dash/pkg/executor"
 	. "github.com/infradash/redpill/pkg/api"
 	"github.com/qorio/maestro/pkg/docker"
+	"time"
 )
 
 type ModelStorage interface {
@@ -17,6 +18,8 @@ type InstanceStorage interface {
 	Save(instance *Instance) error
 	Get(id string) (*Instance, error)
 	List(domain, orchestration string) ([]Instance, error)
+	ListClass(domainClass, orchestration string) ([]Instance, error)
+	ListAll() ([]Instance, error)
 }
 
 type Model struct {
@@ -26,6 +29,10 @@ type Model struct {
 	Description    string                 `json:"dsecription"`
 	DefaultContext map[string]interface{} `json:"default_context"`
 
+	// How long an instance can run before it is stopped and TimedOut, like 30m.  No limit
+	// when empty.
+	Timeout string `json:"timeout,omitempty"`
+
 	// Different way of running this - docker, exec (with dash), or some scheduler api call.
 	Docker *docker.ContainerControl `json:"docker,omitempty"`
 }
@@ -46,6 +53,17 @@ func (this Model) GetDefaultContext() OrchestrationContext {
 	return this.DefaultContext
 }
 
+func (this Model) GetTimeout() (time.Duration, error) {
+	if this.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(this.Timeout)
+	if err != nil || timeout < 0 {
+		return 0, ErrBadTimeout
+	}
+	return timeout, nil
+}
+
 func (this Model) IsOrchestrationModel(ptr interface{}) bool {
 	_, isa := ptr.(*Model)
 	return isa
@@ -5,10 +5,12 @@ import (
 	"github.com/qorio/omni/auth"
 	"github.com/qorio/omni/rest"
 	"net/http"
+	"strings"
 )
 
 type context struct {
 	userId       func() string
+	groups       func() []string
 	urlParameter func(string) string
 	context      auth.Context
 	request      *http.Request
@@ -18,8 +20,12 @@ func (c *context) UserId() string {
 	return c.userId()
 }
 
+func (c *context) Groups() []string {
+	return c.groups()
+}
+
 func (c *context) UrlParameter(k string) string {
-	return c.UrlParameter(k)
+	return c.urlParameter(k)
 }
 
 func ServiceContext(engine rest.Engine) func(c auth.Context, req *http.Request) Context {
@@ -28,6 +34,12 @@ func ServiceContext(engine rest.Engine) func(c auth.Context, req *http.Request)
 		ctx.userId = func() string {
 			return c.GetStringForService(ServiceId, "@id")
 		}
+		ctx.groups = func() []string {
+			if groups := c.GetStringForService(ServiceId, "@groups"); groups != "" {
+				return strings.Split(groups, ",")
+			}
+			return nil
+		}
 		ctx.urlParameter = func(k string) string {
 			return engine.GetUrlParameter(req, k)
 		}
@@ -2,6 +2,7 @@ package redpill
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/gorilla/websocket"
@@ -12,6 +13,7 @@ import (
 	"github.com/qorio/omni/rest"
 	"github.com/qorio/omni/version"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os/exec"
 	"path/filepath"
@@ -29,6 +31,7 @@ type Api struct {
 	registry    RegistryService
 	orchestrate OrchestrateService
 	conf        ConfService
+	stats       StatsService
 
 	CreateServiceContext CreateContextFunc
 }
@@ -46,7 +49,8 @@ func NewApi(options Options, auth auth.Service,
 	domain DomainService,
 	registry RegistryService,
 	orchestrate OrchestrateService,
-	conf ConfService) (*Api, error) {
+	conf ConfService,
+	stats StatsService) (*Api, error) {
 	ep := &Api{
 		options:     options,
 		authService: auth,
@@ -56,6 +60,7 @@ func NewApi(options Options, auth auth.Service,
 		registry:    registry,
 		orchestrate: orchestrate,
 		conf:        conf,
+		stats:       stats,
 	}
 
 	ep.CreateServiceContext = ServiceContext(ep.engine)
@@ -70,42 +75,79 @@ func NewApi(options Options, auth auth.Service,
 		// Domains
 		rest.SetAuthenticatedHandler(ServiceId, Methods[ListDomains], ep.ListDomains),
 		rest.SetAuthenticatedHandler(ServiceId, Methods[GetDomain], ep.GetDomain),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateDomain], ep.CreateDomain),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateDomain], ep.member(DomainRoleAdmin, ep.UpdateDomain)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteDomain], ep.member(DomainRoleAdmin, ep.DeleteDomain)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[AddDomainInstance], ep.member(DomainRoleAdmin, ep.AddDomainInstance)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[RetireDomainInstance], ep.member(DomainRoleAdmin, ep.RetireDomainInstance)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetDomainMembers], ep.member(DomainRoleViewer, ep.GetDomainMembers)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateDomainMembers], ep.member(DomainRoleAdmin, ep.UpdateDomainMembers)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetDomainStats], ep.member(DomainRoleViewer, ep.GetDomainStats)),
 
 		// Environments
-		rest.SetAuthenticatedHandler(ServiceId, Methods[ListEnvironmentVars], ep.ListEnvironmentVars),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[GetEnvironmentVars], ep.GetEnvironmentVars),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateEnvironmentVars], ep.CreateEnvironmentVars),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateEnvironmentVars], ep.UpdateEnvironmentVars),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ListEnvironmentVars], ep.member(DomainRoleViewer, ep.ListEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetEnvironmentVars], ep.member(DomainRoleViewer, ep.GetEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateEnvironmentVars], ep.member(DomainRoleEditor, ep.CreateEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateEnvironmentVars], ep.member(DomainRoleEditor, ep.UpdateEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ListEnvironmentHistory], ep.member(DomainRoleViewer, ep.ListEnvironmentHistory)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetEnvironmentVarsAtRevision], ep.member(DomainRoleViewer, ep.GetEnvironmentVarsAtRevision)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[RollbackEnvironmentVars], ep.member(DomainRoleEditor, ep.RollbackEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[DiffEnvironmentVars], ep.member(DomainRoleViewer, ep.DiffEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[PromoteEnvironmentVars], ep.member(DomainRoleEditor, ep.PromoteEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[RevealEnvironmentVars], ep.member(DomainRoleEditor, ep.RevealEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ValidateEnvironmentVars], ep.member(DomainRoleViewer, ep.ValidateEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetEnvironmentSchema], ep.member(DomainRoleViewer, ep.GetEnvironmentSchema)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateEnvironmentSchema], ep.member(DomainRoleEditor, ep.UpdateEnvironmentSchema)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ResolveEnvironmentVars], ep.member(DomainRoleViewer, ep.ResolveEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[WatchEnvironmentVars], ep.member(DomainRoleViewer, ep.WatchEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetClassEnvironmentVars], ep.member(DomainRoleViewer, ep.GetEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateClassEnvironmentVars], ep.member(DomainRoleEditor, ep.CreateEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateClassEnvironmentVars], ep.member(DomainRoleEditor, ep.UpdateEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetInstanceEnvironmentVars], ep.member(DomainRoleViewer, ep.GetEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateInstanceEnvironmentVars], ep.member(DomainRoleEditor, ep.CreateEnvironmentVars)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateInstanceEnvironmentVars], ep.member(DomainRoleEditor, ep.UpdateEnvironmentVars)),
 
 		// Registry
 		rest.SetAuthenticatedHandler(ServiceId, Methods[GetRegistryEntry], ep.GetRegistryEntry),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ListRegistryRoot], ep.ListRegistryRoot),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[RegistryTransaction], ep.RegistryTransaction),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ExportRegistry], ep.ExportRegistry),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ImportRegistry], ep.ImportRegistry),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[WatchRegistry], ep.WatchRegistry),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[SearchRegistry], ep.SearchRegistry),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GrantRegistryLease], ep.GrantRegistryLease),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[KeepAliveRegistryLease], ep.KeepAliveRegistryLease),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[RevokeRegistryLease], ep.RevokeRegistryLease),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetRegistryAcl], ep.GetRegistryAcl),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateRegistryAcl], ep.UpdateRegistryAcl),
 		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateRegistryEntry], ep.UpdateRegistryEntry),
 		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteRegistryEntry], ep.DeleteRegistryEntry),
 
 		// Orchestration
-		rest.SetAuthenticatedHandler(ServiceId, Methods[ListOrchestrations], ep.ListOrchestrations),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[StartOrchestration], ep.StartOrchestration),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[WatchOrchestration], ep.WatchOrchestration),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[GetOrchestrationInstance], ep.GetOrchestrationInstance),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[ListOrchestrationInstances], ep.ListOrchestrationInstances),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ListOrchestrations], ep.member(DomainRoleViewer, ep.ListOrchestrations)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[StartOrchestration], ep.member(DomainRoleEditor, ep.StartOrchestration)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[WatchOrchestration], ep.member(DomainRoleViewer, ep.WatchOrchestration)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetOrchestrationInstance], ep.member(DomainRoleViewer, ep.GetOrchestrationInstance)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CancelOrchestration], ep.member(DomainRoleEditor, ep.CancelOrchestration)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ListOrchestrationInstances], ep.member(DomainRoleViewer, ep.ListOrchestrationInstances)),
 
 		// Models
-		rest.SetAuthenticatedHandler(ServiceId, Methods[GetOrchestrationModel], ep.GetOrchestrationModel),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateOrchestrationModel], ep.CreateOrchestrationModel),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateOrchestrationModel], ep.CreateOrchestrationModel),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteOrchestrationModel], ep.DeleteOrchestrationModel),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetOrchestrationModel], ep.member(DomainRoleViewer, ep.GetOrchestrationModel)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateOrchestrationModel], ep.member(DomainRoleEditor, ep.CreateOrchestrationModel)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateOrchestrationModel], ep.member(DomainRoleEditor, ep.CreateOrchestrationModel)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteOrchestrationModel], ep.member(DomainRoleEditor, ep.DeleteOrchestrationModel)),
 
 		// ConfigFiles
-		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateConfFile], ep.CreateConfFile),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateConfFile], ep.CreateConfFile),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[GetConfFile], ep.GetConfFile),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteConfFile], ep.DeleteConfFile),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[ListConfFiles], ep.ListConfFiles),
-
-		rest.SetAuthenticatedHandler(ServiceId, Methods[GetConfFileVersion], ep.GetConfFileVersion),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateConfFileVersion], ep.CreateConfFileVersion),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateConfFileVersion], ep.CreateConfFileVersion),
-		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteConfFileVersion], ep.DeleteConfFileVersion),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateConfFile], ep.member(DomainRoleEditor, ep.CreateConfFile)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateConfFile], ep.member(DomainRoleEditor, ep.CreateConfFile)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetConfFile], ep.member(DomainRoleViewer, ep.GetConfFile)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteConfFile], ep.member(DomainRoleEditor, ep.DeleteConfFile)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[ListConfFiles], ep.member(DomainRoleViewer, ep.ListConfFiles)),
+
+		rest.SetAuthenticatedHandler(ServiceId, Methods[GetConfFileVersion], ep.member(DomainRoleViewer, ep.GetConfFileVersion)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[CreateConfFileVersion], ep.member(DomainRoleEditor, ep.CreateConfFileVersion)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[UpdateConfFileVersion], ep.member(DomainRoleEditor, ep.CreateConfFileVersion)),
+		rest.SetAuthenticatedHandler(ServiceId, Methods[DeleteConfFileVersion], ep.member(DomainRoleEditor, ep.DeleteConfFileVersion)),
 	)
 
 	return ep, nil
@@ -153,7 +195,14 @@ func (this *Api) GetDomain(context auth.Context, resp http.ResponseWriter, req *
 	glog.Infoln("GetDomain", "UserId=", userId)
 	domain_class := request.UrlParameter("domain_class")
 	detail, err := this.domain.GetDomain(request, domain_class)
-	if err != nil {
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err == ErrForbidden:
+		this.engine.HandleError(resp, req, "forbidden", http.StatusForbidden)
+		return
+	case err != nil:
 		this.engine.HandleError(resp, req, "cannot-get-domain", http.StatusInternalServerError)
 		return
 	}
@@ -358,18 +407,33 @@ func (this *Api) ListEnvironmentVars(context auth.Context, resp http.ResponseWri
 func (this *Api) GetEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
 	request := this.CreateServiceContext(context, req)
 
+	queries, err := this.engine.GetUrlQueries(req, Methods[GetEnvironmentVars].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	format := env_format(req, queries["format"].(string), "Accept")
+	if EnvFormatContentType(format) == "" {
+		this.engine.HandleError(resp, req, ErrUnknownEnvFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
 	vars, rev, err := this.env.GetEnv(request,
-		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		env_domain(request),
 		request.UrlParameter("service"),
 		request.UrlParameter("version"))
 	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", rev))
 
-	if err != nil {
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
 		glog.Warningln("Err=", err)
 		this.engine.HandleError(resp, req, "get-env-fails", http.StatusInternalServerError)
 		return
 	}
-	err = this.engine.MarshalJSON(req, vars, resp)
+	err = this.write_env(req, resp, format, vars)
 	if err != nil {
 		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
 		return
@@ -379,24 +443,39 @@ func (this *Api) GetEnvironmentVars(context auth.Context, resp http.ResponseWrit
 func (this *Api) CreateEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
 	request := this.CreateServiceContext(context, req)
 
-	vars := Methods[CreateEnvironmentVars].RequestBody(req).(*EnvList)
-	err := this.engine.UnmarshalJSON(req, vars)
+	defer req.Body.Close()
+	buff, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		glog.Warningln("Err=", err)
-		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		this.engine.HandleError(resp, req, "bad-request", http.StatusBadRequest)
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[CreateEnvironmentVars].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	vars, err := ParseEnvList(env_format(req, queries["format"].(string), "Content-Type"), buff)
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	rev, err := this.env.NewEnv(request,
-		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		env_domain(request),
 		request.UrlParameter("service"),
 		request.UrlParameter("version"),
-		vars)
+		&vars, split_keys(queries["secret"].(string))...)
 
 	switch {
 	case err == ErrConflict:
 		this.engine.HandleError(resp, req, "version-conflict", http.StatusConflict)
 		return
+	case is_invalid(err):
+		this.write_invalid(resp, req, err)
+		return
 	case err != nil:
 		glog.Warningln("Err=", err)
 		this.engine.HandleError(resp, req, "save-env-fails", http.StatusInternalServerError)
@@ -409,11 +488,17 @@ func (this *Api) CreateEnvironmentVars(context auth.Context, resp http.ResponseW
 func (this *Api) UpdateEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
 	request := this.CreateServiceContext(context, req)
 
-	change := Methods[UpdateEnvironmentVars].RequestBody(req).(*EnvChange)
-	err := this.engine.UnmarshalJSON(req, change)
+	defer req.Body.Close()
+	buff, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		glog.Warningln("Err=", err)
-		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		this.engine.HandleError(resp, req, "bad-request", http.StatusBadRequest)
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[UpdateEnvironmentVars].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
 		return
 	}
 
@@ -424,22 +509,72 @@ func (this *Api) UpdateEnvironmentVars(context auth.Context, resp http.ResponseW
 		return
 	}
 
-	err = this.env.SaveEnv(request,
-		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
-		request.UrlParameter("service"),
-		request.UrlParameter("version"),
-		change,
-		Revision(rev))
+	domain := env_domain(request)
+	service := request.UrlParameter("service")
+	version := request.UrlParameter("version")
+
+	format := env_format(req, queries["format"].(string), "Content-Type")
+	replace := queries["replace"].(bool)
+
+	change := Methods[UpdateEnvironmentVars].RequestBody(req).(*EnvChange)
+	switch {
+	case format == EnvFormatJSON && !replace:
+		if err := json.Unmarshal(buff, change); err != nil {
+			glog.Warningln("Err=", err)
+			this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+			return
+		}
+	default:
+		vars, err := ParseEnvList(format, buff)
+		if err != nil {
+			glog.Warningln("Err=", err)
+			this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+			return
+		}
+		change.Update = vars
+	}
+	// Secret keys come back masked, so the current env is needed to tell them apart
+	if replace || has_masked(change.Update) {
+		current, current_rev, err := this.env.GetEnv(request, domain, service, version)
+		switch {
+		case err == ErrNotFound:
+			this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+			return
+		case err != nil:
+			glog.Warningln("Err=", err)
+			this.engine.HandleError(resp, req, "get-env-fails", http.StatusInternalServerError)
+			return
+		case current_rev != Revision(rev):
+			this.engine.HandleError(resp, req, "version-conflict", http.StatusConflict)
+			return
+		}
+		if replace {
+			change = replace_env(current, change.Update)
+		} else {
+			keep_masked(current, change)
+		}
+	}
+	change.Secret = append(change.Secret, split_keys(queries["secret"].(string))...)
+
+	new_rev, err := this.env.SaveEnv(request, domain, service, version, change, Revision(rev))
 
 	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
 	case err == ErrConflict:
 		this.engine.HandleError(resp, req, "version-conflict", http.StatusConflict)
 		return
+	case is_invalid(err):
+		this.write_invalid(resp, req, err)
+		return
 	case err != nil:
 		glog.Warningln("Err=", err)
 		this.engine.HandleError(resp, req, "save-env-fails", http.StatusInternalServerError)
 		return
 	}
+
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", new_rev))
 }
 
 func (this *Api) GetRegistryEntry(context auth.Context, resp http.ResponseWriter, req *http.Request) {
@@ -449,8 +584,21 @@ func (this *Api) GetRegistryEntry(context auth.Context, resp http.ResponseWriter
 	result.Path = "/" + c.UrlParameter("path")
 
 	glog.Infoln("GetRegistry", "path=", result.Path)
+	if !this.registry_access(c, resp, req, result.Path, RegistryAccessRead) {
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[GetRegistryEntry].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	if depth := queries["depth"].(int); queries["list"].(bool) || depth > 0 {
+		this.list_registry(c, resp, req, result.Path, depth)
+		return
+	}
 
-	v, rev, err := this.registry.GetEntry(c, result.Path)
+	result, err = this.registry.DescribeEntry(c, result.Path)
 	switch {
 	case err == ErrNotFound:
 		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
@@ -460,8 +608,7 @@ func (this *Api) GetRegistryEntry(context auth.Context, resp http.ResponseWriter
 		return
 	}
 
-	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", rev))
-	result.Value = string(v)
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", result.Version))
 
 	err = this.engine.MarshalJSON(req, result, resp)
 	if err != nil {
@@ -486,6 +633,20 @@ func (this *Api) UpdateRegistryEntry(context auth.Context, resp http.ResponseWri
 		this.engine.HandleError(resp, req, "conflict", http.StatusBadRequest)
 		return
 	}
+	if !this.registry_access(c, resp, req, path, RegistryAccessUpdate) {
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[UpdateRegistryEntry].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	ephemeral, sequential := queries["ephemeral"].(bool), queries["sequential"].(bool)
+	if ephemeral || sequential {
+		this.create_registry_entry(c, resp, req, change, ephemeral, sequential, queries["lease"].(string))
+		return
+	}
 
 	rev, err := strconv.Atoi(req.Header.Get("X-Dash-Version"))
 	if err != nil {
@@ -499,6 +660,9 @@ func (this *Api) UpdateRegistryEntry(context auth.Context, resp http.ResponseWri
 	case err == ErrNotFound:
 		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
 		return
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "version-conflict", http.StatusConflict)
+		return
 	case err != nil:
 		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
 		return
@@ -509,6 +673,9 @@ func (this *Api) UpdateRegistryEntry(context auth.Context, resp http.ResponseWri
 func (this *Api) DeleteRegistryEntry(context auth.Context, resp http.ResponseWriter, req *http.Request) {
 	c := this.CreateServiceContext(context, req)
 	path := "/" + c.UrlParameter("path")
+	if !this.registry_access(c, resp, req, path, RegistryAccessUpdate) {
+		return
+	}
 	rev, err := strconv.Atoi(req.Header.Get("X-Dash-Version"))
 	if err != nil {
 		glog.Warningln("Err=", err)
@@ -520,6 +687,9 @@ func (this *Api) DeleteRegistryEntry(context auth.Context, resp http.ResponseWri
 	case err == ErrNotFound:
 		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
 		return
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "version-conflict", http.StatusConflict)
+		return
 	case err != nil:
 		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
 		return
@@ -650,6 +820,35 @@ func (this *Api) GetOrchestrationInstance(context auth.Context, resp http.Respon
 	}
 }
 
+func (this *Api) CancelOrchestration(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	domain_class := c.UrlParameter("domain_class")
+	domain_instance := c.UrlParameter("domain_instance")
+	domain := fmt.Sprintf("%s.%s", domain_instance, domain_class)
+	orchestration := c.UrlParameter("orchestration")
+	instance_id := c.UrlParameter("instance_id")
+
+	glog.Infoln("Domain=", domain, "Orchestration=", orchestration, "Instance=", instance_id)
+	orc, err := this.orchestrate.CancelOrchestration(c, domain, orchestration, instance_id)
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err == ErrBadTransition:
+		this.engine.HandleError(resp, req, "already-completed", http.StatusConflict)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "cannot-cancel-orchestration", http.StatusInternalServerError)
+		return
+	}
+	err = this.engine.MarshalJSON(req, orc, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-orchestration-instance", http.StatusInternalServerError)
+		return
+	}
+}
+
 func (this *Api) WatchOrchestration(context auth.Context, resp http.ResponseWriter, req *http.Request) {
 	glog.Infoln("WatchOrchestration")
 
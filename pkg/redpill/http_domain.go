@@ -0,0 +1,189 @@
+package redpill
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/omni/auth"
+	"net/http"
+)
+
+// Wraps the handler of a route with a {domain_class} so that only the members of the domain
+// class with the role can use it.  The role is needed in the {domain_instance} of the route,
+// and in the {to_instance} too for the routes that have one.
+func (this *Api) member(role string, handler auth.HttpHandler) auth.HttpHandler {
+	return func(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+		c := this.CreateServiceContext(context, req)
+		domain_class := c.UrlParameter("domain_class")
+		instances := []string{c.UrlParameter("domain_instance")}
+		if to_instance := c.UrlParameter("to_instance"); to_instance != "" {
+			instances = append(instances, to_instance)
+		}
+		for _, domain_instance := range instances {
+			err := this.domain.CheckMembership(c, domain_class, domain_instance, role)
+			switch {
+			case err == ErrForbidden:
+				this.engine.HandleError(resp, req, "forbidden", http.StatusForbidden)
+				return
+			case err != nil:
+				this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		handler(context, resp, req)
+	}
+}
+
+func (this *Api) handle_domain_error(resp http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+	case err == ErrForbidden:
+		this.engine.HandleError(resp, req, "forbidden", http.StatusForbidden)
+	case err == ErrBadDomain, err == ErrBadDomainMember:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+	case err == ErrDomainExists, err == ErrDomainHasInstances:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusConflict)
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "conflict", http.StatusConflict)
+	default:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (this *Api) write_domain(resp http.ResponseWriter, req *http.Request, detail *DomainDetail) {
+	err := this.engine.MarshalJSON(req, detail, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) CreateDomain(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	domain := Methods[CreateDomain].RequestBody(req).(*Domain)
+	if err := this.engine.UnmarshalJSON(req, domain); err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+
+	detail, err := this.domain.CreateDomain(request, domain)
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+	this.write_domain(resp, req, detail)
+}
+
+func (this *Api) UpdateDomain(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	domain := Methods[UpdateDomain].RequestBody(req).(*Domain)
+	if err := this.engine.UnmarshalJSON(req, domain); err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+	domain.Class = request.UrlParameter("domain_class")
+
+	detail, err := this.domain.UpdateDomain(request, domain)
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+	this.write_domain(resp, req, detail)
+}
+
+func (this *Api) DeleteDomain(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	err := this.domain.DeleteDomain(request, request.UrlParameter("domain_class"))
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+}
+
+func (this *Api) AddDomainInstance(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	instance := Methods[AddDomainInstance].RequestBody(req).(*DomainInstance)
+	if err := this.engine.UnmarshalJSON(req, instance); err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+
+	detail, err := this.domain.AddInstance(request, request.UrlParameter("domain_class"), instance)
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+	this.write_domain(resp, req, detail)
+}
+
+func (this *Api) RetireDomainInstance(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	detail, err := this.domain.RetireInstance(request,
+		request.UrlParameter("domain_class"),
+		request.UrlParameter("domain_instance"))
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+	this.write_domain(resp, req, detail)
+}
+
+func (this *Api) write_members(resp http.ResponseWriter, req *http.Request, members *DomainMembers) {
+	err := this.engine.MarshalJSON(req, members, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) GetDomainMembers(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	members, err := this.domain.GetMembers(request, request.UrlParameter("domain_class"))
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+	this.write_members(resp, req, members)
+}
+
+func (this *Api) UpdateDomainMembers(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	members := Methods[UpdateDomainMembers].RequestBody(req).(*DomainMembers)
+	if err := this.engine.UnmarshalJSON(req, members); err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+
+	result, err := this.domain.SaveMembers(request, request.UrlParameter("domain_class"), members)
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+	this.write_members(resp, req, result)
+}
+
+func (this *Api) GetDomainStats(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	stats, err := this.stats.GetDomainStats(request, request.UrlParameter("domain_class"))
+	if err != nil {
+		this.handle_domain_error(resp, req, err)
+		return
+	}
+	err = this.engine.MarshalJSON(req, stats, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,457 @@
+package redpill
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/omni/auth"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func (this *Api) ListEnvironmentHistory(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	history, err := this.env.ListEnvHistory(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"))
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "get-env-history-fails", http.StatusInternalServerError)
+		return
+	}
+	err = this.engine.MarshalJSON(req, history, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) GetEnvironmentVarsAtRevision(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	rev, err := strconv.Atoi(request.UrlParameter("revision"))
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-revision", http.StatusBadRequest)
+		return
+	}
+
+	vars, err := this.env.GetEnvAt(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"),
+		Revision(rev))
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "get-env-fails", http.StatusInternalServerError)
+		return
+	}
+
+	// No X-Dash-Version: the env at a past revision is not one that can be written back
+	err = this.engine.MarshalJSON(req, vars, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) RollbackEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	to, err := strconv.Atoi(request.UrlParameter("revision"))
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-revision", http.StatusBadRequest)
+		return
+	}
+
+	rev, err := strconv.Atoi(req.Header.Get("X-Dash-Version"))
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-version", http.StatusBadRequest)
+		return
+	}
+
+	new_rev, err := this.env.RollbackEnv(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"),
+		Revision(to),
+		Revision(rev))
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "version-conflict", http.StatusConflict)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "rollback-env-fails", http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", new_rev))
+}
+
+func (this *Api) DiffEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+	domain_class := request.UrlParameter("domain_class")
+
+	diff, err := this.env.DiffEnv(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), domain_class),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"),
+		fmt.Sprintf("%s.%s", request.UrlParameter("to_instance"), domain_class),
+		request.UrlParameter("to_service"),
+		request.UrlParameter("to_version"))
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "diff-env-fails", http.StatusInternalServerError)
+		return
+	}
+	err = this.engine.MarshalJSON(req, diff, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) PromoteEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+	domain_class := request.UrlParameter("domain_class")
+
+	promotion := Methods[PromoteEnvironmentVars].RequestBody(req).(*EnvPromotion)
+	err := this.engine.UnmarshalJSON(req, promotion)
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+	if len(promotion.Keys) == 0 {
+		this.engine.HandleError(resp, req, ErrNoInput.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rev, err := this.env.PromoteEnv(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), domain_class),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"),
+		fmt.Sprintf("%s.%s", request.UrlParameter("to_instance"), domain_class),
+		request.UrlParameter("to_service"),
+		request.UrlParameter("to_version"),
+		promotion.Keys)
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "version-conflict", http.StatusConflict)
+		return
+	case is_invalid(err):
+		this.write_invalid(resp, req, err)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "promote-env-fails", http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", rev))
+}
+
+func (this *Api) RevealEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	vars, rev, err := this.env.RevealEnv(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"))
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "reveal-env-fails", http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", rev))
+	err = this.engine.MarshalJSON(req, vars, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+// The format of the env in the request body, or to respond with.  The format query takes
+// precedence over the header, and json is the default.
+func env_format(req *http.Request, query, header string) string {
+	if query != "" {
+		return query
+	}
+	for _, t := range strings.Split(req.Header.Get(header), ",") {
+		if format := EnvFormatForContentType(t); format != "" {
+			return format
+		}
+	}
+	return EnvFormatJSON
+}
+
+func (this *Api) write_env(req *http.Request, resp http.ResponseWriter, format string, vars EnvList) error {
+	if format == EnvFormatJSON {
+		return this.engine.MarshalJSON(req, vars, resp)
+	}
+	buff, err := vars.Format(format)
+	if err != nil {
+		return err
+	}
+	resp.Header().Set("Content-Type", EnvFormatContentType(format))
+	_, err = resp.Write(buff)
+	return err
+}
+
+// The change that turns the current env into the uploaded one.  Secret keys come back
+// masked when exported, so a masked value in the upload leaves the key alone.
+func replace_env(current, upload EnvList) *EnvChange {
+	change := &EnvChange{Update: EnvList{}}
+	for k, v := range upload {
+		value := fmt.Sprintf("%v", v)
+		if old, has := current[k]; has && (value == EnvSecretMask || value == fmt.Sprintf("%v", old)) {
+			continue
+		}
+		change.Update[k] = value
+	}
+	for k, _ := range current {
+		if _, has := upload[k]; !has {
+			change.Delete = append(change.Delete, k)
+		}
+	}
+	sort.Strings(change.Delete)
+	return change
+}
+
+func has_masked(vars EnvList) bool {
+	for _, v := range vars {
+		if fmt.Sprintf("%v", v) == EnvSecretMask {
+			return true
+		}
+	}
+	return false
+}
+
+// Masked values of the secret keys in the current env are dropped from the change
+func keep_masked(current EnvList, change *EnvChange) {
+	for k, v := range change.Update {
+		if fmt.Sprintf("%v", v) == EnvSecretMask && fmt.Sprintf("%v", current[k]) == EnvSecretMask {
+			delete(change.Update, k)
+		}
+	}
+}
+
+func split_keys(keys string) []string {
+	if keys == "" {
+		return []string{}
+	}
+	return strings.Split(keys, ",")
+}
+
+func is_invalid(err error) bool {
+	_, is := err.(*EnvValidationError)
+	return is
+}
+
+// Responds with the errors of each key of an env or schema that is not valid
+func (this *Api) write_invalid(resp http.ResponseWriter, req *http.Request, err error) {
+	this.write_error(resp, req, err, http.StatusBadRequest)
+}
+
+// Responds with the error as json, for errors that say more than their message
+func (this *Api) write_error(resp http.ResponseWriter, req *http.Request, err error, code int) {
+	buff, err := json.Marshal(err)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(code)
+	resp.Write(buff)
+}
+
+func (this *Api) ValidateEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	result, err := this.env.ValidateEnv(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"))
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "validate-env-fails", http.StatusInternalServerError)
+		return
+	}
+
+	err = this.engine.MarshalJSON(req, result, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) GetEnvironmentSchema(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	schema, err := this.env.GetEnvSchema(request, request.UrlParameter("domain_class"), request.UrlParameter("service"))
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "get-schema-fails", http.StatusInternalServerError)
+		return
+	}
+
+	err = this.engine.MarshalJSON(req, schema, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) UpdateEnvironmentSchema(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	schema := Methods[UpdateEnvironmentSchema].RequestBody(req).(*EnvSchema)
+	err := this.engine.UnmarshalJSON(req, schema)
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+
+	err = this.env.SaveEnvSchema(request, request.UrlParameter("domain_class"), request.UrlParameter("service"), schema)
+	switch {
+	case is_invalid(err):
+		this.write_invalid(resp, req, err)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "save-schema-fails", http.StatusInternalServerError)
+		return
+	}
+}
+
+// The domain of the env in the request.  The envs of the domain class layer have no domain
+// instance, and the layers have no version.
+func env_domain(request Context) string {
+	if instance := request.UrlParameter("domain_instance"); instance != "" {
+		return fmt.Sprintf("%s.%s", instance, request.UrlParameter("domain_class"))
+	}
+	return request.UrlParameter("domain_class")
+}
+
+func (this *Api) ResolveEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	resolved, err := this.env.ResolveEnv(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"))
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "resolve-env-fails", http.StatusInternalServerError)
+		return
+	}
+
+	err = this.engine.MarshalJSON(req, resolved, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) WatchEnvironmentVars(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := this.CreateServiceContext(context, req)
+
+	stop := make(chan bool)
+	events, err := this.env.WatchEnv(request,
+		fmt.Sprintf("%s.%s", request.UrlParameter("domain_instance"), request.UrlParameter("domain_class")),
+		request.UrlParameter("service"),
+		request.UrlParameter("version"),
+		stop)
+
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "watch-env-fails", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		glog.Infoln("ERROR", err)
+		close(stop)
+		return
+	}
+
+	// Incoming messages are ignored.  The watch stops when the client goes away.
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				conn.Close()
+				close(stop)
+				break
+			}
+		}
+	}()
+
+	for event := range events {
+		message, err := json.Marshal(event)
+		if err != nil {
+			glog.Warningln("ERROR Mashal:", err)
+			continue
+		}
+		err = conn.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			report_error(conn, err, "ws write error")
+			conn.Close()
+			return
+		}
+	}
+	conn.Close()
+	glog.Infoln("Completed")
+}
@@ -2,7 +2,7 @@ package redpill
 
 import (
 	"github.com/golang/glog"
-	_ "github.com/infradash/redpill/pkg/api"
+	. "github.com/infradash/redpill/pkg/api"
 	"github.com/qorio/omni/auth"
 	"net/http"
 )
@@ -19,7 +19,11 @@ func (this *Api) CreateOrchestrationModel(context auth.Context, resp http.Respon
 		return
 	}
 	err = this.orchestrate.SaveOrchestrationModel(c, domain_class, model)
-	if err != nil {
+	switch {
+	case err == ErrBadTimeout:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
 		glog.Warningln("Err=", err)
 		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,459 @@
+package redpill
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/qorio/omni/auth"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writes the error and returns false if the user does not have the access to the path
+func (this *Api) registry_access(c Context, resp http.ResponseWriter, req *http.Request, path, access string) bool {
+	err := this.registry.CheckAccess(c, path, access)
+	switch {
+	case err == ErrForbidden:
+		this.engine.HandleError(resp, req, "forbidden", http.StatusForbidden)
+		return false
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (this *Api) ListRegistryRoot(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	if !this.registry_access(c, resp, req, "/", RegistryAccessRead) {
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[ListRegistryRoot].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	this.list_registry(c, resp, req, "/", queries["depth"].(int))
+}
+
+func (this *Api) list_registry(c Context, resp http.ResponseWriter, req *http.Request, path string, depth int) {
+	glog.Infoln("ListRegistry", "path=", path, "depth=", depth)
+
+	if depth < 1 {
+		depth = 1
+	}
+	result, err := this.registry.ListEntries(c, path, depth)
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = this.engine.MarshalJSON(req, result, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) create_registry_entry(c Context, resp http.ResponseWriter, req *http.Request,
+	change *RegistryEntry, ephemeral, sequential bool, lease string) {
+
+	result, err := this.registry.CreateEntry(c, change.Path, []byte(change.Value), ephemeral, sequential, lease)
+	switch {
+	case err == ErrLeaseRequired:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "lease-not-found", http.StatusNotFound)
+		return
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "conflict", http.StatusConflict)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", result.Version))
+	err = this.engine.MarshalJSON(req, result, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func is_txn_error(err error) bool {
+	_, is := err.(*RegistryTxnError)
+	return is
+}
+
+func (this *Api) RegistryTransaction(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	txn := Methods[RegistryTransaction].RequestBody(req).(*RegistryTxn)
+	err := this.engine.UnmarshalJSON(req, txn)
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+
+	c := this.CreateServiceContext(context, req)
+	for _, op := range txn.Ops {
+		access := RegistryAccessUpdate
+		if op.Op == RegistryTxnCheck {
+			access = RegistryAccessRead
+		}
+		if !this.registry_access(c, resp, req, op.Path, access) {
+			return
+		}
+	}
+
+	result, err := this.registry.Transaction(c, txn)
+	switch {
+	case err == ErrBadTxn:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	case is_txn_error(err):
+		this.write_error(resp, req, err, http.StatusConflict)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = this.engine.MarshalJSON(req, result, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) GrantRegistryLease(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	request := Methods[GrantRegistryLease].RequestBody(req).(*RegistryLease)
+	err := this.engine.UnmarshalJSON(req, request)
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+
+	c := this.CreateServiceContext(context, req)
+	result, err := this.registry.GrantLease(c, time.Duration(request.Ttl)*time.Second)
+	switch {
+	case err == ErrBadLeaseTtl:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	case err == ErrTooManyLeases:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	this.write_lease(resp, req, result)
+}
+
+func (this *Api) KeepAliveRegistryLease(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	result, err := this.registry.KeepAliveLease(c, c.UrlParameter("lease"))
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	this.write_lease(resp, req, result)
+}
+
+func (this *Api) RevokeRegistryLease(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	err := this.registry.RevokeLease(c, c.UrlParameter("lease"))
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) write_lease(resp http.ResponseWriter, req *http.Request, lease *RegistryLease) {
+	err := this.engine.MarshalJSON(req, lease, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+const tar_content_type = "application/x-tar"
+
+func (this *Api) ExportRegistry(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	path := "/" + c.UrlParameter("path")
+	if !this.registry_access(c, resp, req, path, RegistryAccessRead) {
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[ExportRegistry].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	format := queries["format"].(string)
+	if format != "json" && format != "tar" {
+		this.engine.HandleError(resp, req, "bad-format", http.StatusBadRequest)
+		return
+	}
+
+	glog.Infoln("ExportRegistry", "path=", path, "format=", format)
+
+	snapshot, err := this.registry.ExportEntries(c, path)
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "tar" {
+		resp.Header().Set("Content-Type", tar_content_type)
+		if err := snapshot.WriteTar(resp); err != nil {
+			glog.Warningln("Err=", err)
+		}
+		return
+	}
+	err = this.engine.MarshalJSON(req, snapshot, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) ImportRegistry(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	path := "/" + c.UrlParameter("path")
+	if !this.registry_access(c, resp, req, path, RegistryAccessAdmin) {
+		return
+	}
+
+	defer req.Body.Close()
+	buff, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-request", http.StatusBadRequest)
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[ImportRegistry].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	format := queries["format"].(string)
+	if format == "" && strings.HasPrefix(req.Header.Get("Content-Type"), tar_content_type) {
+		format = "tar"
+	}
+
+	glog.Infoln("ImportRegistry", "path=", path, "format=", format)
+
+	snapshot := Methods[ImportRegistry].RequestBody(req).(*RegistrySnapshot)
+	switch format {
+	case "tar":
+		snapshot, err = ReadRegistrySnapshotTar(bytes.NewReader(buff))
+	case "", "json":
+		err = json.Unmarshal(buff, snapshot)
+	default:
+		this.engine.HandleError(resp, req, "bad-format", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-snapshot", http.StatusBadRequest)
+		return
+	}
+
+	result, err := this.registry.ImportEntries(c, path, snapshot, queries["mode"].(string), queries["dry_run"].(bool))
+	switch {
+	case err == ErrForbidden:
+		this.engine.HandleError(resp, req, "forbidden", http.StatusForbidden)
+		return
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "conflict", http.StatusConflict)
+		return
+	case err == ErrBadSnapshot, err == ErrBadImportMode:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = this.engine.MarshalJSON(req, result, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) WatchRegistry(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	path := "/" + c.UrlParameter("path")
+	if !this.registry_access(c, resp, req, path, RegistryAccessRead) {
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[WatchRegistry].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+
+	stop := make(chan bool)
+	events, err := this.registry.WatchEntries(c, path, queries["recursive"].(bool), stop)
+	switch {
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "watch-registry-fails", http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		glog.Infoln("ERROR", err)
+		close(stop)
+		return
+	}
+
+	// Incoming messages are ignored.  The watch stops when the client goes away.
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				conn.Close()
+				close(stop)
+				break
+			}
+		}
+	}()
+
+	for event := range events {
+		message, err := json.Marshal(event)
+		if err != nil {
+			glog.Warningln("ERROR Mashal:", err)
+			continue
+		}
+		err = conn.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			report_error(conn, err, "ws write error")
+			conn.Close()
+			return
+		}
+	}
+	conn.Close()
+	glog.Infoln("Completed")
+}
+
+func (this *Api) SearchRegistry(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	path := "/" + c.UrlParameter("path")
+	if !this.registry_access(c, resp, req, path, RegistryAccessRead) {
+		return
+	}
+
+	queries, err := this.engine.GetUrlQueries(req, Methods[SearchRegistry].UrlQueries)
+	if err != nil {
+		this.engine.HandleError(resp, req, "error-bad-request", http.StatusBadRequest)
+		return
+	}
+	search := &RegistrySearch{
+		Key:        queries["key"].(string),
+		Value:      queries["value"].(string),
+		ValueRegex: queries["value_regex"].(string),
+		Depth:      queries["depth"].(int),
+		Limit:      queries["limit"].(int),
+	}
+
+	glog.Infoln("SearchRegistry", "path=", path, "search=", search)
+
+	result, err := this.registry.SearchEntries(c, path, search)
+	switch {
+	case err == ErrBadSearch:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	case err == ErrNotFound:
+		this.engine.HandleError(resp, req, "not-found", http.StatusNotFound)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = this.engine.MarshalJSON(req, result, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) GetRegistryAcl(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	c := this.CreateServiceContext(context, req)
+	acl, rev, err := this.registry.GetAcl(c)
+	if err != nil {
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", rev))
+	err = this.engine.MarshalJSON(req, acl, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed-result", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *Api) UpdateRegistryAcl(context auth.Context, resp http.ResponseWriter, req *http.Request) {
+	acl := Methods[UpdateRegistryAcl].RequestBody(req).(*RegistryAcl)
+	err := this.engine.UnmarshalJSON(req, acl)
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-json", http.StatusBadRequest)
+		return
+	}
+
+	c := this.CreateServiceContext(context, req)
+	rev, err := strconv.Atoi(req.Header.Get("X-Dash-Version"))
+	if err != nil {
+		glog.Warningln("Err=", err)
+		this.engine.HandleError(resp, req, "bad-version", http.StatusBadRequest)
+		return
+	}
+	new_rev, err := this.registry.SaveAcl(c, acl, Revision(rev))
+	switch {
+	case err == ErrBadAclRule:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	case err == ErrConflict:
+		this.engine.HandleError(resp, req, "conflict", http.StatusConflict)
+		return
+	case err != nil:
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("X-Dash-Version", fmt.Sprintf("%d", new_rev))
+}
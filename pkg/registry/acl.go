@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"path/filepath"
+	"strings"
+)
+
+// Redpill keeps its own records, like the domains and their members, below this node.  None
+// of it is reachable with the registry entry api.
+const reserved_root = "/_redpill"
+
+// The rules are kept as json in this node.  It is managed through GetAcl and SaveAcl only.
+const acl_path = reserved_root + "/registry-acl"
+
+var access_levels = map[string]int{
+	RegistryAccessRead:   1,
+	RegistryAccessUpdate: 2,
+	RegistryAccessAdmin:  3,
+}
+
+// True if the path is the prefix or is below it
+func under(prefix, path string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func check_acl(acl *RegistryAcl) error {
+	for _, rule := range acl.Rules {
+		switch {
+		case !strings.HasPrefix(rule.Prefix, "/"), filepath.Clean(rule.Prefix) != rule.Prefix:
+			return ErrBadAclRule
+		case rule.User != "" && rule.Group != "":
+			return ErrBadAclRule
+		case access_levels[rule.Access] == 0:
+			return ErrBadAclRule
+		}
+	}
+	return nil
+}
+
+func applies(rule RegistryAclRule, user string, groups []string) bool {
+	switch {
+	case rule.User == "" && rule.Group == "":
+		return true
+	case rule.User != "":
+		return rule.User == user
+	}
+	for _, g := range groups {
+		if g == rule.Group {
+			return true
+		}
+	}
+	return false
+}
+
+// The access the user has to the path, from the rules with the longest prefix of the path.
+// Covered is false if no rule is for the path or any of its parents.
+func acl_access(acl *RegistryAcl, user string, groups []string, path string) (covered bool, access string) {
+	longest := ""
+	for _, rule := range acl.Rules {
+		if under(rule.Prefix, path) && len(rule.Prefix) > len(longest) {
+			longest = rule.Prefix
+		}
+	}
+	if longest == "" {
+		return false, ""
+	}
+	for _, rule := range acl.Rules {
+		if rule.Prefix == longest && applies(rule, user, groups) &&
+			access_levels[rule.Access] > access_levels[access] {
+			access = rule.Access
+		}
+	}
+	return true, access
+}
+
+// RegistryService
+func (this *Service) GetAcl(c Context) (*RegistryAcl, Revision, error) {
+	glog.Infoln("GetAcl:", c.UserId())
+	acl := &RegistryAcl{Rules: []RegistryAclRule{}}
+	zn, err := this.conn.Get(acl_path)
+	switch {
+	case err == kv.ErrNotExist:
+		return acl, Revision(0), nil
+	case err != nil:
+		return nil, Revision(0), err
+	}
+	if err := json.Unmarshal(zn.Value, acl); err != nil {
+		return nil, Revision(0), err
+	}
+	return acl, Revision(zn.Version), nil
+}
+
+// RegistryService
+func (this *Service) SaveAcl(c Context, acl *RegistryAcl, rev Revision) (Revision, error) {
+	glog.Infoln("SaveAcl:", c.UserId(), "Rules=", len(acl.Rules), "Rev=", rev)
+	if err := check_acl(acl); err != nil {
+		return Revision(0), err
+	}
+	value, err := json.Marshal(acl)
+	if err != nil {
+		return Revision(0), err
+	}
+	return this.UpdateEntry(c, acl_path, value, rev)
+}
+
+// True if the user may have the access to the key under the rules.  Admin access is used for
+// operations on whole subtrees, which must not reach the reserved nodes from one of their
+// parents.
+func has_access(acl *RegistryAcl, c Context, key, access string) bool {
+	switch {
+	case under(reserved_root, key):
+		return false
+	case access == RegistryAccessAdmin && under(key, reserved_root):
+		return false
+	}
+	covered, granted := acl_access(acl, c.UserId(), c.Groups(), key)
+	return !covered || access_levels[granted] >= access_levels[access]
+}
+
+// The nodes of a subtree, sorted by path, without those the user cannot read and those below
+// them.  The reserved nodes are never among them.
+func readable(acl *RegistryAcl, c Context, nodes []*kv.Node) []*kv.Node {
+	list := []*kv.Node{}
+	denied := []string{}
+next:
+	for _, n := range nodes {
+		for _, d := range denied {
+			if under(d, n.GetPath()) {
+				continue next
+			}
+		}
+		if !has_access(acl, c, n.GetPath(), RegistryAccessRead) {
+			denied = append(denied, n.GetPath())
+			continue
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+// RegistryService
+//
+// Returns ErrForbidden if the user does not have the access asked for.
+func (this *Service) CheckAccess(c Context, key, access string) error {
+	if under(reserved_root, key) {
+		return ErrForbidden
+	}
+	acl, _, err := this.GetAcl(c)
+	if err != nil {
+		return err
+	}
+	if !has_access(acl, c, key, access) {
+		glog.Infoln("CheckAccess:", c.UserId(), "Key=", key, "Access=", access, "Forbidden")
+		return ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package registry
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type AclTests struct{}
+
+var _ = Suite(&AclTests{})
+
+func (suite *AclTests) TestUnder(c *C) {
+	c.Assert(under("/", "/a"), Equals, true)
+	c.Assert(under("/a", "/a"), Equals, true)
+	c.Assert(under("/a", "/a/b"), Equals, true)
+	c.Assert(under("/a", "/ab"), Equals, false)
+	c.Assert(under("/a/b", "/a"), Equals, false)
+}
+
+func (suite *AclTests) TestCheckAcl(c *C) {
+	c.Assert(check_acl(&RegistryAcl{Rules: []RegistryAclRule{
+		{Prefix: "/", Access: RegistryAccessRead},
+		{Prefix: "/prod", Group: "ops", Access: RegistryAccessAdmin},
+	}}), Equals, nil)
+
+	for _, bad := range []RegistryAclRule{
+		{Prefix: "prod", Access: RegistryAccessRead},
+		{Prefix: "/prod/", Access: RegistryAccessRead},
+		{Prefix: "/prod", Access: "write"},
+		{Prefix: "/prod", User: "u", Group: "g", Access: RegistryAccessRead},
+	} {
+		c.Assert(check_acl(&RegistryAcl{Rules: []RegistryAclRule{bad}}), Equals, ErrBadAclRule)
+	}
+}
+
+func (suite *AclTests) TestAccess(c *C) {
+	acl := &RegistryAcl{Rules: []RegistryAclRule{
+		{Prefix: "/", Access: RegistryAccessUpdate},
+		{Prefix: "/production.blinker.com", Access: RegistryAccessRead},
+		{Prefix: "/production.blinker.com", Group: "ops", Access: RegistryAccessUpdate},
+		{Prefix: "/production.blinker.com", User: "root", Access: RegistryAccessAdmin},
+		{Prefix: "/production.blinker.com/secrets", User: "root", Access: RegistryAccessAdmin},
+	}}
+
+	check := func(user string, groups []string, path string, covered bool, access string) {
+		cov, a := acl_access(acl, user, groups, path)
+		c.Assert(cov, Equals, covered)
+		c.Assert(a, Equals, access)
+	}
+
+	check("dev", nil, "/dev.blinker.com/x", true, RegistryAccessUpdate)
+	check("dev", nil, "/production.blinker.com/x", true, RegistryAccessRead)
+	check("dev", []string{"ops"}, "/production.blinker.com/x", true, RegistryAccessUpdate)
+	check("root", []string{"ops"}, "/production.blinker.com", true, RegistryAccessAdmin)
+
+	// The longest prefix decides, even if it grants less
+	check("dev", []string{"ops"}, "/production.blinker.com/secrets/a", true, "")
+	check("root", nil, "/production.blinker.com/secrets/a", true, RegistryAccessAdmin)
+
+	cov, _ := acl_access(&RegistryAcl{}, "dev", nil, "/a")
+	c.Assert(cov, Equals, false)
+}
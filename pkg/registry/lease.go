@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"time"
+)
+
+// A lease holds its own session.  When the lease expires or is revoked the session is closed
+// and the store removes the ephemeral nodes created in it.  Leases
+// are kept in memory, so a lease lives only as long as the server that granted it.  In
+// ZooKeeper each session is a connection, so the store bounds how many leases can be held.
+type lease struct {
+	id      string
+	conn    kv.Store
+	ttl     time.Duration
+	expires time.Time
+	timer   *time.Timer
+
+	// Id of the session, known once an ephemeral node has been created with the lease
+	session int64
+}
+
+func (this *lease) info() *RegistryLease {
+	return &RegistryLease{
+		Id:      this.id,
+		Ttl:     int(this.ttl / time.Second),
+		Expires: this.expires.Unix(),
+	}
+}
+
+func new_lease_id() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// RegistryService
+func (this *Service) GrantLease(c Context, ttl time.Duration) (*RegistryLease, error) {
+	glog.Infoln("GrantLease:", c.UserId(), "Ttl=", ttl)
+	if ttl < time.Second {
+		return nil, ErrBadLeaseTtl
+	}
+	id, err := new_lease_id()
+	if err != nil {
+		return nil, err
+	}
+	session, err := this.conn.Session()
+	switch {
+	case err == kv.ErrTooManySessions:
+		return nil, ErrTooManyLeases
+	case err != nil:
+		return nil, err
+	}
+	l := &lease{id: id, conn: session, ttl: ttl, expires: time.Now().Add(ttl)}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	l.timer = time.AfterFunc(ttl, func() { this.expire(id) })
+	this.leases[id] = l
+	return l.info(), nil
+}
+
+// RegistryService
+func (this *Service) KeepAliveLease(c Context, id string) (*RegistryLease, error) {
+	glog.Infoln("KeepAliveLease:", c.UserId(), "Lease=", id)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	l, has := this.leases[id]
+	if !has || !l.timer.Stop() {
+		// Expired, or expiring now
+		return nil, ErrNotFound
+	}
+	l.expires = time.Now().Add(l.ttl)
+	l.timer.Reset(l.ttl)
+	return l.info(), nil
+}
+
+// RegistryService
+func (this *Service) RevokeLease(c Context, id string) error {
+	glog.Infoln("RevokeLease:", c.UserId(), "Lease=", id)
+
+	this.lock.Lock()
+	l, has := this.leases[id]
+	if !has || !l.timer.Stop() {
+		this.lock.Unlock()
+		return ErrNotFound
+	}
+	delete(this.leases, id)
+	this.lock.Unlock()
+
+	return l.conn.Close()
+}
+
+func (this *Service) expire(id string) {
+	this.lock.Lock()
+	l, has := this.leases[id]
+	delete(this.leases, id)
+	this.lock.Unlock()
+
+	if has {
+		glog.Infoln("Lease expired:", id)
+		l.conn.Close()
+	}
+}
+
+func (this *Service) get_lease(id string) *lease {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.leases[id]
+}
+
+// The lease whose session owns an ephemeral node, if it was granted by us
+func (this *Service) lease_of(session int64) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for id, l := range this.leases {
+		if l.session == session {
+			return id
+		}
+	}
+	return ""
+}
+
+func (this *Service) set_session(l *lease, session int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	l.session = session
+}
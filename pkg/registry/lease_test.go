@@ -0,0 +1,88 @@
+package registry
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"time"
+)
+
+type LeaseTests struct{}
+
+var _ = Suite(&LeaseTests{})
+
+func (suite *LeaseTests) TestIsSequential(c *C) {
+	c.Assert(is_sequential("/a/member-0000000012"), Equals, true)
+	c.Assert(is_sequential("/0000000012"), Equals, true)
+	c.Assert(is_sequential("/a/member-12"), Equals, false)
+	c.Assert(is_sequential("/a/member-000000001x"), Equals, false)
+}
+
+func (suite *LeaseTests) TestLeases(c *C) {
+	store, err := kv.OpenBoltStore(filepath.Join(c.MkDir(), "lease.db"))
+	c.Assert(err, Equals, nil)
+	defer store.Close()
+
+	reg := NewService(store)
+	ctx := test_context("test")
+
+	_, err = reg.GrantLease(ctx, 0)
+	c.Assert(err, Equals, ErrBadLeaseTtl)
+
+	lease, err := reg.GrantLease(ctx, time.Hour)
+	c.Assert(err, Equals, nil)
+	c.Assert(lease.Ttl, Equals, 3600)
+
+	entry, err := reg.CreateEntry(ctx, "/services/a", []byte("a"), true, false, lease.Id)
+	c.Assert(err, Equals, nil)
+	c.Assert(entry.Lease, Equals, lease.Id)
+
+	kept, err := reg.KeepAliveLease(ctx, lease.Id)
+	c.Assert(err, Equals, nil)
+	c.Assert(kept.Id, Equals, lease.Id)
+
+	c.Assert(reg.RevokeLease(ctx, lease.Id), Equals, nil)
+	_, _, err = reg.GetEntry(ctx, "/services/a")
+	c.Assert(err, Equals, ErrNotFound)
+	c.Assert(reg.RevokeLease(ctx, lease.Id), Equals, ErrNotFound)
+	_, err = reg.KeepAliveLease(ctx, lease.Id)
+	c.Assert(err, Equals, ErrNotFound)
+
+	// Not kept alive
+	lease, err = reg.GrantLease(ctx, time.Second)
+	c.Assert(err, Equals, nil)
+	_, err = reg.CreateEntry(ctx, "/services/b", []byte("b"), true, false, lease.Id)
+	c.Assert(err, Equals, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err = reg.GetEntry(ctx, "/services/b"); err == ErrNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatal("Lease did not expire")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	_, err = reg.KeepAliveLease(ctx, lease.Id)
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+// A store with no session left
+type no_sessions_store struct {
+	kv.Store
+}
+
+func (this no_sessions_store) Session() (kv.Store, error) {
+	return nil, kv.ErrTooManySessions
+}
+
+func (suite *LeaseTests) TestTooManyLeases(c *C) {
+	store, err := kv.OpenBoltStore(filepath.Join(c.MkDir(), "lease.db"))
+	c.Assert(err, Equals, nil)
+	defer store.Close()
+
+	reg := NewService(no_sessions_store{store})
+	_, err = reg.GrantLease(test_context("test"), time.Hour)
+	c.Assert(err, Equals, ErrTooManyLeases)
+}
@@ -1,9 +1,13 @@
 package registry
 
 import (
+	"fmt"
 	"github.com/golang/glog"
 	. "github.com/infradash/redpill/pkg/api"
-	"github.com/qorio/maestro/pkg/zk"
+	"github.com/infradash/redpill/pkg/kv"
+	"path/filepath"
+	"sort"
+	"sync"
 )
 
 const (
@@ -11,40 +15,150 @@ const (
 )
 
 type Service struct {
-	conn zk.ZK
+	conn kv.Store
+
+	// Each lease has its own session, so that its ephemeral nodes go away with it
+	leases map[string]*lease
+	lock   sync.Mutex
 }
 
-func NewService(pool func() zk.ZK) RegistryService {
+func NewService(store kv.Store) RegistryService {
 	s := new(Service)
-	s.conn = pool()
+	s.conn = store
+	s.leases = map[string]*lease{}
 	return s
 }
 
-func (this *Service) load_and_check(key string, rev Revision) (*zk.Node, error) {
+func (this *Service) load_and_check(key string, rev Revision) (*kv.Node, error) {
 	zn, err := this.conn.Get(key)
 	switch {
-	case err == zk.ErrNotExist:
+	case err == kv.ErrNotExist:
 		return nil, ErrNotFound
 	case err != nil:
 		return nil, err
 	}
-	if zn.Stats.Version != int32(rev) {
+	if zn.Version != int32(rev) {
 		return nil, ErrConflict
 	}
 	return zn, nil
 }
 
+// The entry was changed, created or deleted by someone else after it was checked
+func write_err(err error) error {
+	switch err {
+	case kv.ErrBadVersion, kv.ErrNodeExists, kv.ErrNotExist:
+		return ErrConflict
+	default:
+		return err
+	}
+}
+
 // RegistryService
 func (this *Service) GetEntry(c Context, key string) ([]byte, Revision, error) {
 	glog.Infoln("GetEntry:", c.UserId(), "Key=", key)
 	zn, err := this.conn.Get(key)
 	switch {
-	case err == zk.ErrNotExist:
+	case err == kv.ErrNotExist:
 		return nil, Revision(0), ErrNotFound
 	case err != nil:
 		return nil, Revision(0), err
 	}
-	return zn.Value, Revision(zn.Stats.Version), nil
+	return zn.Value, Revision(zn.Version), nil
+}
+
+// ZK does not keep a flag for sequential nodes.  Their names end with the 10 digit counter
+// that the server appends.
+func is_sequential(path string) bool {
+	name := filepath.Base(path)
+	if len(name) < 10 {
+		return false
+	}
+	for _, r := range name[len(name)-10:] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *Service) registry_entry(zn *kv.Node) *RegistryEntry {
+	entry := &RegistryEntry{
+		Path:       zn.GetPath(),
+		Value:      zn.GetValueString(),
+		Version:    Revision(zn.Version),
+		Sequential: is_sequential(zn.GetPath()),
+	}
+	if owner := zn.Owner; owner != 0 {
+		entry.Ephemeral = true
+		entry.Owner = fmt.Sprintf("%x", owner)
+		entry.Lease = this.lease_of(owner)
+	}
+	return entry
+}
+
+// RegistryService
+func (this *Service) DescribeEntry(c Context, key string) (*RegistryEntry, error) {
+	glog.Infoln("DescribeEntry:", c.UserId(), "Key=", key)
+	zn, err := this.conn.Get(key)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	return this.registry_entry(zn), nil
+}
+
+// RegistryService
+//
+// Ephemeral entries are created in the session of the lease and need one.  The parents are
+// created as persistent nodes if they are not there.
+func (this *Service) CreateEntry(c Context, key string, value []byte, ephemeral, sequential bool, leaseId string) (*RegistryEntry, error) {
+	glog.Infoln("CreateEntry:", c.UserId(), "Key=", key, "Ephemeral=", ephemeral, "Sequential=", sequential, "Lease=", leaseId)
+
+	conn := this.conn
+	var l *lease
+	if ephemeral {
+		if leaseId == "" {
+			return nil, ErrLeaseRequired
+		}
+		if l = this.get_lease(leaseId); l == nil {
+			return nil, ErrNotFound
+		}
+		conn = l.conn
+	}
+
+	var op kv.Op
+	switch {
+	case ephemeral && sequential:
+		op = kv.OpCreateEphemeralSequential(key, value)
+	case ephemeral:
+		op = kv.OpCreateEphemeral(key, value)
+	case sequential:
+		op = kv.OpCreateSequential(key, value)
+	default:
+		op = kv.OpCreate(key, value)
+	}
+
+	if err := this.ensure_parents(key); err != nil {
+		return nil, err
+	}
+	results, err := conn.Multi(op)
+	switch {
+	case err == kv.ErrNodeExists:
+		return nil, ErrConflict
+	case err != nil:
+		return nil, err
+	}
+
+	zn, err := conn.Get(results[0])
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		this.set_session(l, zn.Owner)
+	}
+	return this.registry_entry(zn), nil
 }
 
 // RegistryService
@@ -54,17 +168,17 @@ func (this *Service) UpdateEntry(c Context, key string, value []byte, rev Revisi
 	switch {
 
 	case err == nil:
-		err = zn.Set(value)
+		zn, err = this.conn.Set(key, value, zn.Version)
 		if err != nil {
-			return Revision(0), err
+			return Revision(0), write_err(err)
 		}
-		return Revision(zn.Stats.Version), nil
+		return Revision(zn.Version), nil
 	case err == ErrNotFound:
 		zn, err = this.conn.Create(key, value)
 		if err != nil {
-			return Revision(0), err
+			return Revision(0), write_err(err)
 		}
-		return Revision(zn.Stats.Version), nil
+		return Revision(zn.Version), nil
 	default:
 		return Revision(0), err
 	}
@@ -77,5 +191,75 @@ func (this *Service) DeleteEntry(c Context, key string, rev Revision) error {
 	if err != nil {
 		return err
 	}
-	return zn.Delete()
+	return write_err(this.conn.Delete(key, zn.Version))
+}
+
+func registry_node(zn *kv.Node) *RegistryNode {
+	node := &RegistryNode{
+		Path:        zn.GetPath(),
+		Name:        zn.GetBasename(),
+		Value:       zn.GetValueString(),
+		Version:     Revision(zn.Version),
+		NumChildren: zn.NumChildren,
+	}
+	return node
+}
+
+// RegistryService
+//
+// The subtree is read a level at a time so that nothing below the depth is read.  Entries the
+// user cannot read are left out, with everything below them.
+func (this *Service) ListEntries(c Context, key string, depth int) (*RegistryNode, error) {
+	glog.Infoln("ListEntries:", c.UserId(), "Key=", key, "Depth=", depth)
+	zn, err := this.conn.Get(key)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	acl, _, err := this.GetAcl(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if depth < 1 {
+		depth = 1
+	}
+	root := registry_node(zn)
+	tree := map[string]*RegistryNode{key: root}
+	level := []string{key}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		next := []string{}
+		for _, parent := range level {
+			children, err := this.conn.Children(parent)
+			switch {
+			case err == kv.ErrNotExist:
+				// Deleted since we saw it
+				continue
+			case err != nil:
+				return nil, err
+			}
+			sort.Sort(by_path(children))
+			for _, n := range children {
+				if !has_access(acl, c, n.GetPath(), RegistryAccessRead) {
+					continue
+				}
+				node := registry_node(n)
+				tree[parent].Children = append(tree[parent].Children, node)
+				tree[n.GetPath()] = node
+				if n.NumChildren > 0 {
+					next = append(next, n.GetPath())
+				}
+			}
+		}
+		level = next
+	}
+	return root, nil
 }
+
+type by_path []*kv.Node
+
+func (p by_path) Len() int           { return len(p) }
+func (p by_path) Less(i, j int) bool { return p[i].GetPath() < p[j].GetPath() }
+func (p by_path) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -1,9 +1,12 @@
 package registry
 
 import (
+	"fmt"
 	. "github.com/infradash/redpill/pkg/api"
-	"github.com/qorio/maestro/pkg/zk"
+	"github.com/infradash/redpill/pkg/kv"
 	. "gopkg.in/check.v1"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -15,35 +18,64 @@ type test_context string
 func (t test_context) UserId() string {
 	return string(t)
 }
+func (t test_context) Groups() []string {
+	return nil
+}
 func (t test_context) UrlParameter(k string) string {
 	return ""
 }
 
 type RegistryTests struct {
-	zc zk.ZK
-	c  Context
+	store kv.Store
+	c     Context
 }
 
 var _ = Suite(&RegistryTests{})
 
 func (suite *RegistryTests) SetUpSuite(c *C) {
 	c.Log("Connecting to zk")
-	zc, err := zk.Connect([]string{"localhost:2181"}, 5*time.Second)
+	store, err := kv.NewZkStore([]string{"localhost:2181"}, 5*time.Second)
 	c.Assert(err, Equals, nil)
-	suite.zc = zc
-
-	zk.CreateOrSet(zc, "/unit-test/registry/test/object1", "object1")
-	zk.CreateOrSet(zc, "/unit-test/registry/test/object2", "object2")
-	zk.CreateOrSet(zc, "/unit-test/registry/test/object3", "object3")
+	suite.setup(c, store)
+}
 
+func (suite *RegistryTests) setup(c *C, store kv.Store) {
+	suite.store = store
 	suite.c = test_context("test")
-	return
+
+	set(c, store, "/unit-test/registry/test/object1", "object1")
+	set(c, store, "/unit-test/registry/test/object2", "object2")
+	set(c, store, "/unit-test/registry/test/object3", "object3")
 }
 
-func (suite *RegistryTests) TestGetEntry(c *C) {
-	z := func() zk.ZK { return suite.zc }
+// The same tests with a BoltDB store
+type BoltRegistryTests struct {
+	RegistryTests
+}
+
+var _ = Suite(&BoltRegistryTests{})
+
+func (suite *BoltRegistryTests) SetUpSuite(c *C) {
+	store, err := kv.OpenBoltStore(filepath.Join(c.MkDir(), "registry.db"))
+	c.Assert(err, Equals, nil)
+	suite.setup(c, store)
+}
 
-	reg := NewService(z)
+func (suite *BoltRegistryTests) TearDownSuite(c *C) {
+	suite.store.Close()
+}
+
+// Creates or sets the node
+func set(c *C, store kv.Store, path, value string) {
+	_, err := store.Create(path, []byte(value))
+	if err == kv.ErrNodeExists {
+		_, err = store.Set(path, []byte(value), -1)
+	}
+	c.Assert(err, Equals, nil)
+}
+
+func (suite *RegistryTests) TestGetEntry(c *C) {
+	reg := NewService(suite.store)
 	c.Log(reg)
 
 	value, rev, err := reg.GetEntry(suite.c, "/unit-test/registry/test/object1")
@@ -53,9 +85,7 @@ func (suite *RegistryTests) TestGetEntry(c *C) {
 }
 
 func (suite *RegistryTests) TestUpdateEntry(c *C) {
-	z := func() zk.ZK { return suite.zc }
-
-	reg := NewService(z)
+	reg := NewService(suite.store)
 	c.Log(reg)
 
 	_, rev, err := reg.GetEntry(suite.c, "/unit-test/registry/test/object1")
@@ -72,3 +102,504 @@ func (suite *RegistryTests) TestUpdateEntry(c *C) {
 	value, rev, err := reg.GetEntry(suite.c, "/unit-test/registry/test/object1")
 	c.Assert(value, DeepEquals, []byte("new-value"))
 }
+
+// Changes the node each time it is read, as if someone else wrote it right after
+type racing_store struct {
+	kv.Store
+}
+
+func (this *racing_store) Get(path string) (*kv.Node, error) {
+	zn, err := this.Store.Get(path)
+	if err == nil {
+		this.Store.Set(path, zn.Value, -1)
+	}
+	return zn, err
+}
+
+// Written by someone else between the check and the write
+func (suite *RegistryTests) TestUpdateEntryRace(c *C) {
+	reg := NewService(&racing_store{suite.store})
+	key := fmt.Sprintf("/unit-test/registry/race-%d", time.Now().UnixNano())
+	set(c, suite.store, key, "v")
+
+	_, err := reg.UpdateEntry(suite.c, key, []byte("v2"), 0)
+	c.Assert(err, Equals, ErrConflict)
+	err = reg.DeleteEntry(suite.c, key, 2)
+	c.Assert(err, Equals, ErrConflict)
+}
+
+func (suite *RegistryTests) TestListEntries(c *C) {
+	reg := NewService(suite.store)
+
+	set(c, suite.store, "/unit-test/registry/tree/a/a1", "a1")
+	set(c, suite.store, "/unit-test/registry/tree/a/a2/deep", "deep")
+	set(c, suite.store, "/unit-test/registry/tree/b", "b")
+
+	list, err := reg.ListEntries(suite.c, "/unit-test/registry/tree", 1)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list.Children), Equals, 2)
+	c.Assert(list.Children[0].Name, Equals, "a")
+	c.Assert(list.Children[0].NumChildren, Equals, int32(2))
+	c.Assert(list.Children[0].Children, IsNil)
+	c.Assert(list.Children[1].Value, Equals, "b")
+
+	tree, err := reg.ListEntries(suite.c, "/unit-test/registry/tree", 2)
+	c.Assert(err, Equals, nil)
+	a := tree.Children[0]
+	c.Assert(len(a.Children), Equals, 2)
+	c.Assert(a.Children[0].Path, Equals, "/unit-test/registry/tree/a/a1")
+	c.Assert(a.Children[0].Value, Equals, "a1")
+	c.Assert(a.Children[1].NumChildren, Equals, int32(1))
+	c.Assert(a.Children[1].Children, IsNil)
+
+	_, err = reg.ListEntries(suite.c, "/unit-test/registry/no-such-path", 1)
+	c.Assert(err, Equals, ErrNotFound)
+
+	// Nothing below the depth is read
+	store := &listing_store{Store: suite.store, listed: map[string]bool{}}
+	_, err = NewService(store).ListEntries(suite.c, "/unit-test/registry/tree", 2)
+	c.Assert(err, Equals, nil)
+	c.Assert(store.listed, DeepEquals, map[string]bool{
+		"/unit-test/registry/tree":   true,
+		"/unit-test/registry/tree/a": true,
+	})
+}
+
+// Records the nodes whose children are read
+type listing_store struct {
+	kv.Store
+	listed map[string]bool
+}
+
+func (this *listing_store) Children(path string) ([]*kv.Node, error) {
+	this.listed[path] = true
+	return this.Store.Children(path)
+}
+
+func (suite *RegistryTests) TestExportImport(c *C) {
+	reg := NewService(suite.store)
+
+	set(c, suite.store, "/unit-test/registry/export/a", "a")
+	set(c, suite.store, "/unit-test/registry/export/a/b", "b")
+
+	snapshot, err := reg.ExportEntries(suite.c, "/unit-test/registry/export")
+	c.Assert(err, Equals, nil)
+	c.Assert(len(snapshot.Entries), Equals, 3)
+	c.Assert(snapshot.Entries[2].Path, Equals, "/a/b")
+
+	target := fmt.Sprintf("/unit-test/registry/import-%d", time.Now().UnixNano())
+	result, err := reg.ImportEntries(suite.c, target, snapshot, RegistryImportSkip, true)
+	c.Assert(err, Equals, nil)
+	c.Assert(result.Created, DeepEquals, []string{target, target + "/a", target + "/a/b"})
+	_, _, err = reg.GetEntry(suite.c, target)
+	c.Assert(err, Equals, ErrNotFound)
+
+	result, err = reg.ImportEntries(suite.c, target, snapshot, RegistryImportSkip, false)
+	c.Assert(err, Equals, nil)
+	value, _, err := reg.GetEntry(suite.c, target+"/a/b")
+	c.Assert(err, Equals, nil)
+	c.Assert(string(value), Equals, "b")
+
+	snapshot.Entries[2].Value = "b2"
+	result, err = reg.ImportEntries(suite.c, target, snapshot, RegistryImportSkip, false)
+	c.Assert(err, Equals, nil)
+	c.Assert(result.Skipped, DeepEquals, []string{target + "/a/b"})
+	c.Assert(result.Unchanged, DeepEquals, []string{target, target + "/a"})
+
+	result, err = reg.ImportEntries(suite.c, target, snapshot, RegistryImportOverwrite, false)
+	c.Assert(err, Equals, nil)
+	c.Assert(result.Updated, DeepEquals, []string{target + "/a/b"})
+	value, _, err = reg.GetEntry(suite.c, target+"/a/b")
+	c.Assert(string(value), Equals, "b2")
+}
+
+func (suite *RegistryTests) TestWatchEntries(c *C) {
+	reg := NewService(suite.store)
+
+	root := fmt.Sprintf("/unit-test/registry/watch-%d", time.Now().UnixNano())
+	_, err := reg.UpdateEntry(suite.c, root, []byte("v1"), 0)
+	c.Assert(err, Equals, nil)
+
+	next := func(events <-chan RegistryChangeEvent) RegistryChangeEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			c.Fatal("No events")
+		}
+		return RegistryChangeEvent{}
+	}
+
+	stop := make(chan bool)
+	events, err := reg.WatchEntries(suite.c, root, true, stop)
+	c.Assert(err, Equals, nil)
+	c.Assert(next(events), DeepEquals, RegistryChangeEvent{Path: root, Action: RegistryEventCurrent, Value: "v1"})
+
+	rev, err := reg.UpdateEntry(suite.c, root, []byte("v2"), 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(next(events), DeepEquals, RegistryChangeEvent{Path: root, Action: RegistryEventChange, Value: "v2", Version: rev})
+
+	// Descendants are watched with recursive
+	_, err = reg.UpdateEntry(suite.c, root+"/a", []byte("a"), 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(next(events).Action, Equals, RegistryEventChildren)
+	c.Assert(next(events), DeepEquals, RegistryChangeEvent{Path: root + "/a", Action: RegistryEventCreate, Value: "a"})
+
+	err = reg.DeleteEntry(suite.c, root+"/a", 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(next(events).Action, Equals, RegistryEventChildren)
+	c.Assert(next(events), DeepEquals, RegistryChangeEvent{Path: root + "/a", Action: RegistryEventDelete})
+
+	err = reg.DeleteEntry(suite.c, root, rev)
+	c.Assert(err, Equals, nil)
+	c.Assert(next(events), DeepEquals, RegistryChangeEvent{Path: root, Action: RegistryEventDelete})
+
+	close(stop)
+	for _ = range events {
+	}
+}
+
+// Counts the watches set
+type watching_store struct {
+	kv.Store
+	lock sync.Mutex
+	set  int
+}
+
+func (this *watching_store) Watch(path string, f func()) (chan<- bool, error) {
+	this.lock.Lock()
+	this.set++
+	this.lock.Unlock()
+	return this.Store.Watch(path, f)
+}
+
+func (this *watching_store) WatchChildren(path string, f func()) (chan<- bool, error) {
+	this.lock.Lock()
+	this.set++
+	this.lock.Unlock()
+	return this.Store.WatchChildren(path, f)
+}
+
+// Only the watch that fired is set again
+func (suite *RegistryTests) TestWatchSetsFiredOnly(c *C) {
+	store := &watching_store{Store: suite.store}
+	reg := NewService(store)
+
+	root := fmt.Sprintf("/unit-test/registry/watch-fired-%d", time.Now().UnixNano())
+	set(c, suite.store, root+"/a", "a")
+
+	stop := make(chan bool)
+	events, err := reg.WatchEntries(suite.c, root, true, stop)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(next_events(c, events, 2)), Equals, 2)
+
+	for i := 0; i < 3; i++ {
+		set(c, suite.store, root+"/a", fmt.Sprintf("a%d", i))
+		event := next_events(c, events, 1)[0]
+		c.Assert(event.Path, Equals, root+"/a")
+		c.Assert(event.Action, Equals, RegistryEventChange)
+	}
+	store.lock.Lock()
+	c.Assert(store.set, Equals, 4+3)
+	store.lock.Unlock()
+
+	close(stop)
+	for _ = range events {
+	}
+}
+
+func next_events(c *C, events <-chan RegistryChangeEvent, n int) []RegistryChangeEvent {
+	list := []RegistryChangeEvent{}
+	for len(list) < n {
+		select {
+		case event := <-events:
+			list = append(list, event)
+		case <-time.After(5 * time.Second):
+			c.Fatal("No events")
+		}
+	}
+	return list
+}
+
+func (suite *RegistryTests) TestEphemeralAndSequential(c *C) {
+	reg := NewService(suite.store)
+
+	root := fmt.Sprintf("/unit-test/registry/lease-%d", time.Now().UnixNano())
+
+	entry, err := reg.CreateEntry(suite.c, root+"/member-", []byte("m"), false, true, "")
+	c.Assert(err, Equals, nil)
+	c.Assert(entry.Path, Equals, root+"/member-0000000000")
+	c.Assert(entry.Sequential, Equals, true)
+	c.Assert(entry.Ephemeral, Equals, false)
+
+	_, err = reg.CreateEntry(suite.c, root+"/live", []byte("x"), true, false, "")
+	c.Assert(err, Equals, ErrLeaseRequired)
+
+	lease, err := reg.GrantLease(suite.c, 10*time.Second)
+	c.Assert(err, Equals, nil)
+
+	entry, err = reg.CreateEntry(suite.c, root+"/live", []byte("x"), true, false, lease.Id)
+	c.Assert(err, Equals, nil)
+	c.Assert(entry.Ephemeral, Equals, true)
+	c.Assert(entry.Lease, Equals, lease.Id)
+
+	described, err := reg.DescribeEntry(suite.c, root+"/live")
+	c.Assert(err, Equals, nil)
+	c.Assert(described, DeepEquals, entry)
+
+	c.Assert(reg.RevokeLease(suite.c, lease.Id), Equals, nil)
+	_, err = reg.DescribeEntry(suite.c, root+"/live")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (suite *RegistryTests) TestAcl(c *C) {
+	reg := NewService(suite.store)
+
+	acl, rev, err := reg.GetAcl(suite.c)
+	c.Assert(err, Equals, nil)
+	saved := *acl
+	defer func() {
+		_, rev, _ := reg.GetAcl(suite.c)
+		reg.SaveAcl(suite.c, &saved, rev)
+	}()
+
+	prefix := fmt.Sprintf("/unit-test/registry/acl-%d", time.Now().UnixNano())
+	_, err = reg.SaveAcl(suite.c, &RegistryAcl{Rules: []RegistryAclRule{{Prefix: "bad", Access: "read"}}}, rev)
+	c.Assert(err, Equals, ErrBadAclRule)
+
+	rev, err = reg.SaveAcl(suite.c, &RegistryAcl{Rules: []RegistryAclRule{
+		{Prefix: prefix, Access: RegistryAccessRead},
+		{Prefix: prefix, User: "test", Access: RegistryAccessUpdate},
+	}}, rev)
+	c.Assert(err, Equals, nil)
+
+	c.Assert(reg.CheckAccess(suite.c, prefix+"/a", RegistryAccessUpdate), Equals, nil)
+	c.Assert(reg.CheckAccess(suite.c, prefix+"/a", RegistryAccessAdmin), Equals, ErrForbidden)
+	c.Assert(reg.CheckAccess(test_context("other"), prefix+"/a", RegistryAccessRead), Equals, nil)
+	c.Assert(reg.CheckAccess(test_context("other"), prefix+"/a", RegistryAccessUpdate), Equals, ErrForbidden)
+	c.Assert(reg.CheckAccess(test_context("other"), "/unit-test/registry/other", RegistryAccessUpdate), Equals, nil)
+
+	// The rules are only reachable through the acl api, and redpill's own records not at all
+	c.Assert(reg.CheckAccess(suite.c, acl_path, RegistryAccessRead), Equals, ErrForbidden)
+	c.Assert(reg.CheckAccess(suite.c, "/", RegistryAccessAdmin), Equals, ErrForbidden)
+	c.Assert(reg.CheckAccess(suite.c, "/_redpill", RegistryAccessRead), Equals, ErrForbidden)
+	c.Assert(reg.CheckAccess(suite.c, "/_redpill/domain/blinker.com", RegistryAccessUpdate), Equals, ErrForbidden)
+	c.Assert(reg.CheckAccess(suite.c, "/_redpillx", RegistryAccessUpdate), Equals, nil)
+
+	_, err = reg.SaveAcl(suite.c, &RegistryAcl{}, rev-1)
+	c.Assert(err, Equals, ErrConflict)
+}
+
+// What a user cannot read is left out of lists, exports and watches of the subtrees above it
+func (suite *RegistryTests) TestAclSubtrees(c *C) {
+	reg := NewService(suite.store)
+
+	root := fmt.Sprintf("/unit-test/registry/acl-tree-%d", time.Now().UnixNano())
+	set(c, suite.store, root+"/public/a", "a")
+	set(c, suite.store, root+"/secret/b", "b")
+
+	acl, rev, err := reg.GetAcl(suite.c)
+	c.Assert(err, Equals, nil)
+	saved := *acl
+	defer func() {
+		_, rev, _ := reg.GetAcl(suite.c)
+		reg.SaveAcl(suite.c, &saved, rev)
+	}()
+	_, err = reg.SaveAcl(suite.c, &RegistryAcl{Rules: []RegistryAclRule{
+		{Prefix: root + "/secret", User: "test", Access: RegistryAccessUpdate},
+	}}, rev)
+	c.Assert(err, Equals, nil)
+	other := test_context("other")
+
+	list, err := reg.ListEntries(other, root, 3)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list.Children), Equals, 1)
+	c.Assert(list.Children[0].Name, Equals, "public")
+	list, err = reg.ListEntries(suite.c, root, 3)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(list.Children), Equals, 2)
+
+	// The reserved nodes are not in any subtree
+	list, err = reg.ListEntries(suite.c, "/", 3)
+	c.Assert(err, Equals, nil)
+	var paths func(n *RegistryNode) []string
+	paths = func(n *RegistryNode) []string {
+		p := []string{n.Path}
+		for _, child := range n.Children {
+			p = append(p, paths(child)...)
+		}
+		return p
+	}
+	for _, p := range paths(list) {
+		c.Assert(under(reserved_root, p), Equals, false)
+	}
+
+	snapshot, err := reg.ExportEntries(other, root)
+	c.Assert(err, Equals, nil)
+	exported := []string{}
+	for _, entry := range snapshot.Entries {
+		exported = append(exported, entry.Path)
+	}
+	c.Assert(exported, DeepEquals, []string{"/", "/public", "/public/a"})
+
+	stop := make(chan bool)
+	events, err := reg.WatchEntries(other, root, true, stop)
+	c.Assert(err, Equals, nil)
+	watched := []string{}
+	for len(watched) < 3 {
+		select {
+		case event := <-events:
+			watched = append(watched, event.Path)
+		case <-time.After(5 * time.Second):
+			c.Fatal("No events")
+		}
+	}
+	c.Assert(watched, DeepEquals, []string{root, root + "/public", root + "/public/a"})
+	close(stop)
+	for _ = range events {
+	}
+
+	// Every entry imported is checked, not just the root
+	snapshot = &RegistrySnapshot{Entries: []RegistryEntry{{Path: "/"}, {Path: "/secret"}, {Path: "/secret/c", Value: "c"}}}
+	_, err = reg.ImportEntries(other, root, snapshot, RegistryImportOverwrite, false)
+	c.Assert(err, Equals, ErrForbidden)
+	_, _, err = reg.GetEntry(suite.c, root+"/secret/c")
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = reg.ImportEntries(suite.c, root, snapshot, RegistryImportOverwrite, false)
+	c.Assert(err, Equals, nil)
+}
+
+func (suite *RegistryTests) TestSearch(c *C) {
+	reg := NewService(suite.store)
+
+	root := fmt.Sprintf("/unit-test/registry/search-%d", time.Now().UnixNano())
+	set(c, suite.store, root+"/web/host", "10.0.1.1")
+	set(c, suite.store, root+"/web/port", "8080")
+	set(c, suite.store, root+"/db/host", "10.0.2.1")
+	set(c, suite.store, root+"/db/port", "5432")
+	set(c, suite.store, root+"/db/replica/host", "10.0.2.2")
+	set(c, suite.store, root+"/secret/host", "10.0.3.1")
+
+	search_paths := func(ctx Context, search *RegistrySearch) ([]string, bool) {
+		result, err := reg.SearchEntries(ctx, root, search)
+		c.Assert(err, Equals, nil)
+		paths := []string{}
+		for _, entry := range result.Entries {
+			paths = append(paths, entry.Path)
+		}
+		return paths, result.Truncated
+	}
+
+	paths, truncated := search_paths(suite.c, &RegistrySearch{Key: "host"})
+	c.Assert(paths, DeepEquals, []string{root + "/db/host", root + "/secret/host", root + "/web/host",
+		root + "/db/replica/host"})
+	c.Assert(truncated, Equals, false)
+
+	paths, _ = search_paths(suite.c, &RegistrySearch{Key: "host", Depth: 2})
+	c.Assert(paths, DeepEquals, []string{root + "/db/host", root + "/secret/host", root + "/web/host"})
+
+	paths, truncated = search_paths(suite.c, &RegistrySearch{Key: "host", Limit: 2})
+	c.Assert(paths, DeepEquals, []string{root + "/db/host", root + "/secret/host"})
+	c.Assert(truncated, Equals, true)
+
+	paths, _ = search_paths(suite.c, &RegistrySearch{Key: root + "/*/port", ValueRegex: "^[0-9]{4}$"})
+	c.Assert(paths, DeepEquals, []string{root + "/db/port", root + "/web/port"})
+
+	paths, _ = search_paths(suite.c, &RegistrySearch{Value: "10.0.2."})
+	c.Assert(paths, DeepEquals, []string{root + "/db/host", root + "/db/replica/host"})
+
+	// Entries the user cannot read are left out
+	acl, rev, err := reg.GetAcl(suite.c)
+	c.Assert(err, Equals, nil)
+	saved := *acl
+	defer func() {
+		_, rev, _ := reg.GetAcl(suite.c)
+		reg.SaveAcl(suite.c, &saved, rev)
+	}()
+	_, err = reg.SaveAcl(suite.c, &RegistryAcl{Rules: []RegistryAclRule{
+		{Prefix: root + "/secret", User: "test", Access: RegistryAccessRead},
+	}}, rev)
+	c.Assert(err, Equals, nil)
+
+	paths, _ = search_paths(test_context("other"), &RegistrySearch{Key: "host", Depth: 2})
+	c.Assert(paths, DeepEquals, []string{root + "/db/host", root + "/web/host"})
+	paths, _ = search_paths(suite.c, &RegistrySearch{Key: "host", Depth: 2})
+	c.Assert(paths, DeepEquals, []string{root + "/db/host", root + "/secret/host", root + "/web/host"})
+
+	_, err = reg.SearchEntries(suite.c, root, &RegistrySearch{})
+	c.Assert(err, Equals, ErrBadSearch)
+	_, err = reg.SearchEntries(suite.c, root+"/none", &RegistrySearch{Key: "*"})
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (suite *RegistryTests) TestTransaction(c *C) {
+	reg := NewService(suite.store)
+
+	root := fmt.Sprintf("/unit-test/registry/txn-%d", time.Now().UnixNano())
+	set(c, suite.store, root+"/pointer", "v1")
+	set(c, suite.store, root+"/meta", "m1")
+	set(c, suite.store, root+"/old", "o")
+
+	result, err := reg.Transaction(suite.c, &RegistryTxn{Ops: []RegistryTxnOp{
+		{Op: RegistryTxnSet, Path: root + "/pointer", Value: "v2", Version: 0},
+		{Op: RegistryTxnSet, Path: root + "/meta", Value: "m2", Version: 0},
+		{Op: RegistryTxnCreate, Path: root + "/v2", Value: "new"},
+		{Op: RegistryTxnCreate, Path: root + "/v2/notes", Value: "notes"},
+		{Op: RegistryTxnDelete, Path: root + "/old", Version: 0},
+	}})
+	c.Assert(err, Equals, nil)
+	c.Assert(result.Revisions, DeepEquals, map[string]Revision{
+		root + "/pointer": 1, root + "/meta": 1, root + "/v2": 0, root + "/v2/notes": 0,
+	})
+
+	value, rev, err := reg.GetEntry(suite.c, root+"/pointer")
+	c.Assert(err, Equals, nil)
+	c.Assert(string(value), Equals, "v2")
+	c.Assert(rev, Equals, Revision(1))
+	_, _, err = reg.GetEntry(suite.c, root+"/old")
+	c.Assert(err, Equals, ErrNotFound)
+
+	// Nothing is written when an operation fails, and the error tells which
+	failed := func(ops ...RegistryTxnOp) *RegistryTxnError {
+		_, err := reg.Transaction(suite.c, &RegistryTxn{Ops: ops})
+		txn_err, ok := err.(*RegistryTxnError)
+		c.Assert(ok, Equals, true)
+		return txn_err
+	}
+	err = failed(
+		RegistryTxnOp{Op: RegistryTxnSet, Path: root + "/meta", Value: "m3", Version: 1},
+		RegistryTxnOp{Op: RegistryTxnCheck, Path: root + "/pointer", Version: 0},
+	)
+	c.Assert(err, DeepEquals, &RegistryTxnError{Message: "txn-failed", Op: 1, Path: root + "/pointer",
+		Reason: RegistryTxnVersionMismatch})
+	value, _, _ = reg.GetEntry(suite.c, root+"/meta")
+	c.Assert(string(value), Equals, "m2")
+
+	c.Assert(failed(
+		RegistryTxnOp{Op: RegistryTxnCreate, Path: root + "/v2"},
+	).Reason, Equals, RegistryTxnExists)
+	c.Assert(failed(
+		RegistryTxnOp{Op: RegistryTxnCreate, Path: root + "/x/y"},
+	).Reason, Equals, RegistryTxnNotFound)
+	c.Assert(failed(
+		RegistryTxnOp{Op: RegistryTxnDelete, Path: root + "/v2", Version: 0},
+	).Reason, Equals, RegistryTxnNotEmpty)
+
+	// An entry written by someone else since it was read
+	set(c, suite.store, root+"/pointer", "v3")
+	c.Assert(failed(
+		RegistryTxnOp{Op: RegistryTxnCreate, Path: root + "/v3", Value: "new"},
+		RegistryTxnOp{Op: RegistryTxnDelete, Path: root + "/v3", Version: 0},
+		RegistryTxnOp{Op: RegistryTxnSet, Path: root + "/pointer", Value: "v3", Version: 1},
+	), DeepEquals, &RegistryTxnError{Message: "txn-failed", Op: 2, Path: root + "/pointer",
+		Reason: RegistryTxnVersionMismatch})
+	_, _, err = reg.GetEntry(suite.c, root+"/v3")
+	c.Assert(err, Equals, ErrNotFound)
+
+	_, err = reg.Transaction(suite.c, &RegistryTxn{})
+	c.Assert(err, Equals, ErrBadTxn)
+	_, err = reg.Transaction(suite.c, &RegistryTxn{Ops: []RegistryTxnOp{
+		{Op: RegistryTxnSet, Path: root + "/pointer", Value: "v4", Version: -1},
+	}})
+	c.Assert(err, Equals, ErrBadTxn)
+}
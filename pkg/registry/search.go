@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A search reads every node it visits, so both how deep it goes and how many entries it
+// returns are bounded.
+const (
+	search_default_depth = 5
+	search_max_depth     = 16
+	search_default_limit = 100
+	search_max_limit     = 1000
+)
+
+type matcher struct {
+	key   string
+	value string
+	regex *regexp.Regexp
+}
+
+func new_matcher(search *RegistrySearch) (*matcher, error) {
+	if search.Key == "" && search.Value == "" && search.ValueRegex == "" {
+		return nil, ErrBadSearch
+	}
+	m := &matcher{key: search.Key, value: search.Value}
+	if m.key != "" {
+		if _, err := path.Match(m.key, ""); err != nil {
+			return nil, ErrBadSearch
+		}
+	}
+	if search.ValueRegex != "" {
+		regex, err := regexp.Compile(search.ValueRegex)
+		if err != nil {
+			return nil, ErrBadSearch
+		}
+		m.regex = regex
+	}
+	return m, nil
+}
+
+func (this *matcher) match(n *kv.Node) bool {
+	if this.key != "" {
+		name := n.GetBasename()
+		if strings.HasPrefix(this.key, "/") {
+			name = n.GetPath()
+		}
+		if ok, _ := path.Match(this.key, name); !ok {
+			return false
+		}
+	}
+	value := n.GetValueString()
+	if this.value != "" && !strings.Contains(value, this.value) {
+		return false
+	}
+	if this.regex != nil && !this.regex.MatchString(value) {
+		return false
+	}
+	return true
+}
+
+// The value if it is given, else the default, and never more than max
+func bounded(value, default_value, max int) int {
+	switch {
+	case value <= 0:
+		return default_value
+	case value > max:
+		return max
+	}
+	return value
+}
+
+// RegistryService
+//
+// The subtree is read a level at a time so that the shallowest entries are found first and
+// nothing below the depth is read.  Entries the user cannot read are left out.
+func (this *Service) SearchEntries(c Context, key string, search *RegistrySearch) (*RegistrySearchResult, error) {
+	glog.Infoln("SearchEntries:", c.UserId(), "Key=", key, "Search=", search)
+
+	m, err := new_matcher(search)
+	if err != nil {
+		return nil, err
+	}
+	depth := bounded(search.Depth, search_default_depth, search_max_depth)
+	limit := bounded(search.Limit, search_default_limit, search_max_limit)
+
+	_, err = this.conn.Get(key)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	acl, _, err := this.GetAcl(c)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RegistrySearchResult{Entries: []RegistryEntry{}}
+	level := []string{key}
+	for d := 0; d < depth && len(level) > 0; d++ {
+		next := []string{}
+		for _, parent := range level {
+			children, err := this.conn.Children(parent)
+			switch {
+			case err == kv.ErrNotExist:
+				// Deleted since we saw it
+				continue
+			case err != nil:
+				return nil, err
+			}
+			sort.Sort(by_path(children))
+			for _, n := range children {
+				if under(reserved_root, n.GetPath()) {
+					continue
+				}
+				if n.NumChildren > 0 {
+					next = append(next, n.GetPath())
+				}
+				if !m.match(n) || !has_access(acl, c, n.GetPath(), RegistryAccessRead) {
+					continue
+				}
+				if len(result.Entries) == limit {
+					result.Truncated = true
+					return result, nil
+				}
+				result.Entries = append(result.Entries, *this.registry_entry(n))
+			}
+		}
+		level = next
+	}
+	return result, nil
+}
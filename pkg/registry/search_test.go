@@ -0,0 +1,48 @@
+package registry
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	. "gopkg.in/check.v1"
+)
+
+type SearchTests struct{}
+
+var _ = Suite(&SearchTests{})
+
+func node(path, value string) *kv.Node {
+	return &kv.Node{Path: path, Value: []byte(value)}
+}
+
+func (suite *SearchTests) TestMatcher(c *C) {
+	_, err := new_matcher(&RegistrySearch{})
+	c.Assert(err, Equals, ErrBadSearch)
+	_, err = new_matcher(&RegistrySearch{Key: "[a-"})
+	c.Assert(err, Equals, ErrBadSearch)
+	_, err = new_matcher(&RegistrySearch{ValueRegex: "(a"})
+	c.Assert(err, Equals, ErrBadSearch)
+
+	m, err := new_matcher(&RegistrySearch{Key: "port*"})
+	c.Assert(err, Equals, nil)
+	c.Assert(m.match(node("/app/web/port", "80")), Equals, true)
+	c.Assert(m.match(node("/app/web/host", "web")), Equals, false)
+
+	m, err = new_matcher(&RegistrySearch{Key: "/app/*/port"})
+	c.Assert(err, Equals, nil)
+	c.Assert(m.match(node("/app/web/port", "80")), Equals, true)
+	c.Assert(m.match(node("/app/web/v1/port", "80")), Equals, false)
+
+	m, err = new_matcher(&RegistrySearch{Key: "host", Value: "10.0.", ValueRegex: ":[0-9]+$"})
+	c.Assert(err, Equals, nil)
+	c.Assert(m.match(node("/db/host", "10.0.1.2:5432")), Equals, true)
+	c.Assert(m.match(node("/db/host", "10.0.1.2")), Equals, false)
+	c.Assert(m.match(node("/db/host", "192.168.1.2:5432")), Equals, false)
+	c.Assert(m.match(node("/db/name", "10.0.1.2:5432")), Equals, false)
+}
+
+func (suite *SearchTests) TestBounded(c *C) {
+	c.Assert(bounded(0, 5, 16), Equals, 5)
+	c.Assert(bounded(-1, 5, 16), Equals, 5)
+	c.Assert(bounded(3, 5, 16), Equals, 3)
+	c.Assert(bounded(100, 5, 16), Equals, 16)
+}
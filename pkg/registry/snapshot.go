@@ -0,0 +1,193 @@
+package registry
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Path of the node relative to the root of the subtree
+func relative(root, path string) string {
+	if path == root {
+		return "/"
+	}
+	if root == "/" {
+		return path
+	}
+	return path[len(root):]
+}
+
+func absolute(root, rel string) string {
+	if rel == "/" {
+		return root
+	}
+	if root == "/" {
+		return rel
+	}
+	return root + rel
+}
+
+// RegistryService
+//
+// Entries the user cannot read are left out, with everything below them.
+func (this *Service) ExportEntries(c Context, key string) (*RegistrySnapshot, error) {
+	glog.Infoln("ExportEntries:", c.UserId(), "Key=", key)
+	zn, err := this.conn.Get(key)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+	nodes, err := kv.Walk(this.conn, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	acl, _, err := this.GetAcl(c)
+	if err != nil {
+		return nil, err
+	}
+	nodes = append(nodes, zn)
+	sort.Sort(by_path(nodes))
+	nodes = readable(acl, c, nodes)
+
+	snapshot := &RegistrySnapshot{Root: key, Entries: []RegistryEntry{}}
+	for _, n := range nodes {
+		snapshot.Entries = append(snapshot.Entries, RegistryEntry{
+			Path:    relative(key, n.GetPath()),
+			Value:   n.GetValueString(),
+			Version: Revision(n.Version),
+		})
+	}
+	return snapshot, nil
+}
+
+// Paths must be clean and every entry's parent must be in the snapshot, except for the
+// root's.  Returns the entries sorted so parents come first.
+func check_snapshot(snapshot *RegistrySnapshot) ([]RegistryEntry, error) {
+	entries := append([]RegistryEntry{}, snapshot.Entries...)
+	sort.Sort(by_entry_path(entries))
+	seen := map[string]bool{"/": true}
+	for i, entry := range entries {
+		if !strings.HasPrefix(entry.Path, "/") || filepath.Clean(entry.Path) != entry.Path {
+			return nil, ErrBadSnapshot
+		}
+		if i > 0 && entries[i-1].Path == entry.Path {
+			return nil, ErrBadSnapshot
+		}
+		if entry.Path != "/" && !seen[filepath.Dir(entry.Path)] {
+			return nil, ErrBadSnapshot
+		}
+		seen[entry.Path] = true
+	}
+	return entries, nil
+}
+
+type by_entry_path []RegistryEntry
+
+func (p by_entry_path) Len() int           { return len(p) }
+func (p by_entry_path) Less(i, j int) bool { return p[i].Path < p[j].Path }
+func (p by_entry_path) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// RegistryService
+//
+// The entries are written in one transaction, so either all of them are or none are.
+// Existing entries with a different value are set in overwrite mode and left alone in skip
+// mode.  A dry run reports the same but writes nothing.  Returns ErrForbidden if the user
+// cannot update any of the entries.
+func (this *Service) ImportEntries(c Context, key string, snapshot *RegistrySnapshot, mode string, dryRun bool) (*RegistryImportResult, error) {
+	glog.Infoln("ImportEntries:", c.UserId(), "Key=", key, "Mode=", mode, "DryRun=", dryRun)
+
+	if mode != RegistryImportSkip && mode != RegistryImportOverwrite {
+		return nil, ErrBadImportMode
+	}
+	entries, err := check_snapshot(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	acl, _, err := this.GetAcl(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !has_access(acl, c, absolute(key, entry.Path), RegistryAccessUpdate) {
+			glog.Infoln("ImportEntries:", c.UserId(), "Key=", absolute(key, entry.Path), "Forbidden")
+			return nil, ErrForbidden
+		}
+	}
+
+	result := &RegistryImportResult{
+		DryRun:    dryRun,
+		Created:   []string{},
+		Updated:   []string{},
+		Skipped:   []string{},
+		Unchanged: []string{},
+	}
+
+	// The root may not be in the snapshot
+	if len(entries) == 0 || entries[0].Path != "/" {
+		entries = append([]RegistryEntry{RegistryEntry{Path: "/"}}, entries...)
+	}
+
+	ops := []kv.Op{}
+	for i, entry := range entries {
+		path := absolute(key, entry.Path)
+		zn, err := this.conn.Get(path)
+		switch {
+		case err == kv.ErrNotExist:
+			ops = append(ops, kv.OpCreate(path, []byte(entry.Value)))
+			result.Created = append(result.Created, path)
+		case err != nil:
+			return nil, err
+		case i == 0 && len(snapshot.Entries) < len(entries):
+			// The root is not in the snapshot and is already there
+		case zn.GetValueString() == entry.Value:
+			result.Unchanged = append(result.Unchanged, path)
+		case mode == RegistryImportOverwrite:
+			ops = append(ops, kv.OpSet(path, []byte(entry.Value), zn.Version))
+			result.Updated = append(result.Updated, path)
+		default:
+			result.Skipped = append(result.Skipped, path)
+		}
+	}
+
+	if dryRun || len(ops) == 0 {
+		return result, nil
+	}
+	// The multi does not create the parents of the root
+	if err := this.ensure_parents(key); err != nil {
+		return nil, err
+	}
+	_, err = this.conn.Multi(ops...)
+	switch {
+	case err == kv.ErrBadVersion, err == kv.ErrNodeExists, err == kv.ErrNotExist:
+		return nil, ErrConflict
+	case err != nil:
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *Service) ensure_parents(key string) error {
+	parts := strings.Split(strings.Trim(filepath.Dir(key), "/"), "/")
+	path := ""
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		path = path + "/" + part
+		_, err := this.conn.Get(path)
+		switch {
+		case err == kv.ErrNotExist:
+			if _, err := this.conn.Create(path, []byte{}); err != nil && err != kv.ErrNodeExists {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
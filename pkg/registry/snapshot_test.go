@@ -0,0 +1,37 @@
+package registry
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type SnapshotTests struct{}
+
+var _ = Suite(&SnapshotTests{})
+
+func (suite *SnapshotTests) TestPaths(c *C) {
+	c.Assert(relative("/a/b", "/a/b"), Equals, "/")
+	c.Assert(relative("/a/b", "/a/b/c"), Equals, "/c")
+	c.Assert(relative("/", "/a"), Equals, "/a")
+	c.Assert(absolute("/x", "/"), Equals, "/x")
+	c.Assert(absolute("/x", "/c/d"), Equals, "/x/c/d")
+	c.Assert(absolute("/", "/c"), Equals, "/c")
+}
+
+func (suite *SnapshotTests) TestCheckSnapshot(c *C) {
+	entries, err := check_snapshot(&RegistrySnapshot{Entries: []RegistryEntry{
+		{Path: "/a/b"}, {Path: "/"}, {Path: "/a"},
+	}})
+	c.Assert(err, Equals, nil)
+	c.Assert(entries, DeepEquals, []RegistryEntry{{Path: "/"}, {Path: "/a"}, {Path: "/a/b"}})
+
+	for _, bad := range [][]RegistryEntry{
+		{{Path: "a"}},
+		{{Path: "/a/../b"}},
+		{{Path: "/a"}, {Path: "/a"}},
+		{{Path: "/a/b"}}, // no parent
+	} {
+		_, err := check_snapshot(&RegistrySnapshot{Entries: bad})
+		c.Assert(err, Equals, ErrBadSnapshot)
+	}
+}
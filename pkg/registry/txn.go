@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"path/filepath"
+)
+
+func check_txn(txn *RegistryTxn) error {
+	if len(txn.Ops) == 0 {
+		return ErrBadTxn
+	}
+	for _, op := range txn.Ops {
+		if op.Path == "" || op.Path[0] != '/' || filepath.Clean(op.Path) != op.Path {
+			return ErrBadTxn
+		}
+		// Any version is not allowed, or the revisions after the commit would not be known
+		if op.Version < 0 {
+			return ErrBadTxn
+		}
+		switch op.Op {
+		case RegistryTxnCheck, RegistryTxnSet:
+		case RegistryTxnCreate, RegistryTxnDelete:
+			if op.Path == "/" {
+				return ErrBadTxn
+			}
+		default:
+			return ErrBadTxn
+		}
+	}
+	return nil
+}
+
+func kv_op(op RegistryTxnOp) kv.Op {
+	switch op.Op {
+	case RegistryTxnSet:
+		return kv.OpSet(op.Path, []byte(op.Value), int32(op.Version))
+	case RegistryTxnCreate:
+		return kv.OpCreate(op.Path, []byte(op.Value))
+	case RegistryTxnDelete:
+		return kv.OpDelete(op.Path, int32(op.Version))
+	default:
+		return kv.OpCheck(op.Path, int32(op.Version))
+	}
+}
+
+// The versions after a transaction that went through.  Every check, set and delete was at the
+// version it gave, so nothing needs to be read.
+func txn_revisions(txn *RegistryTxn) map[string]Revision {
+	revisions := map[string]Revision{}
+	for _, op := range txn.Ops {
+		switch op.Op {
+		case RegistryTxnCheck:
+			revisions[op.Path] = op.Version
+		case RegistryTxnSet:
+			revisions[op.Path] = op.Version + 1
+		case RegistryTxnCreate:
+			revisions[op.Path] = Revision(0)
+		case RegistryTxnDelete:
+			delete(revisions, op.Path)
+		}
+	}
+	return revisions
+}
+
+func txn_reason(err error) string {
+	switch err {
+	case kv.ErrBadVersion:
+		return RegistryTxnVersionMismatch
+	case kv.ErrNotExist:
+		return RegistryTxnNotFound
+	case kv.ErrNodeExists:
+		return RegistryTxnExists
+	case kv.ErrNotEmpty:
+		return RegistryTxnNotEmpty
+	}
+	return ""
+}
+
+// The multi does not tell which of its operations failed, so they are applied again to what
+// is in the store now to find the first that fails.
+func (this *Service) txn_error(ops []kv.Op, txn *RegistryTxn, err error) error {
+	i, failed := kv.FailedOp(this.conn, ops...)
+	switch {
+	case failed != nil && txn_reason(failed) == "":
+		return failed
+	case i < 0:
+		return &RegistryTxnError{Message: "txn-failed", Op: -1, Reason: txn_reason(err)}
+	}
+	return &RegistryTxnError{Message: "txn-failed", Op: i, Path: txn.Ops[i].Path, Reason: txn_reason(failed)}
+}
+
+// RegistryService
+func (this *Service) Transaction(c Context, txn *RegistryTxn) (*RegistryTxnResult, error) {
+	glog.Infoln("Transaction:", c.UserId(), "Ops=", len(txn.Ops))
+	if err := check_txn(txn); err != nil {
+		return nil, err
+	}
+	ops := make([]kv.Op, len(txn.Ops))
+	for i, op := range txn.Ops {
+		ops[i] = kv_op(op)
+	}
+	_, err := this.conn.Multi(ops...)
+	switch {
+	case txn_reason(err) != "":
+		return nil, this.txn_error(ops, txn, err)
+	case err != nil:
+		return nil, err
+	}
+	return &RegistryTxnResult{Revisions: txn_revisions(txn)}, nil
+}
@@ -0,0 +1,42 @@
+package registry
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type TxnTests struct{}
+
+var _ = Suite(&TxnTests{})
+
+func (suite *TxnTests) TestCheckTxn(c *C) {
+	c.Assert(check_txn(&RegistryTxn{Ops: []RegistryTxnOp{
+		{Op: RegistryTxnCheck, Path: "/"},
+		{Op: RegistryTxnSet, Path: "/a", Value: "a"},
+		{Op: RegistryTxnCreate, Path: "/a/b"},
+		{Op: RegistryTxnDelete, Path: "/a/c", Version: 2},
+	}}), Equals, nil)
+
+	c.Assert(check_txn(&RegistryTxn{}), Equals, ErrBadTxn)
+	for _, bad := range []RegistryTxnOp{
+		{Op: "update", Path: "/a"},
+		{Op: RegistryTxnSet, Path: "a"},
+		{Op: RegistryTxnSet, Path: "/a/"},
+		{Op: RegistryTxnSet, Path: ""},
+		{Op: RegistryTxnDelete, Path: "/"},
+		{Op: RegistryTxnSet, Path: "/a", Version: -1},
+		{Op: RegistryTxnCheck, Path: "/a", Version: -1},
+	} {
+		c.Assert(check_txn(&RegistryTxn{Ops: []RegistryTxnOp{bad}}), Equals, ErrBadTxn)
+	}
+}
+
+func (suite *TxnTests) TestRevisions(c *C) {
+	c.Assert(txn_revisions(&RegistryTxn{Ops: []RegistryTxnOp{
+		{Op: RegistryTxnCheck, Path: "/a", Version: 3},
+		{Op: RegistryTxnSet, Path: "/b", Version: 1},
+		{Op: RegistryTxnSet, Path: "/b", Version: 2},
+		{Op: RegistryTxnCreate, Path: "/c"},
+		{Op: RegistryTxnDelete, Path: "/d", Version: 0},
+	}}), DeepEquals, map[string]Revision{"/a": 3, "/b": 3, "/c": 0})
+}
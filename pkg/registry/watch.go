@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/kv"
+	"sort"
+)
+
+// What we last saw of a watched node.  Cversion changes whenever a child is added or removed.
+type watched struct {
+	value       string
+	version     int32
+	cversion    int32
+	numChildren int32
+}
+
+// Watched nodes, keyed by path
+type tree map[string]watched
+
+func (this tree) event(path, action string) RegistryChangeEvent {
+	n := this[path]
+	return RegistryChangeEvent{Path: path, Action: action, Value: n.value, Version: Revision(n.version),
+		NumChildren: n.numChildren}
+}
+
+// The entries as they are, in path order
+func current(t tree) []RegistryChangeEvent {
+	events := []RegistryChangeEvent{}
+	for path, _ := range t {
+		events = append(events, t.event(path, RegistryEventCurrent))
+	}
+	sort.Sort(by_event_path(events))
+	return events
+}
+
+// The changes that turn before into after, in path order.  A node can both change its value
+// and its children, in which case there is an event for each.
+func tree_changes(before, after tree) []RegistryChangeEvent {
+	events := []RegistryChangeEvent{}
+	for path, n := range after {
+		old, has := before[path]
+		switch {
+		case !has:
+			events = append(events, after.event(path, RegistryEventCreate))
+			continue
+		case old.version != n.version || old.value != n.value:
+			events = append(events, after.event(path, RegistryEventChange))
+		}
+		if old.cversion != n.cversion {
+			events = append(events, after.event(path, RegistryEventChildren))
+		}
+	}
+	for path, _ := range before {
+		if _, has := after[path]; !has {
+			events = append(events, RegistryChangeEvent{Path: path, Action: RegistryEventDelete})
+		}
+	}
+	sort.Sort(by_event_path(events))
+	return events
+}
+
+type by_event_path []RegistryChangeEvent
+
+func (p by_event_path) Len() int           { return len(p) }
+func (p by_event_path) Less(i, j int) bool { return p[i].Path < p[j].Path }
+func (p by_event_path) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Sets the watches on the node at path, unless they are still set, and reads it.  The exists
+// watch fires when the node is created, changed or deleted and the children watch when a child
+// is added or removed.  They are set before the node is read, so a change made while we read
+// fires them and is not lost.  With recursive the children the user can read are read and
+// watched as well.
+func (this *Service) watch_tree(c Context, acl *RegistryAcl, path string, recursive bool, watches *kv.Watches, t tree, seen map[string]bool) error {
+	seen[path] = true
+	if err := watches.Watch(path); err != nil {
+		return err
+	}
+	err := watches.WatchChildren(path)
+	switch {
+	case err == kv.ErrNotExist:
+		// Not there, or deleted since.  The exists watch fires when that changes.
+		return nil
+	case err != nil:
+		return err
+	}
+
+	zn, err := this.conn.Get(path)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil
+	case err != nil:
+		return err
+	}
+	t[path] = watched{
+		value:       zn.GetValueString(),
+		version:     zn.Version,
+		cversion:    zn.Cversion,
+		numChildren: zn.NumChildren,
+	}
+	if !recursive {
+		return nil
+	}
+
+	children, err := this.conn.Children(path)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil
+	case err != nil:
+		return err
+	}
+	for _, child := range children {
+		if !has_access(acl, c, child.Path, RegistryAccessRead) {
+			continue
+		}
+		if err := this.watch_tree(c, acl, child.Path, recursive, watches, t, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegistryService
+//
+// Watches fire only once.  Each time one fires it is set again, the watches of nodes that are
+// gone or no longer readable are stopped and the tree is read again to find what changed,
+// under the rules as they are then.  The channel is closed when stop is closed or sent to.
+func (this *Service) WatchEntries(c Context, key string, recursive bool, stop <-chan bool) (<-chan RegistryChangeEvent, error) {
+	glog.Infoln("WatchEntries:", c.UserId(), "Key=", key, "Recursive=", recursive)
+
+	_, err := this.conn.Get(key)
+	switch {
+	case err == kv.ErrNotExist:
+		return nil, ErrNotFound
+	case err != nil:
+		return nil, err
+	}
+
+	events := make(chan RegistryChangeEvent)
+	go this.watch(c, key, recursive, events, stop)
+	return events, nil
+}
+
+func (this *Service) watch(c Context, key string, recursive bool, events chan<- RegistryChangeEvent, stop <-chan bool) {
+	defer close(events)
+	watches := kv.NewWatches(this.conn)
+	defer watches.Close()
+
+	var before tree
+	for {
+		after := tree{}
+		seen := map[string]bool{}
+		acl, _, err := this.GetAcl(c)
+		if err == nil {
+			err = this.watch_tree(c, acl, key, recursive, watches, after, seen)
+		}
+		if err != nil {
+			glog.Warningln("Cannot watch", key, "Err=", err)
+			return
+		}
+		watches.Keep(seen)
+
+		var changes []RegistryChangeEvent
+		if before == nil {
+			changes = current(after)
+		} else {
+			changes = tree_changes(before, after)
+		}
+		for _, event := range changes {
+			select {
+			case events <- event:
+			case <-stop:
+				return
+			}
+		}
+		before = after
+
+		select {
+		case <-watches.Fired():
+		case <-stop:
+			glog.Infoln("Stopped watching", key)
+			return
+		}
+	}
+}
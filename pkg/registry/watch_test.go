@@ -0,0 +1,41 @@
+package registry
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	. "gopkg.in/check.v1"
+)
+
+type WatchTests struct{}
+
+var _ = Suite(&WatchTests{})
+
+func (suite *WatchTests) TestCurrent(c *C) {
+	t := tree{
+		"/a/b": {value: "b", version: 2},
+		"/a":   {value: "a", version: 1, numChildren: 1},
+	}
+	c.Assert(current(t), DeepEquals, []RegistryChangeEvent{
+		{Path: "/a", Action: RegistryEventCurrent, Value: "a", Version: 1, NumChildren: 1},
+		{Path: "/a/b", Action: RegistryEventCurrent, Value: "b", Version: 2},
+	})
+}
+
+func (suite *WatchTests) TestTreeChanges(c *C) {
+	before := tree{
+		"/a":   {value: "a", version: 1, cversion: 1, numChildren: 2},
+		"/a/b": {value: "b"},
+		"/a/c": {value: "c"},
+	}
+	after := tree{
+		"/a":   {value: "a2", version: 2, cversion: 3, numChildren: 2},
+		"/a/b": {value: "b"},
+		"/a/d": {value: "d"},
+	}
+	c.Assert(tree_changes(before, after), DeepEquals, []RegistryChangeEvent{
+		{Path: "/a", Action: RegistryEventChange, Value: "a2", Version: 2, NumChildren: 2},
+		{Path: "/a", Action: RegistryEventChildren, Value: "a2", Version: 2, NumChildren: 2},
+		{Path: "/a/c", Action: RegistryEventDelete},
+		{Path: "/a/d", Action: RegistryEventCreate, Value: "d"},
+	})
+	c.Assert(tree_changes(after, after), DeepEquals, []RegistryChangeEvent{})
+}
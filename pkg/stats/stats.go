@@ -0,0 +1,220 @@
+package stats
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/redpill/pkg/api"
+	"sync"
+	"time"
+)
+
+// The stats of a domain class are no longer refreshed once they have not been read for this
+// many refreshes.  The next read computes them again.
+const idle_refreshes = 10
+
+// The user the stats were last read by.  Only the viewers of the whole domain class can read
+// them, so refreshing as that user sees all of the class.
+type reader struct {
+	user   string
+	groups []string
+}
+
+func (this reader) UserId() string {
+	return this.user
+}
+
+func (this reader) Groups() []string {
+	return this.groups
+}
+
+func (this reader) UrlParameter(k string) string {
+	return ""
+}
+
+type cached struct {
+	stats  *DomainStats
+	reader reader
+	read   time.Time
+}
+
+type statsService struct {
+	env         EnvService
+	domain      DomainService
+	orchestrate OrchestrateService
+	refresh     time.Duration
+
+	lock  sync.Mutex
+	cache map[string]*cached
+	done  chan bool
+}
+
+// Stats are refreshed in the background every refresh, for the domain classes that have
+// been read recently.
+func NewService(env EnvService, domain DomainService, orchestrate OrchestrateService, refresh time.Duration) StatsService {
+	s := &statsService{
+		env:         env,
+		domain:      domain,
+		orchestrate: orchestrate,
+		refresh:     refresh,
+		cache:       map[string]*cached{},
+		done:        make(chan bool),
+	}
+	go s.refresh_loop()
+	return s
+}
+
+func (this *statsService) stop() {
+	close(this.done)
+}
+
+func (this *statsService) refresh_loop() {
+	ticker := time.NewTicker(this.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+			this.refresh_all()
+		}
+	}
+}
+
+// The readers of the domain classes to refresh.  Those not read for a while are dropped.
+func (this *statsService) readers() map[string]reader {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	readers := map[string]reader{}
+	for domainClass, entry := range this.cache {
+		if time.Since(entry.read) > idle_refreshes*this.refresh {
+			delete(this.cache, domainClass)
+			continue
+		}
+		readers[domainClass] = entry.reader
+	}
+	return readers
+}
+
+func (this *statsService) refresh_all() {
+	for domainClass, r := range this.readers() {
+		stats, err := this.compute(r, domainClass)
+		this.lock.Lock()
+		entry, has := this.cache[domainClass]
+		switch {
+		case !has:
+		case err == ErrNotFound, err == ErrForbidden:
+			delete(this.cache, domainClass)
+		case err != nil:
+			glog.Warningln("Refresh stats:", r.UserId(), "DomainClass=", domainClass, "Err=", err)
+		default:
+			entry.stats = stats
+		}
+		this.lock.Unlock()
+	}
+}
+
+func distinct(values []string) int {
+	seen := map[string]bool{}
+	for _, v := range values {
+		seen[v] = true
+	}
+	return len(seen)
+}
+
+func (this *statsService) compute(c Context, domainClass string) (*DomainStats, error) {
+	detail, err := this.domain.GetDomain(c, domainClass)
+	if err != nil {
+		return nil, err
+	}
+	envs, err := this.env.ListEnvs(c, domainClass)
+	if err != nil {
+		return nil, err
+	}
+	models, err := this.orchestrate.ListOrchestrations(c, domainClass)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DomainStats{
+		Class: domainClass,
+		Environments: DomainEnvironmentStats{
+			Domains:  len(detail.Instances),
+			Retired:  len(detail.InstanceInfo) - len(detail.Instances),
+			Services: len(envs),
+		},
+		Orchestrations: DomainOrchestrationStats{
+			Models: len(models),
+			Status: map[string]int{},
+		},
+		Instances:  []DomainInstanceStats{},
+		UpdateTime: time.Now(),
+	}
+	// The status of the runs of each domain instance, listed once for each model
+	runs := map[string][]string{}
+	for _, model := range models {
+		list, err := this.orchestrate.ListClassInstances(c, domainClass, model.GetName())
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range list {
+			runs[run.Info().Domain] = append(runs[run.Info().Domain], run.Info().Status)
+		}
+	}
+
+	services := map[string]int{}
+	for _, env := range envs {
+		stats.Environments.Versions += distinct(env.Versions)
+		stats.Environments.Live += len(env.Live)
+		for _, instance := range env.Instances {
+			services[instance]++
+		}
+	}
+
+	for _, instance := range detail.InstanceInfo {
+		s := DomainInstanceStats{
+			Name:     instance.Name,
+			Tier:     instance.Tier,
+			Retired:  instance.RetireTime != nil,
+			Services: services[instance.Name],
+		}
+		for _, env := range envs {
+			if _, has := env.Live[instance.Name]; has {
+				s.Live++
+			}
+		}
+		for _, status := range runs[instance.Name+"."+domainClass] {
+			stats.Orchestrations.Status[status]++
+			s.Runs++
+		}
+		stats.Orchestrations.AllTime += s.Runs
+		stats.Instances = append(stats.Instances, s)
+	}
+	return stats, nil
+}
+
+// Only the viewers of the whole domain class can see its stats.  They are computed on the
+// first read and then come from the cache.
+func (this *statsService) GetDomainStats(c Context, domainClass string) (*DomainStats, error) {
+	glog.Infoln("GetDomainStats", "UserId=", c.UserId(), "DomainClass=", domainClass)
+	if err := this.domain.CheckMembership(c, domainClass, "", DomainRoleViewer); err != nil {
+		return nil, err
+	}
+	r := reader{user: c.UserId(), groups: c.Groups()}
+
+	this.lock.Lock()
+	if entry, has := this.cache[domainClass]; has {
+		entry.reader, entry.read = r, time.Now()
+		stats := entry.stats
+		this.lock.Unlock()
+		return stats, nil
+	}
+	this.lock.Unlock()
+
+	stats, err := this.compute(r, domainClass)
+	if err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.cache[domainClass] = &cached{stats: stats, reader: r, read: time.Now()}
+	return stats, nil
+}
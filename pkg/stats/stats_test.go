@@ -0,0 +1,202 @@
+package stats
+
+import (
+	. "github.com/infradash/redpill/pkg/api"
+	"github.com/infradash/redpill/pkg/domain"
+	"github.com/infradash/redpill/pkg/kv"
+	"github.com/infradash/redpill/pkg/orchestrate"
+	. "gopkg.in/check.v1"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) { TestingT(t) }
+
+type test_context string
+
+func (t test_context) UserId() string {
+	return string(t)
+}
+func (t test_context) Groups() []string {
+	return nil
+}
+func (t test_context) UrlParameter(k string) string {
+	return ""
+}
+
+type fake_env struct {
+	EnvService
+	lock sync.Mutex
+	envs []Env
+}
+
+func (this *fake_env) ListEnvs(c Context, domainClass string) ([]Env, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.envs, nil
+}
+
+func (this *fake_env) set(envs []Env) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.envs = envs
+}
+
+type fake_model string
+
+func (this fake_model) GetName() string                         { return string(this) }
+func (this fake_model) GetFriendlyName() string                 { return string(this) }
+func (this fake_model) GetDescription() string                  { return "" }
+func (this fake_model) GetDefaultContext() OrchestrationContext { return nil }
+
+// Runs by domain and then by orchestration
+type fake_orchestrate struct {
+	OrchestrateService
+	models []Orchestration
+	runs   map[string]map[string][]string
+	lists  int
+}
+
+func (this *fake_orchestrate) ListOrchestrations(c Context, domainClass string) ([]Orchestration, error) {
+	return this.models, nil
+}
+
+func (this *fake_orchestrate) ListClassInstances(c Context, domainClass, orchestration string) ([]OrchestrationInstance, error) {
+	this.lists++
+	list := []OrchestrationInstance{}
+	for domain, runs := range this.runs {
+		if !strings.HasSuffix(domain, "."+domainClass) {
+			continue
+		}
+		for _, status := range runs[orchestration] {
+			list = append(list, orchestrate.Instance{InstanceInfo: OrchestrationInfo{Domain: domain, Status: status}})
+		}
+	}
+	return list, nil
+}
+
+type StatsTests struct {
+	store       kv.Store
+	c           Context
+	env         *fake_env
+	domain      DomainService
+	orchestrate *fake_orchestrate
+}
+
+var _ = Suite(&StatsTests{})
+
+func (suite *StatsTests) SetUpTest(c *C) {
+	store, err := kv.OpenBoltStore(filepath.Join(c.MkDir(), "stats.db"))
+	c.Assert(err, Equals, nil)
+	suite.store = store
+	suite.c = test_context("test")
+	suite.domain = domain.NewService(store)
+
+	_, err = suite.domain.CreateDomain(suite.c, &Domain{Class: "blinker.com"})
+	c.Assert(err, Equals, nil)
+	for _, i := range []DomainInstance{
+		{Name: "integration", Tier: DomainTierTest},
+		{Name: "production", Tier: DomainTierProduction},
+		{Name: "staging", Tier: DomainTierStaging},
+	} {
+		_, err = suite.domain.AddInstance(suite.c, "blinker.com", &i)
+		c.Assert(err, Equals, nil)
+	}
+	_, err = suite.domain.RetireInstance(suite.c, "blinker.com", "staging")
+	c.Assert(err, Equals, nil)
+
+	suite.env = &fake_env{envs: []Env{
+		{Domain: "blinker.com", Service: "api", Instances: []string{"integration", "production"},
+			Versions: []string{"v1", "v2", "v1"}, Live: map[string]string{"production": "v1"}},
+		{Domain: "blinker.com", Service: "web", Instances: []string{"production"},
+			Versions: []string{"v3"}, Live: map[string]string{"production": "v3"}},
+	}}
+	suite.orchestrate = &fake_orchestrate{
+		models: []Orchestration{fake_model("deploy"), fake_model("backup")},
+		runs: map[string]map[string][]string{
+			"integration.blinker.com": {"deploy": {OrchestrationSucceeded, OrchestrationRunning}},
+			"production.blinker.com":  {"deploy": {OrchestrationSucceeded}, "backup": {OrchestrationFailed}},
+			"staging.blinker.com":     {"backup": {OrchestrationSucceeded}},
+		},
+	}
+}
+
+func (suite *StatsTests) TearDownTest(c *C) {
+	suite.store.Close()
+}
+
+func (suite *StatsTests) TestGetDomainStats(c *C) {
+	s := NewService(suite.env, suite.domain, suite.orchestrate, time.Hour)
+	defer s.(*statsService).stop()
+
+	stats, err := s.GetDomainStats(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(stats.Class, Equals, "blinker.com")
+	c.Assert(stats.Environments, DeepEquals, DomainEnvironmentStats{
+		Domains: 2, Retired: 1, Services: 2, Versions: 3, Live: 2,
+	})
+	c.Assert(stats.Orchestrations, DeepEquals, DomainOrchestrationStats{
+		Models: 2, AllTime: 5, Status: map[string]int{
+			OrchestrationSucceeded: 3, OrchestrationRunning: 1, OrchestrationFailed: 1},
+	})
+	c.Assert(stats.Instances, DeepEquals, []DomainInstanceStats{
+		{Name: "integration", Tier: DomainTierTest, Services: 1, Live: 0, Runs: 2},
+		{Name: "production", Tier: DomainTierProduction, Services: 2, Live: 2, Runs: 2},
+		{Name: "staging", Tier: DomainTierStaging, Retired: true, Services: 0, Live: 0, Runs: 1},
+	})
+	// Listed once for each model, not for each domain instance
+	c.Assert(suite.orchestrate.lists, Equals, 2)
+
+	// Cached until refreshed
+	suite.env.set(nil)
+	again, err := s.GetDomainStats(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(again, Equals, stats)
+
+	_, err = s.GetDomainStats(suite.c, "other.com")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (suite *StatsTests) TestRefresh(c *C) {
+	s := NewService(suite.env, suite.domain, suite.orchestrate, 10*time.Millisecond)
+	defer s.(*statsService).stop()
+
+	stats, err := s.GetDomainStats(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(stats.Environments.Services, Equals, 2)
+
+	suite.env.set([]Env{{Domain: "blinker.com", Service: "api", Instances: []string{"production"},
+		Versions: []string{"v1"}, Live: map[string]string{}}})
+	for i := 0; i < 100 && stats.Environments.Services == 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats, err = s.GetDomainStats(suite.c, "blinker.com")
+		c.Assert(err, Equals, nil)
+	}
+	c.Assert(stats.Environments.Services, Equals, 1)
+	c.Assert(stats.Environments.Live, Equals, 0)
+}
+
+func (suite *StatsTests) TestMembership(c *C) {
+	s := NewService(suite.env, suite.domain, suite.orchestrate, time.Hour)
+	defer s.(*statsService).stop()
+
+	_, err := suite.domain.SaveMembers(suite.c, "blinker.com", &DomainMembers{Members: []DomainMember{
+		{User: "test", Role: DomainRoleAdmin},
+		{User: "dev", Instance: "integration", Role: DomainRoleViewer},
+	}})
+	c.Assert(err, Equals, nil)
+
+	_, err = s.GetDomainStats(test_context("dev"), "blinker.com")
+	c.Assert(err, Equals, ErrForbidden)
+
+	stats, err := s.GetDomainStats(suite.c, "blinker.com")
+	c.Assert(err, Equals, nil)
+	c.Assert(len(stats.Instances), Equals, 3)
+
+	// Not even from the cache
+	_, err = s.GetDomainStats(test_context("dev"), "blinker.com")
+	c.Assert(err, Equals, ErrForbidden)
+}